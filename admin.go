@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/deployment"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/secrets"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// registerAdminRoutes creates the /admin group, authenticated with a bearer token.
+// Returns nil when no admin token is configured.
+func registerAdminRoutes(e *echo.Echo, adminToken string) *echo.Group {
+	if adminToken == "" {
+		log.Println("ADMIN_TOKEN not set - admin API disabled")
+		return nil
+	}
+
+	return e.Group("/admin", middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+		return subtle.ConstantTimeCompare([]byte(key), []byte(adminToken)) == 1, nil
+	}))
+}
+
+// registerSecretRoutes exposes the secrets store. Values can be written but never read back.
+func registerSecretRoutes(admin *echo.Group, store *secrets.Store) {
+	admin.GET("/repos/:repo/secrets", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string][]string{"secrets": store.Names(c.Param("repo"))})
+	})
+
+	admin.PUT("/repos/:repo/secrets/:name", func(c echo.Context) error {
+		value, err := io.ReadAll(c.Request().Body)
+		if err != nil || len(value) == 0 {
+			return c.String(http.StatusBadRequest, "Secret value is required")
+		}
+
+		if err := store.Set(c.Param("repo"), c.Param("name"), string(value)); err != nil {
+			log.Printf("❌ Failed to store secret %s for %s: %v", c.Param("name"), c.Param("repo"), err)
+			return c.String(http.StatusInternalServerError, "Failed to store secret")
+		}
+
+		log.Printf("🔐 Secret %s stored for %s", c.Param("name"), c.Param("repo"))
+		return c.JSON(http.StatusOK, map[string]string{"status": "stored"})
+	})
+
+	admin.DELETE("/repos/:repo/secrets/:name", func(c echo.Context) error {
+		if err := store.Delete(c.Param("repo"), c.Param("name")); err != nil {
+			log.Printf("❌ Failed to delete secret %s for %s: %v", c.Param("name"), c.Param("repo"), err)
+			return c.String(http.StatusInternalServerError, "Failed to delete secret")
+		}
+
+		log.Printf("🔐 Secret %s deleted for %s", c.Param("name"), c.Param("repo"))
+		return c.JSON(http.StatusOK, map[string]string{"status": "deleted"})
+	})
+}
+
+// registerDeploymentRoutes exposes the state of deployments and removes them in bulk
+func registerDeploymentRoutes(admin *echo.Group, provider providers.Provider) {
+	admin.GET("/deployments", func(c echo.Context) error {
+		filter, err := deploymentFilter(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+
+		deployments, err := provider.ListDeployments(c.Request().Context(), filter)
+		if err != nil {
+			log.Printf("❌ Failed to list deployments: %v", err)
+			return c.String(http.StatusInternalServerError, "Failed to list deployments")
+		}
+		return c.JSON(http.StatusOK, map[string]any{"deployments": deployments})
+	})
+
+	// Removes every matching deployment, e.g. before uninstalling; ?dry_run=true only lists them
+	admin.DELETE("/deployments", func(c echo.Context) error {
+		filter, err := deploymentFilter(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		dryRun := c.QueryParam("dry_run") == "true"
+
+		deployments, err := deployment.CleanupAllDeployments(c.Request().Context(), provider, filter, dryRun)
+		response := map[string]any{"deployments": deployments, "dry_run": dryRun}
+		if err != nil {
+			log.Printf("❌ Failed to clean up deployments: %v", err)
+			response["error"] = err.Error()
+			return c.JSON(http.StatusInternalServerError, response)
+		}
+		return c.JSON(http.StatusOK, response)
+	})
+
+	admin.GET("/deployments/:id", func(c echo.Context) error {
+		status, err := provider.GetDeploymentStatus(c.Request().Context(), c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.JSON(http.StatusOK, status)
+	})
+}
+
+// registerGCRoutes runs the garbage collector on demand; ?dry_run=true only reports the orphans
+func registerGCRoutes(admin *echo.Group, collector providers.GarbageCollector, grace time.Duration) {
+	admin.POST("/gc", func(c echo.Context) error {
+		report, err := collector.CollectGarbage(c.Request().Context(), grace, c.QueryParam("dry_run") == "true")
+		if err != nil {
+			log.Printf("❌ Garbage collection failed: %v", err)
+			return c.String(http.StatusInternalServerError, "Garbage collection failed")
+		}
+		return c.JSON(http.StatusOK, report)
+	})
+}
+
+// registerQueueRoutes lets a pull request be redeployed ahead of the queued deploys
+func registerQueueRoutes(admin *echo.Group, queue *deployment.Queue) {
+	admin.POST("/repos/:repo/prs/:number/redeploy", func(c echo.Context) error {
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid PR number")
+		}
+
+		last := queue.Last(deployment.JobKey(c.Param("repo"), number))
+		if last == nil {
+			return c.String(http.StatusNotFound, "No deployment known for this PR")
+		}
+
+		position, err := queue.Enqueue(&deployment.Job{Webhook: last.Webhook, Priority: deployment.PriorityHigh, Force: true})
+		if err != nil {
+			log.Printf("❌ Failed to queue redeploy of PR #%d (%s): %v", number, c.Param("repo"), err)
+			return c.String(http.StatusInternalServerError, "Failed to queue redeploy")
+		}
+		log.Printf("🔁 Redeploy of PR #%d (%s) requested, queue position %d", number, c.Param("repo"), position)
+		return c.JSON(http.StatusAccepted, map[string]any{"status": "queued", "position": position})
+	})
+}
+
+// registerRollbackRoutes lists the deployed commits of a pull request and rolls back to one,
+// the one before the running commit unless ?sha= is given
+func registerRollbackRoutes(admin *echo.Group, queue *deployment.Queue, history *deployment.History, provider providers.Provider) {
+	admin.GET("/repos/:repo/prs/:number/releases", func(c echo.Context) error {
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid PR number")
+		}
+		return c.JSON(http.StatusOK, map[string]any{"releases": history.Releases(deployment.JobKey(c.Param("repo"), number))})
+	})
+
+	admin.POST("/repos/:repo/prs/:number/rollback", func(c echo.Context) error {
+		number, err := strconv.Atoi(c.Param("number"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Invalid PR number")
+		}
+
+		last := queue.Last(deployment.JobKey(c.Param("repo"), number))
+		if last == nil {
+			return c.String(http.StatusNotFound, "No deployment known for this PR")
+		}
+
+		release, position, err := queueRollback(c.Request().Context(), queue, history, provider, last.Webhook, c.QueryParam("sha"))
+		if errors.Is(err, errNoRelease) {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		if err != nil {
+			log.Printf("❌ Failed to queue rollback of PR #%d (%s): %v", number, c.Param("repo"), err)
+			return c.String(http.StatusInternalServerError, "Failed to queue rollback")
+		}
+		return c.JSON(http.StatusAccepted, map[string]any{"status": "queued", "position": position, "release": release})
+	})
+}
+
+// registerDeliveryRoutes lists the recorded webhook deliveries and replays them
+func registerDeliveryRoutes(admin *echo.Group, deliveries *webhook.DeliveryStore, handlers webhook.Handlers) {
+	admin.GET("/deliveries", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]any{"deliveries": deliveries.List()})
+	})
+
+	admin.GET("/deliveries/:id", func(c echo.Context) error {
+		delivery, err := deliveries.Get(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
+		return c.JSON(http.StatusOK, delivery)
+	})
+
+	admin.POST("/deliveries/:id/replay", webhook.ReplayDelivery(deliveries, handlers))
+}
+
+// deploymentFilter reads the repo, pr and status query parameters
+func deploymentFilter(c echo.Context) (providers.DeploymentFilter, error) {
+	filter := providers.DeploymentFilter{
+		Repo:  c.QueryParam("repo"),
+		Phase: providers.Phase(c.QueryParam("status")),
+	}
+
+	if pr := c.QueryParam("pr"); pr != "" {
+		number, err := strconv.Atoi(pr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid pr %q", pr)
+		}
+		filter.PR = number
+	}
+
+	return filter, nil
+}
+
+// maskOutput masks secret values in everything the controller logs, including
+// output written directly to stdout such as build logs.
+func maskOutput(masker secrets.Masker) {
+	log.SetOutput(secrets.NewMaskingWriter(os.Stderr, masker))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Printf("Warning: could not mask stdout: %v", err)
+		return
+	}
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	go func() {
+		masked := secrets.NewMaskingWriter(stdout, masker)
+		io.Copy(masked, r)
+		masked.Flush()
+	}()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/deployment"
+	"github.com/karindrlainux/flying-cup/pkg/notification"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// commandAssociations are the author associations allowed to run /preview commands
+var commandAssociations = map[string]bool{"OWNER": true, "MEMBER": true, "COLLABORATOR": true}
+
+// prCommands handles the /preview commands posted as PR comments
+type prCommands struct {
+	queue    *deployment.Queue
+	expiry   *deployment.ExpiryScheduler
+	history  *deployment.History
+	provider providers.Provider
+	notifier *notification.GithubNotifier
+}
+
+func (p *prCommands) handle(ctx context.Context, comment *webhook.GithubCommentWebhook) error {
+	fields := strings.Fields(comment.Comment.Body)
+	if len(fields) < 2 || fields[0] != "/preview" {
+		return nil
+	}
+
+	log.Printf("💬 %s requested /preview %s on PR #%d (%s)", comment.Comment.User.Username, fields[1], comment.Issue.Number, comment.Repository.Name)
+
+	// Anyone can comment on public repositories, commands redeploy previews
+	if !commandAssociations[comment.Comment.AuthorAssociation] {
+		log.Printf("🚫 Ignoring /preview %s from %s (%s)", fields[1], comment.Comment.User.Username, comment.Comment.AuthorAssociation)
+		return p.reply(ctx, p.target(comment), fmt.Sprintf("🚫 @%s, only owners, members and collaborators of the repository can use `/preview` commands.", comment.Comment.User.Username))
+	}
+
+	switch fields[1] {
+	case "wake":
+		return p.wake(ctx, comment)
+	case "rollback":
+		sha := ""
+		if len(fields) > 2 {
+			sha = fields[2]
+		}
+		return p.rollback(ctx, comment, sha)
+	default:
+		return p.reply(ctx, p.target(comment), fmt.Sprintf("🤷 Unknown command `/preview %s`. Available commands: `/preview wake`, `/preview rollback [sha]`.", fields[1]))
+	}
+}
+
+// wake redeploys an expired preview, or resets the idle timer of a running one
+func (p *prCommands) wake(ctx context.Context, comment *webhook.GithubCommentWebhook) error {
+	key := deployment.JobKey(comment.Repository.Name, comment.Issue.Number)
+
+	hook, expired := p.expiry.Lookup(key)
+	if hook == nil {
+		return p.reply(ctx, p.target(comment), "🤷 No preview is known for this PR yet. Push a commit to deploy one.")
+	}
+
+	p.expiry.Track(hook)
+
+	if !expired {
+		expiresAt := p.expiry.ExpiresAt(key)
+		if expiresAt.IsZero() {
+			return p.reply(ctx, hook, "👋 The preview is running and does not expire.")
+		}
+		return p.reply(ctx, hook, fmt.Sprintf("👋 The preview is running, it now expires at %s.", expiresAt.UTC().Format(time.RFC1123)))
+	}
+
+	position, err := p.queue.Enqueue(&deployment.Job{Webhook: hook, Priority: deployment.PriorityHigh})
+	if err != nil {
+		return fmt.Errorf("failed to queue wake up: %w", err)
+	}
+
+	message := "⏰ Waking up the preview, it is being redeployed."
+	if position > 0 {
+		message = fmt.Sprintf("⏰ Waking up the preview, queued (#%d).", position)
+	}
+	return p.reply(ctx, hook, message)
+}
+
+// rollback redeploys an earlier commit of the PR from its image, without rebuilding it
+func (p *prCommands) rollback(ctx context.Context, comment *webhook.GithubCommentWebhook, sha string) error {
+	hook, _ := p.expiry.Lookup(deployment.JobKey(comment.Repository.Name, comment.Issue.Number))
+	if hook == nil {
+		return p.reply(ctx, p.target(comment), "🤷 No preview is known for this PR yet. Push a commit to deploy one.")
+	}
+
+	release, position, err := queueRollback(ctx, p.queue, p.history, p.provider, hook, sha)
+	if errors.Is(err, errNoRelease) {
+		return p.reply(ctx, hook, fmt.Sprintf("🤷 %v. Deployed commits: %s.", err, formatReleases(p.history.Releases(deployment.JobKey(hook.Repository.Name, hook.Number)))))
+	}
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("⏪ Rolling back the preview to %s.", release.SHA)
+	if position > 0 {
+		message = fmt.Sprintf("⏪ Rolling back the preview to %s, queued (#%d).", release.SHA, position)
+	}
+	return p.reply(ctx, hook, message)
+}
+
+// errNoRelease is returned when no deployed commit matches a rollback
+var errNoRelease = errors.New("no earlier deployed commit to roll back to")
+
+// queueRollback enqueues the rollback of a PR to the deployed commit starting with sha, or
+// to the commit deployed before the running one when sha is empty
+func queueRollback(ctx context.Context, queue *deployment.Queue, history *deployment.History, provider providers.Provider, hook *webhook.GithubPRWebhook, sha string) (deployment.Release, int, error) {
+	key := deployment.JobKey(hook.Repository.Name, hook.Number)
+
+	var release deployment.Release
+	var found bool
+	if sha != "" {
+		release, found = history.Find(key, sha)
+		if !found {
+			return release, 0, fmt.Errorf("%w: %s was not deployed recently", errNoRelease, sha)
+		}
+	} else {
+		release, found = history.Previous(key, runningSHA(ctx, provider, hook))
+		if !found {
+			return release, 0, errNoRelease
+		}
+	}
+
+	position, err := queue.Enqueue(&deployment.Job{Webhook: hook, Priority: deployment.PriorityHigh, Force: true, Rollback: &release})
+	if err != nil {
+		return release, 0, fmt.Errorf("failed to queue rollback: %w", err)
+	}
+
+	log.Printf("⏪ Rollback of PR #%d (%s) to %s requested, queue position %d", hook.Number, hook.Repository.Name, release.SHA, position)
+	return release, position, nil
+}
+
+// runningSHA returns the commit the preview of a PR runs, or its head if none runs
+func runningSHA(ctx context.Context, provider providers.Provider, hook *webhook.GithubPRWebhook) string {
+	deployments, err := provider.ListDeployments(ctx, providers.DeploymentFilter{Repo: hook.Repository.Name, PR: hook.Number})
+	if err != nil {
+		log.Printf("Warning: failed to list the deployments of PR #%d (%s): %v", hook.Number, hook.Repository.Name, err)
+	}
+	for _, status := range deployments {
+		if status.Phase == providers.PhaseReady || status.Phase == providers.PhaseSleeping {
+			return status.SHA
+		}
+	}
+	return hook.PullRequest.Head.Sha
+}
+
+func formatReleases(releases []deployment.Release) string {
+	if len(releases) == 0 {
+		return "none"
+	}
+
+	shas := make([]string, 0, len(releases))
+	for _, release := range releases {
+		shas = append(shas, "`"+release.SHA+"`")
+	}
+	return strings.Join(shas, ", ")
+}
+
+// target builds a webhook to reply to a comment on a PR without a known preview
+func (p *prCommands) target(comment *webhook.GithubCommentWebhook) *webhook.GithubPRWebhook {
+	if hook, _ := p.expiry.Lookup(deployment.JobKey(comment.Repository.Name, comment.Issue.Number)); hook != nil {
+		return hook
+	}
+	return &webhook.GithubPRWebhook{Number: comment.Issue.Number, Repository: comment.Repository, Sender: comment.Sender}
+}
+
+func (p *prCommands) reply(ctx context.Context, hook *webhook.GithubPRWebhook, message string) error {
+	if err := p.notifier.CreateCommentPR(ctx, hook, message); err != nil {
+		return fmt.Errorf("failed to reply on PR #%d: %w", hook.Number, err)
+	}
+	return nil
+}
+
+// ttlPolicies returns the per-repository overrides of the expiry defaults
+func ttlPolicies(config *Config) map[string]deployment.TTLPolicy {
+	defaults := deployment.TTLPolicy{MaxAge: config.Expiry.MaxAge, IdleTTL: config.Expiry.IdleTTL}
+
+	policies := make(map[string]deployment.TTLPolicy)
+	for name, repo := range config.Repos {
+		if repo.MaxAge == nil && repo.IdleTTL == nil {
+			continue
+		}
+
+		policy := defaults
+		if repo.MaxAge != nil {
+			policy.MaxAge = *repo.MaxAge
+		}
+		if repo.IdleTTL != nil {
+			policy.IdleTTL = *repo.IdleTTL
+		}
+		policies[name] = policy
+	}
+	return policies
+}
+
+func createExpiryComment(event deployment.ExpiryEvent, keepLabel string) string {
+	if event.Expired {
+		return fmt.Sprintf(`## ⌛ Preview Expired
+
+The preview of this PR was stopped (%s).
+
+It is redeployed on the next push, or right away with a `+"`/preview wake`"+` comment.`, event.Reason)
+	}
+
+	return fmt.Sprintf(`## ⏰ Preview Expiring
+
+The preview of this PR will be stopped at %s (%s).
+
+Comment `+"`/preview wake`"+` to keep it running, or add the `+"`%s`"+` label to exempt the PR.`, event.At.UTC().Format(time.RFC1123), event.Reason, keepLabel)
+}
@@ -4,37 +4,253 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Server ServerConfig
-	Github GithubConfig
+	Server    ServerConfig
+	Github    GithubConfig
+	Build     BuildConfig
+	Registry  RegistryConfig
+	Container ContainerConfig
+	Network   NetworkConfig
+	Deploy    DeployConfig
+	Expiry    ExpiryConfig
+	Idle      IdleConfig
+	Quota     QuotaConfig
+	GC        GCConfig
+	Secrets   SecretsConfig
+	// Repos holds per-repository settings from the config file, keyed by repository name
+	Repos map[string]RepoConfig
 }
 
 type ServerConfig struct {
 	Environment string
 	Domain      string
 	Port        int
+	// DataDir holds the controller's persistent state
+	DataDir string
+	// ShutdownTimeout is how long in-flight deploys may finish on shutdown
+	ShutdownTimeout time.Duration
+	// AdminToken protects the /admin API, which is disabled when empty
+	AdminToken string
 }
 
 type GithubConfig struct {
 	AppID         string
 	WebhookSecret string
 	Token         string
+	// DedupWindow is how long redeliveries of a webhook are skipped
+	DedupWindow time.Duration
+	// DeliveryRetention is how long webhook payloads are kept for replays
+	DeliveryRetention time.Duration
+}
+
+type BuildConfig struct {
+	// Backend is the image builder: docker or buildkit
+	Backend      string
+	BuildKitHost string
+
+	// Per-build limits
+	Timeout time.Duration
+	Memory  int64
+	CPUs    float64
+}
+
+type RegistryConfig struct {
+	URL             string
+	Username        string
+	Password        string
+	Insecure        bool
+	DeleteOnCleanup bool
+}
+
+// ContainerConfig holds the default limits and hardening for preview containers
+type ContainerConfig struct {
+	Memory          int64
+	CPUs            float64
+	PidsLimit       int64
+	NoNewPrivileges bool
+	CapDrop         []string
+	ReadOnly        bool
+	Tmpfs           []string
+	Ulimits         []string
+	// ReadyTimeout bounds how long a preview may take to listen on its port
+	ReadyTimeout time.Duration
+}
+
+// NetworkConfig holds the network isolation settings of previews
+type NetworkConfig struct {
+	// ProxyContainer is the Traefik container, connected to the networks of previews
+	ProxyContainer string
+	// RoutesDir is watched by the Traefik file provider for the routes of previews
+	RoutesDir string
+	// ProbeURL is the unpublished Traefik entrypoint new releases are checked through
+	ProbeURL string
+	// Egress is open or none
+	Egress string
+}
+
+// DeployConfig controls the deploy queue
+type DeployConfig struct {
+	// Workers is the number of deploys run at the same time
+	Workers int
+	// MaxAttempts of a deploy failing on transient errors, including the first one
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry, doubled for each following one
+	RetryBackoff time.Duration
+	// Releases is how many deployed commits are kept per PR to roll back to
+	Releases int
+}
+
+// ExpiryConfig controls the teardown of stale previews
+type ExpiryConfig struct {
+	// MaxAge and IdleTTL are the defaults of the repositories, 0 disables them
+	MaxAge  time.Duration
+	IdleTTL time.Duration
+	// Warning is how long before the teardown the PR is warned
+	Warning time.Duration
+	// KeepLabel exempts a PR from expiry
+	KeepLabel string
+	// Interval between checks, disabled when zero
+	Interval time.Duration
+}
+
+// IdleConfig controls the scale to zero of previews without traffic
+type IdleConfig struct {
+	// After is how long a preview runs without requests before it is stopped, disabled when zero
+	After time.Duration
+	// AccessLog is the Traefik JSON access log the requests are read from
+	AccessLog string
+}
+
+// QuotaConfig bounds the previews running on the host, 0 is unlimited
+type QuotaConfig struct {
+	MaxPreviews        int
+	MaxPreviewsPerRepo int
+	// MaxMemory bounds the sum of the memory limits of the running previews
+	MaxMemory int64
+	// Policy is evict to stop the least recently used previews, or queue to wait for room
+	Policy string
+}
+
+// GCConfig controls the garbage collector of orphaned resources
+type GCConfig struct {
+	// Interval between collections, disabled when zero
+	Interval time.Duration
+	// GracePeriod is how long a resource must be orphaned before it is removed
+	GracePeriod time.Duration
+	// DryRun only logs what would be removed
+	DryRun bool
+}
+
+type SecretsConfig struct {
+	// Key encrypts the secrets store, which is disabled when empty
+	Key string
+}
+
+// RepoConfig holds the settings of a single repository in the config file
+type RepoConfig struct {
+	// Env is injected into previews; values may use {{.PreviewURL}}, {{.Branch}} and {{.SHA}}
+	Env map[string]string `yaml:"env"`
+	// MaxAge and IdleTTL override the expiry of the repository's previews, 0 disables it
+	MaxAge  *time.Duration `yaml:"max_age"`
+	IdleTTL *time.Duration `yaml:"idle_ttl"`
+}
+
+// fileConfig is the layout of the optional YAML config file
+type fileConfig struct {
+	Repos map[string]RepoConfig `yaml:"repos"`
 }
 
 func LoadConfig() (*Config, error) {
 	config := &Config{
 		Server: ServerConfig{
-			Environment: getEnv("ENVIRONMENT", "local"),
-			Domain:      getEnv("DOMAIN", "localhost"),
-			Port:        getEnvAsInt("PORT", 80),
+			Environment:     getEnv("ENVIRONMENT", "local"),
+			Domain:          getEnv("DOMAIN", "localhost"),
+			Port:            getEnvAsInt("PORT", 80),
+			DataDir:         getEnv("DATA_DIR", "./data"),
+			ShutdownTimeout: getEnvAsDuration("SHUTDOWN_TIMEOUT", 5*time.Minute),
+			AdminToken:      getEnv("ADMIN_TOKEN", ""),
 		},
 		Github: GithubConfig{
-			AppID:         getEnv("GITHUB_APP_ID", ""),
-			WebhookSecret: getEnv("GITHUB_WEBHOOK_SECRET", ""),
-			Token:         getEnv("GITHUB_TOKEN", ""),
+			AppID:             getEnv("GITHUB_APP_ID", ""),
+			WebhookSecret:     getEnv("GITHUB_WEBHOOK_SECRET", ""),
+			Token:             getEnv("GITHUB_TOKEN", ""),
+			DedupWindow:       getEnvAsDuration("WEBHOOK_DEDUP_WINDOW", time.Hour),
+			DeliveryRetention: getEnvAsDuration("WEBHOOK_RETENTION", 7*24*time.Hour),
+		},
+		Build: BuildConfig{
+			Backend:      getEnv("BUILDER", "docker"),
+			BuildKitHost: getEnv("BUILDKIT_HOST", ""),
+			Timeout:      getEnvAsDuration("BUILD_TIMEOUT", 15*time.Minute),
+			Memory:       getEnvAsBytes("BUILD_MEMORY_LIMIT", 0),
+			CPUs:         getEnvAsFloat("BUILD_CPUS", 0),
+		},
+		Registry: RegistryConfig{
+			URL:             getEnv("REGISTRY_URL", ""),
+			Username:        getEnv("REGISTRY_USERNAME", ""),
+			Password:        getEnv("REGISTRY_PASSWORD", ""),
+			Insecure:        getEnvAsBool("REGISTRY_INSECURE", false),
+			DeleteOnCleanup: getEnvAsBool("REGISTRY_DELETE_ON_CLEANUP", false),
+		},
+		Container: ContainerConfig{
+			Memory:          getEnvAsBytes("PREVIEW_MEMORY_LIMIT", 512*units.MiB),
+			CPUs:            getEnvAsFloat("PREVIEW_CPUS", 1),
+			PidsLimit:       int64(getEnvAsInt("PREVIEW_PIDS_LIMIT", 256)),
+			NoNewPrivileges: getEnvAsBool("PREVIEW_NO_NEW_PRIVILEGES", true),
+			CapDrop:         getEnvAsList("PREVIEW_CAP_DROP", []string{"NET_RAW", "MKNOD", "AUDIT_WRITE", "SYS_CHROOT"}),
+			ReadOnly:        getEnvAsBool("PREVIEW_READ_ONLY", false),
+			Tmpfs:           getEnvAsList("PREVIEW_TMPFS", []string{"/tmp", "/run"}),
+			Ulimits:         getEnvAsList("PREVIEW_ULIMITS", []string{"nofile=4096:8192"}),
+			ReadyTimeout:    getEnvAsDuration("PREVIEW_READY_TIMEOUT", 2*time.Minute),
+		},
+		Network: NetworkConfig{
+			ProxyContainer: getEnv("PROXY_CONTAINER", "traefik"),
+			RoutesDir:      getEnv("TRAEFIK_ROUTES_DIR", "./routes"),
+			ProbeURL:       getEnv("PROXY_PROBE_URL", "http://traefik:8082"),
+			Egress:         getEnv("PREVIEW_EGRESS", "open"),
 		},
+		Deploy: DeployConfig{
+			Workers:      getEnvAsInt("DEPLOY_WORKERS", 2),
+			MaxAttempts:  getEnvAsInt("DEPLOY_MAX_ATTEMPTS", 3),
+			RetryBackoff: getEnvAsDuration("DEPLOY_RETRY_BACKOFF", 30*time.Second),
+			Releases:     getEnvAsInt("PREVIEW_RELEASES", 5),
+		},
+		Expiry: ExpiryConfig{
+			MaxAge:    getEnvAsDuration("PREVIEW_MAX_AGE", 0),
+			IdleTTL:   getEnvAsDuration("PREVIEW_IDLE_TTL", 7*24*time.Hour),
+			Warning:   getEnvAsDuration("PREVIEW_EXPIRY_WARNING", 24*time.Hour),
+			KeepLabel: getEnv("PREVIEW_KEEP_LABEL", "preview:keep"),
+			Interval:  getEnvAsDuration("PREVIEW_EXPIRY_INTERVAL", 10*time.Minute),
+		},
+		Idle: IdleConfig{
+			After:     getEnvAsDuration("SCALE_TO_ZERO_AFTER", 0),
+			AccessLog: getEnv("TRAEFIK_ACCESS_LOG", "/app/logs/access.log"),
+		},
+		Quota: QuotaConfig{
+			MaxPreviews:        getEnvAsInt("PREVIEW_QUOTA", 0),
+			MaxPreviewsPerRepo: getEnvAsInt("PREVIEW_QUOTA_PER_REPO", 0),
+			MaxMemory:          getEnvAsBytes("PREVIEW_QUOTA_MEMORY", 0),
+			Policy:             getEnv("PREVIEW_QUOTA_POLICY", "queue"),
+		},
+		GC: GCConfig{
+			Interval:    getEnvAsDuration("GC_INTERVAL", 10*time.Minute),
+			GracePeriod: getEnvAsDuration("GC_GRACE_PERIOD", time.Hour),
+			DryRun:      getEnvAsBool("GC_DRY_RUN", false),
+		},
+		Secrets: SecretsConfig{
+			Key: getEnv("SECRETS_KEY", ""),
+		},
+	}
+
+	// Load per-repository settings from the optional config file
+	if err := loadConfigFile(getEnv("CONFIG_FILE", "config.yaml"), config); err != nil {
+		return nil, err
 	}
 
 	// Validate required fields
@@ -50,9 +266,32 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("DOMAIN is required")
 	}
 
+	if config.Quota.Policy != "evict" && config.Quota.Policy != "queue" {
+		return nil, fmt.Errorf("PREVIEW_QUOTA_POLICY must be evict or queue, got %q", config.Quota.Policy)
+	}
+
 	return config, nil
 }
 
+// loadConfigFile reads the YAML config file into config, if it exists
+func loadConfigFile(path string, config *Config) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+
+	var file fileConfig
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	config.Repos = file.Repos
+	return nil
+}
+
 // Helper functions for environment variables
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -70,6 +309,57 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvAsList parses a comma separated list
+func getEnvAsList(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+	return defaultValue
+}
+
+func getEnvAsBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsBytes parses sizes like 512m or 2g
+func getEnvAsBytes(key string, defaultValue int64) int64 {
+	if value := os.Getenv(key); value != "" {
+		if bytes, err := units.RAMInBytes(value); err == nil {
+			return bytes
+		}
+	}
+	return defaultValue
+}
+
 // Domain getter method
 func (c *Config) GetDomain() string {
 	return c.Server.Domain
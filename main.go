@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/client"
 	"github.com/karindrlainux/flying-cup/pkg/deployment"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/metrics"
 	"github.com/karindrlainux/flying-cup/pkg/notification"
 	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/secrets"
 	"github.com/karindrlainux/flying-cup/pkg/webhook"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -36,6 +44,19 @@ func main() {
 
 	notifier := notification.NewGithubNotifier(config.Github.Token)
 
+	// Open the secrets store and mask its values in logs and notifications
+	var secretStore *secrets.Store
+	if config.Secrets.Key != "" {
+		secretStore, err = secrets.NewStore(filepath.Join(config.Server.DataDir, "secrets.json"), config.Secrets.Key)
+		if err != nil {
+			log.Fatal("Failed to open secrets store:", err)
+		}
+		maskOutput(secretStore)
+		notifier.SetMasker(secretStore)
+	} else {
+		log.Println("SECRETS_KEY not set - secrets store disabled")
+	}
+
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
@@ -48,11 +69,51 @@ func main() {
 		return c.String(http.StatusOK, "OK")
 	})
 
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+
+	admin := registerAdminRoutes(e, config.Server.AdminToken)
+	if admin != nil && secretStore != nil {
+		registerSecretRoutes(admin, secretStore)
+	}
+
 	// Create deployment provider based on config
 	deploymentConfig := &providers.Config{
-		Domain:      config.Server.Domain,
-		Port:        config.Server.Port,
-		Environment: config.Server.Environment,
+		Domain:       config.Server.Domain,
+		Port:         config.Server.Port,
+		Environment:  config.Server.Environment,
+		Builder:      config.Build.Backend,
+		BuildKitHost: config.Build.BuildKitHost,
+		BuildLimits: docker.BuildLimits{
+			Timeout: config.Build.Timeout,
+			Memory:  config.Build.Memory,
+			CPUs:    config.Build.CPUs,
+		},
+		Registry: docker.RegistryConfig{
+			URL:             config.Registry.URL,
+			Username:        config.Registry.Username,
+			Password:        config.Registry.Password,
+			Insecure:        config.Registry.Insecure,
+			DeleteOnCleanup: config.Registry.DeleteOnCleanup,
+		},
+		Releases: config.Deploy.Releases,
+		ContainerLimits: docker.ContainerLimits{
+			Memory:          config.Container.Memory,
+			CPUs:            config.Container.CPUs,
+			PidsLimit:       config.Container.PidsLimit,
+			NoNewPrivileges: config.Container.NoNewPrivileges,
+			CapDrop:         config.Container.CapDrop,
+			ReadOnly:        config.Container.ReadOnly,
+			Tmpfs:           config.Container.Tmpfs,
+			Ulimits:         config.Container.Ulimits,
+		},
+		ReadyTimeout:   config.Container.ReadyTimeout,
+		ProxyContainer: config.Network.ProxyContainer,
+		RoutesDir:      config.Network.RoutesDir,
+		DataDir:        config.Server.DataDir,
+		ProbeURL:       config.Network.ProbeURL,
+		Egress:         config.Network.Egress,
+		RepoEnv:        repoEnv(config.Repos),
+		Secrets:        secretStore,
 	}
 
 	provider, err := providers.NewProvider(providers.TypeTraefik, deploymentConfig)
@@ -65,86 +126,407 @@ func main() {
 		log.Fatal("Failed to initialize deployment provider:", err)
 	}
 
-	e.POST("/webhook/github", webhook.HandleGithubWebhook(
-		config.Github.WebhookSecret,
-		// On PR Opened
-		func(ctx context.Context, webhook *webhook.GithubPRWebhook) error {
+	if admin != nil {
+		registerDeploymentRoutes(admin, provider)
+	}
 
-			log.Printf("🚀 Starting deployment process for PR #%d", webhook.Number)
-			log.Printf("📋 Deployment details:")
-			log.Printf("   - Repository: %s", webhook.Repository.Name)
-			log.Printf("   - Branch: %s", webhook.PullRequest.Head.Ref)
-			log.Printf("   - PR Title: %s", webhook.PullRequest.Title)
-			log.Printf("   - Author: %s", webhook.Sender.Username)
+	// Remove resources left behind by failed deploys and previous controller runs
+	if collector, ok := provider.(providers.GarbageCollector); ok {
+		if config.GC.Interval > 0 {
+			go providers.RunGarbageCollector(context.Background(), collector, config.GC.Interval, config.GC.GracePeriod, config.GC.DryRun)
+		}
+		if admin != nil {
+			registerGCRoutes(admin, collector, config.GC.GracePeriod)
+		}
+	}
 
-			// Use the provider-agnostic DeployPR function
-			previewURL, err := deployment.DeployPullRequest(ctx, webhook, provider)
+	// Tell the PR when its preview crashes
+	if watcher, ok := provider.(providers.HealthWatcher); ok {
+		go watcher.WatchHealth(context.Background(), func(ctx context.Context, event providers.HealthEvent) {
+			log.Printf("📤 Send unhealthy preview notification for PR #%d (%s)", event.Webhook.Number, event.Webhook.Repository.Name)
 
-			if err != nil {
-				log.Printf("❌ Error deploying PR #%d: %v", webhook.Number, err)
+			if err := notifier.CreateCommentPR(ctx, event.Webhook, createUnhealthyComment(event)); err != nil {
+				log.Printf("❌ Error sending unhealthy preview notification for PR #%d (%s): %v", event.Webhook.Number, event.Webhook.Repository.Name, err)
+			}
+		})
+	}
 
-				log.Printf("📤 Send deployment failure notification for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
-				failureComment := createDeploymentFailureComment(webhook, err.Error())
+	// Admits new previews within the quotas, set up once the expiry records are open
+	var capacity *deployment.Capacity
+	// The queue runs the cleanups of closed PRs, which drop their expiry records
+	var queue *deployment.Queue
+	var expiry *deployment.ExpiryScheduler
 
-				err = notifier.CreateCommentPR(ctx, webhook, failureComment)
+	// Deployed commits are kept to roll back to them
+	history, err := deployment.OpenHistory(filepath.Join(config.Server.DataDir, "history.json"), config.Deploy.Releases)
+	if err != nil {
+		log.Fatalf("Failed to open the deployment history: %v", err)
+	}
 
-				if err != nil {
-					log.Printf("❌ Error sending deployment failure notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
-				}
+	// Deploys run on a bounded pool of workers, persisted until they complete
+	journal, err := deployment.OpenJournal(filepath.Join(config.Server.DataDir, "queue.json"))
+	if err != nil {
+		log.Fatalf("Failed to open the deploy queue journal: %v", err)
+	}
+	queue = deployment.NewQueue(deployment.QueueOptions{
+		Workers: config.Deploy.Workers,
+		Retry: deployment.RetryPolicy{
+			MaxAttempts: config.Deploy.MaxAttempts,
+			Backoff:     config.Deploy.RetryBackoff,
+		},
+		Journal: journal,
+	}, func(ctx context.Context, job *deployment.Job) error {
+		if job.Cleanup {
+			cleanupAndNotify(ctx, provider, notifier, queue, expiry, capacity, history, job.Webhook)
+			return nil
+		}
+		return deployAndNotify(ctx, provider, notifier, capacity, history, job)
+	})
 
-				return err
+	if admin != nil {
+		registerQueueRoutes(admin, queue)
+		registerRollbackRoutes(admin, queue, history, provider)
+	}
+
+	// Stale previews are torn down after warning their PR
+	expiry, err = deployment.NewExpiryScheduler(filepath.Join(config.Server.DataDir, "previews.json"), provider, deployment.ExpiryOptions{
+		Default:   deployment.TTLPolicy{MaxAge: config.Expiry.MaxAge, IdleTTL: config.Expiry.IdleTTL},
+		Repos:     ttlPolicies(config),
+		Warning:   config.Expiry.Warning,
+		KeepLabel: config.Expiry.KeepLabel,
+		Lock:      queue.Lock,
+		Webhook: func(key string) *webhook.GithubPRWebhook {
+			if job := queue.Last(key); job != nil {
+				return job.Webhook
 			}
+			return nil
+		},
+	})
+	if err != nil {
+		log.Fatalf("Failed to open the preview records: %v", err)
+	}
 
-			log.Printf("✅ Deployment successful for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
-			log.Printf("🌐 Preview URL: %s", previewURL)
+	if config.Expiry.Interval > 0 {
+		go expiry.Run(context.Background(), config.Expiry.Interval, func(ctx context.Context, event deployment.ExpiryEvent) {
+			if err := notifier.CreateCommentPR(ctx, event.Webhook, createExpiryComment(event, config.Expiry.KeepLabel)); err != nil {
+				log.Printf("❌ Error sending expiry notification for PR #%d (%s): %v", event.Webhook.Number, event.Webhook.Repository.Name, err)
+			}
+		})
+	}
+
+	// Previews without traffic are stopped, and started again by their next request
+	if sleeper, ok := provider.(providers.Sleeper); ok && config.Idle.After > 0 {
+		scaler := deployment.NewIdleScaler(provider, sleeper, deployment.IdleOptions{
+			After:        config.Idle.After,
+			IgnoreRouter: wakeRouter,
+			Lock:         queue.Lock,
+			OnActivity:   expiry.Touch,
+		})
+		go scaler.TailAccessLog(context.Background(), config.Idle.AccessLog)
+		go scaler.Run(context.Background(), time.Minute)
+		e.Pre(wakePreviews(scaler, config.Server.Domain))
+		log.Printf("💤 Previews scale to zero after %s without requests", config.Idle.After)
+	}
 
-			successComment := createDeploymentSuccessComment(webhook, previewURL)
+	capacity = deployment.NewCapacity(provider, expiry, deployment.CapacityOptions{
+		Quotas: deployment.Quotas{
+			MaxPreviews:        config.Quota.MaxPreviews,
+			MaxPreviewsPerRepo: config.Quota.MaxPreviewsPerRepo,
+			MaxMemory:          config.Quota.MaxMemory,
+			Policy:             config.Quota.Policy,
+		},
+		Memory:  config.Container.Memory,
+		TryLock: queue.TryLock,
+		OnEvict: func(ctx context.Context, webhook *webhook.GithubPRWebhook, reason string) {
+			if err := notifier.CreateCommentPR(ctx, webhook, createEvictionComment(reason)); err != nil {
+				log.Printf("❌ Error sending eviction notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+			}
+		},
+	})
+	if capacity.Enabled() {
+		log.Printf("📦 Preview quotas: %d in total, %d per repository, %d bytes of memory (0 is unlimited), policy %s",
+			config.Quota.MaxPreviews, config.Quota.MaxPreviewsPerRepo, config.Quota.MaxMemory, config.Quota.Policy)
+	}
+	queue.Start(context.Background())
 
-			err = notifier.CreateCommentPR(ctx, webhook, successComment)
+	onPROpened := func(ctx context.Context, webhook *webhook.GithubPRWebhook) error {
+		// A push counts as activity and revives an expired preview
+		expiry.Track(webhook)
 
-			if err != nil {
-				log.Printf("❌ Error sending deployment success notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+		// Replays rebuild even if the commit is deployed, to reproduce the deploy
+		position, err := queue.Enqueue(&deployment.Job{Webhook: webhook, Priority: deployment.PriorityNormal, Force: isReplay(ctx)})
+		if err != nil || position == 0 {
+			return err
+		}
+
+		log.Printf("⏳ Deployment for PR #%d (%s) queued (#%d)", webhook.Number, webhook.Repository.Name, position)
+
+		// The webhook is acknowledged once the job is persisted, without waiting for GitHub
+		go func() {
+			if err := notifier.CreateCommentPR(context.Background(), webhook, createQueuedComment(webhook, position)); err != nil {
+				log.Printf("❌ Error sending queued notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
 			}
+		}()
+
+		return nil
+	}
+
+	onPRClosed := func(ctx context.Context, webhook *webhook.GithubPRWebhook) error {
+		// The cleanup is persisted like a deploy and aborts the pending deploys of the PR
+		_, err := queue.Enqueue(&deployment.Job{Webhook: webhook, Priority: deployment.PriorityHigh, Cleanup: true})
+		return err
+	}
 
-			log.Printf("✅ Deployment success notification sent for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+	commands := &prCommands{queue: queue, expiry: expiry, history: history, provider: provider, notifier: notifier}
 
+	handlers := webhook.Handlers{
+		OnPROpened: onPROpened,
+		OnPRClosed: onPRClosed,
+		OnPRLabeled: func(ctx context.Context, webhook *webhook.GithubPRWebhook) error {
+			expiry.UpdateLabels(webhook)
 			return nil
 		},
-		// On PR Closed
-		func(ctx context.Context, webhook *webhook.GithubPRWebhook) error {
-			log.Printf("🧹 Cleaning up deployment for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
-			log.Printf("📋 Cleanup details:")
-			log.Printf("   - Repository: %s", webhook.Repository.Name)
-			log.Printf("   - PR: #%d", webhook.Number)
+		OnPRComment: commands.handle,
+	}
 
-			err := deployment.CleanupPullRequest(ctx, webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number, provider)
+	// Deliveries are recorded to skip redeliveries and replay them for debugging
+	deliveries, err := webhook.NewDeliveryStore(filepath.Join(config.Server.DataDir, "deliveries"), config.Github.DedupWindow, config.Github.DeliveryRetention)
+	if err != nil {
+		log.Fatalf("Failed to open the webhook delivery store: %v", err)
+	}
 
-			if err != nil {
-				log.Printf("❌ Error cleaning up deployment for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
-			}
+	if admin != nil {
+		registerDeliveryRoutes(admin, deliveries, handlers)
+	}
 
-			log.Printf("📤 Send deployment cleanup success notification for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+	e.POST("/webhook/github", webhook.HandleGithubWebhook(config.Github.WebhookSecret, deliveries, handlers))
 
-			successComment := createCleanupSuccessComment(webhook)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-			err = notifier.CreateCommentPR(ctx, webhook, successComment)
+	go func() {
+		if err := e.Start(fmt.Sprintf(":%d", 8080)); err != nil && !errors.Is(err, http.ErrServerClosed) { // Use internal port 8080
+			e.Logger.Fatal(err)
+		}
+	}()
 
-			if err != nil {
-				log.Printf("❌ Error sending deployment cleanup success notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
-			}
+	<-ctx.Done()
+	stop()
+
+	// Let in-flight deploys finish; unfinished ones resume from the journal on the next start,
+	// like the webhooks received meanwhile
+	log.Printf("🛑 Shutting down, waiting up to %s for in-flight deployments", config.Server.ShutdownTimeout)
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), config.Server.ShutdownTimeout)
+	defer cancel()
+	if err := queue.Shutdown(drainCtx); err != nil {
+		log.Printf("⚠️  %v, they resume on the next start", err)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelShutdown()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Warning: failed to shut down the server: %v", err)
+	}
+
+	log.Println("👋 Flying Cup stopped")
+}
 
-			log.Printf("✅ Deployment cleanup completed for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+// cleanupAndNotify tears down the preview of a closed pull request and comments on it
+func cleanupAndNotify(ctx context.Context, provider providers.Provider, notifier *notification.GithubNotifier, queue *deployment.Queue, expiry *deployment.ExpiryScheduler, capacity *deployment.Capacity, history *deployment.History, webhook *webhook.GithubPRWebhook) {
+	log.Printf("🧹 Cleaning up deployment for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+	log.Printf("📋 Cleanup details:")
+	log.Printf("   - Repository: %s", webhook.Repository.Name)
+	log.Printf("   - PR: #%d", webhook.Number)
 
+	// A closed PR can no longer be redeployed
+	jobKey := deployment.JobKey(webhook.Repository.Name, webhook.Number)
+	queue.Forget(jobKey)
+	expiry.Forget(jobKey)
+	capacity.Forget(jobKey)
+	history.Forget(jobKey)
+
+	err := deployment.CleanupPullRequest(ctx, webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number, provider)
+
+	if err != nil {
+		log.Printf("❌ Error cleaning up deployment for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+	}
+
+	log.Printf("📤 Send deployment cleanup success notification for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+
+	successComment := createCleanupSuccessComment(webhook)
+
+	err = notifier.CreateCommentPR(ctx, webhook, successComment)
+
+	if err != nil {
+		log.Printf("❌ Error sending deployment cleanup success notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+	}
+
+	log.Printf("✅ Deployment cleanup completed for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+}
+
+// deployAndNotify deploys the pull request of a job and comments the outcome on it.
+// Failures the queue retries are only reported once the last attempt fails.
+func deployAndNotify(ctx context.Context, provider providers.Provider, notifier *notification.GithubNotifier, capacity *deployment.Capacity, history *deployment.History, job *deployment.Job) error {
+	webhook := job.Webhook
+
+	// Redelivered and resumed jobs may find their commit deployed already
+	if !job.Force {
+		deployed, err := deployment.DeployedCommit(ctx, webhook, provider)
+		if err != nil {
+			log.Printf("Warning: failed to check the deployed commit of PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+		}
+		if deployed != nil {
+			log.Printf("⏭️  PR #%d (%s) already runs %s, skipping deployment", webhook.Number, webhook.Repository.Name, webhook.PullRequest.Head.Sha)
 			return nil
-		},
-	))
+		}
+	}
+
+	// Make room for the preview within the quotas, or wait until there is
+	if err := capacity.Admit(ctx, job); errors.Is(err, deployment.ErrNoCapacity) {
+		log.Printf("⏸️  Deployment of PR #%d (%s) waits for capacity: %v", webhook.Number, webhook.Repository.Name, err)
+		if capacity.Wait(job.Key()) {
+			if err := notifier.CreateCommentPR(ctx, webhook, createCapacityComment(err)); err != nil {
+				log.Printf("❌ Error sending capacity notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+			}
+		}
+		return err
+	} else if err != nil {
+		log.Printf("Warning: failed to check the preview quotas for PR #%d (%s), deploying anyway: %v", webhook.Number, webhook.Repository.Name, err)
+	}
+	defer capacity.Release(job.Key())
+
+	log.Printf("🚀 Starting deployment process for PR #%d", webhook.Number)
+	log.Printf("📋 Deployment details:")
+	log.Printf("   - Repository: %s", webhook.Repository.Name)
+	log.Printf("   - Branch: %s", webhook.PullRequest.Head.Ref)
+	log.Printf("   - PR Title: %s", webhook.PullRequest.Title)
+	log.Printf("   - Author: %s", webhook.Sender.Username)
+
+	// Use the provider-agnostic DeployPR function, or run an earlier image for rollbacks
+	var previewURL string
+	var err error
+	if job.Rollback != nil {
+		previewURL, err = deployment.RollbackPullRequest(ctx, webhook, *job.Rollback, provider)
+	} else {
+		previewURL, err = deployment.DeployPullRequest(ctx, webhook, provider)
+	}
+
+	if err != nil && deployment.Cancelled(ctx) {
+		// A newer event or the PR's closing took over, it reports on its own
+		log.Printf("⏹️  Deployment of PR #%d (%s) cancelled: %v", webhook.Number, webhook.Repository.Name, context.Cause(ctx))
+		return nil
+	}
+
+	if err != nil && job.WillRetry(err) {
+		log.Printf("⚠️  Deployment of PR #%d (%s) failed on a transient error: %v", webhook.Number, webhook.Repository.Name, err)
+		return err
+	}
+
+	if err != nil {
+		log.Printf("❌ Error deploying PR #%d: %v", webhook.Number, err)
+
+		log.Printf("📤 Send deployment failure notification for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+		failureComment := createDeploymentFailureComment(webhook, err)
+
+		// Notify even if the deployment was cancelled
+		err = notifier.CreateCommentPR(context.WithoutCancel(ctx), webhook, failureComment)
+
+		if err != nil {
+			log.Printf("❌ Error sending deployment failure notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+		}
+
+		return err
+	}
+
+	log.Printf("✅ Deployment successful for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+	log.Printf("🌐 Preview URL: %s", previewURL)
+
+	if job.Rollback != nil {
+		if err := notifier.CreateCommentPR(ctx, webhook, createRollbackComment(*job.Rollback, previewURL)); err != nil {
+			log.Printf("❌ Error sending rollback notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+		}
+		return nil
+	}
+
+	// Keep the commit to roll back to it later
+	if err := history.RecordDeployment(ctx, webhook, provider); err != nil {
+		log.Printf("Warning: failed to record the deployment of PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+	}
+
+	successComment := createDeploymentSuccessComment(webhook, previewURL)
+	if reporter, ok := provider.(providers.JobReporter); ok {
+		successComment += createJobsComment(reporter.JobResults(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number))
+	}
+
+	err = notifier.CreateCommentPR(ctx, webhook, successComment)
+
+	if err != nil {
+		log.Printf("❌ Error sending deployment success notification for PR #%d (%s): %v", webhook.Number, webhook.Repository.Name, err)
+	}
+
+	log.Printf("✅ Deployment success notification sent for PR #%d (%s)", webhook.Number, webhook.Repository.Name)
+
+	return nil
+}
+
+func createRollbackComment(release deployment.Release, previewURL string) string {
+	return fmt.Sprintf(`## ⏪ Preview Rolled Back
+
+The preview now runs commit %s again, deployed on %s, without rebuilding it.
+
+**Preview URL:** %s
+
+It runs with the manifest recorded for that commit, not the branch head. The next push deploys the head of the branch again.`, release.SHA, release.DeployedAt.UTC().Format(time.RFC1123), previewURL)
+}
+
+func createCapacityComment(err error) string {
+	return fmt.Sprintf(`## ⏸️ Preview Waiting for Capacity
+
+The preview host is full (%v).
+
+The preview is deployed as soon as another one is closed or expires.`, err)
+}
+
+func createEvictionComment(reason string) string {
+	return fmt.Sprintf(`## 🪂 Preview Evicted
+
+The preview of this PR was stopped to make room for another one, as it was the least recently used (%s).
+
+It is redeployed on the next push, or right away with a `+"`/preview wake`"+` comment.`, reason)
+}
+
+// isReplay reports whether a webhook is a delivery replayed through the admin API
+func isReplay(ctx context.Context) bool {
+	_, replay := webhook.DeliveryFromContext(ctx)
+	return replay
+}
 
-	e.Logger.Fatal(e.Start(fmt.Sprintf(":%d", 8080))) // Use internal port 8080
+func createQueuedComment(webhook *webhook.GithubPRWebhook, position int) string {
+	return fmt.Sprintf(`## ⏳ Preview Deployment queued (#%d)
+
+Other previews are being deployed. The preview of this PR will start building as soon as a worker is free.
+
+**Details:**
+- Repository: %s
+- Branch: %s
+- PR: #%d`, position, webhook.Repository.Name, webhook.PullRequest.Head.Ref, webhook.Number)
+}
+
+// repoEnv extracts the per-repository environment variables from the config file
+func repoEnv(repos map[string]RepoConfig) map[string]map[string]string {
+	env := make(map[string]map[string]string, len(repos))
+	for name, repo := range repos {
+		env[name] = repo.Env
+	}
+	return env
 }
 
-func createDeploymentFailureComment(webhook *webhook.GithubPRWebhook, errorMessage string) string {
+func createDeploymentFailureComment(webhook *webhook.GithubPRWebhook, deployErr error) string {
 	return fmt.Sprintf(`## ❌ Deployment failed
 	
+**Cause :** %s
+
 **Error :** %s
 
 **Details :**
@@ -154,7 +536,63 @@ func createDeploymentFailureComment(webhook *webhook.GithubPRWebhook, errorMessa
 - Triggered by : %s
 
 Please check your app and deployment configuration.
-	`, errorMessage, webhook.Repository.Name, webhook.PullRequest.Head.Ref, webhook.PullRequest.Title, webhook.Sender.Username)
+	`, deploymentFailureCause(deployErr), deployErr.Error(), webhook.Repository.Name, webhook.PullRequest.Head.Ref, webhook.PullRequest.Title, webhook.Sender.Username) + jobFailureOutput(deployErr)
+}
+
+// jobFailureOutput returns the output of a failed job as a collapsed section, if a job failed
+func jobFailureOutput(err error) string {
+	var jobErr *providers.JobError
+	if !errors.As(err, &jobErr) || jobErr.Output == "" {
+		return ""
+	}
+
+	return fmt.Sprintf("\n<details><summary>Output of %s job %s</summary>\n\n```\n%s\n```\n</details>\n", jobErr.Phase, jobErr.Name, jobErr.Output)
+}
+
+// createJobsComment summarizes the jobs run by a deploy
+func createJobsComment(results []providers.JobResult) string {
+	if len(results) == 0 {
+		return ""
+	}
+
+	comment := "\n\n**Jobs:**\n"
+	for _, result := range results {
+		comment += fmt.Sprintf("- ✅ %s `%s` (%s)\n", result.Phase, result.Name, result.Duration)
+		if result.Output != "" {
+			comment += fmt.Sprintf("\n<details><summary>Output</summary>\n\n```\n%s\n```\n</details>\n\n", result.Output)
+		}
+	}
+	return comment
+}
+
+// deploymentFailureCause describes why a deployment failed, distinguishing build timeouts, OOM kills and cancellations
+func deploymentFailureCause(err error) string {
+	var jobErr *providers.JobError
+	if errors.As(err, &jobErr) {
+		if jobErr.Err != nil {
+			return fmt.Sprintf("🔧 %s job %s failed", jobErr.Phase, jobErr.Name)
+		}
+		return fmt.Sprintf("🔧 %s job %s exited with code %d", jobErr.Phase, jobErr.Name, jobErr.ExitCode)
+	}
+
+	var buildErr *docker.BuildError
+	if !errors.As(err, &buildErr) {
+		if errors.Is(err, context.Canceled) {
+			return "🛑 Deployment cancelled"
+		}
+		return "💥 Deployment error"
+	}
+
+	switch buildErr.Cause {
+	case docker.BuildCauseTimeout:
+		return fmt.Sprintf("⏱️ Build timed out after %s", buildErr.Limits.Timeout)
+	case docker.BuildCauseOOM:
+		return "🧠 Build ran out of memory"
+	case docker.BuildCauseCancelled:
+		return "🛑 Build cancelled"
+	default:
+		return "💥 Build failed"
+	}
 }
 
 func createDeploymentSuccessComment(webhook *webhook.GithubPRWebhook, previewURL string) string {
@@ -170,6 +608,32 @@ Your preview is now available at: **%s**
 The preview will be automatically cleaned up when this PR is closed.`, previewURL, webhook.Repository.Name, webhook.PullRequest.Head.Ref, webhook.Number)
 }
 
+func createUnhealthyComment(event providers.HealthEvent) string {
+	cause := fmt.Sprintf("💥 Container %s exited with code %d", event.Container, event.ExitCode)
+	switch event.Status {
+	case providers.StatusOOMKilled:
+		cause = fmt.Sprintf("🧠 Container %s ran out of memory", event.Container)
+	case providers.StatusUnhealthy:
+		cause = fmt.Sprintf("🩺 Container %s failed its health check", event.Container)
+	}
+
+	comment := fmt.Sprintf(`## ⚠️ Preview Unhealthy
+
+**Cause:** %s
+
+**Details:**
+- Repository: %s
+- Branch: %s
+- Restarts so far: %d
+
+The container is restarted automatically while the PR is open.`, cause, event.Webhook.Repository.Name, event.Webhook.PullRequest.Head.Ref, event.Restarts)
+
+	if event.Logs != "" {
+		comment += fmt.Sprintf("\n\n<details><summary>Last log lines</summary>\n\n```\n%s\n```\n</details>", event.Logs)
+	}
+	return comment
+}
+
 func createCleanupSuccessComment(webhook *webhook.GithubPRWebhook) string {
 	return fmt.Sprintf(`## 🧹 Preview Cleanup Completed
 
@@ -0,0 +1,202 @@
+package compose
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File is the subset of the compose file format supported for previews
+type File struct {
+	Services map[string]Service `yaml:"services"`
+	Volumes  map[string]any     `yaml:"volumes"`
+}
+
+// Service is a single compose service
+type Service struct {
+	Image       string      `yaml:"image"`
+	Build       *Build      `yaml:"build"`
+	Command     StringList  `yaml:"command"`
+	Entrypoint  StringList  `yaml:"entrypoint"`
+	Environment Environment `yaml:"environment"`
+	DependsOn   DependsOn   `yaml:"depends_on"`
+	Expose      []string    `yaml:"expose"`
+	Ports       []string    `yaml:"ports"`
+	Volumes     []string    `yaml:"volumes"`
+	WorkingDir  string      `yaml:"working_dir"`
+}
+
+// Build is the build section of a service, either a context path or a mapping
+type Build struct {
+	Context    string `yaml:"context"`
+	Dockerfile string `yaml:"dockerfile"`
+}
+
+func (b *Build) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		b.Context = node.Value
+		return nil
+	}
+
+	type plain Build
+	return node.Decode((*plain)(b))
+}
+
+// StringList is a command given either as a string or a list
+type StringList []string
+
+func (l *StringList) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*l = []string{"/bin/sh", "-c", node.Value}
+		return nil
+	}
+
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Environment is given either as a mapping or a list of KEY=value
+type Environment map[string]string
+
+func (e *Environment) UnmarshalYAML(node *yaml.Node) error {
+	*e = make(Environment)
+
+	if node.Kind == yaml.SequenceNode {
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		for _, item := range list {
+			key, value, _ := strings.Cut(item, "=")
+			(*e)[key] = value
+		}
+		return nil
+	}
+
+	var values map[string]string
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	for key, value := range values {
+		(*e)[key] = value
+	}
+	return nil
+}
+
+// DependsOn is given either as a list of services or a mapping with conditions
+type DependsOn []string
+
+func (d *DependsOn) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		var list []string
+		if err := node.Decode(&list); err != nil {
+			return err
+		}
+		*d = list
+		return nil
+	}
+
+	var values map[string]any
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	for name := range values {
+		*d = append(*d, name)
+	}
+	sort.Strings(*d)
+	return nil
+}
+
+// Load parses a compose file
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose file: %w", err)
+	}
+
+	var file File
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse compose file: %w", err)
+	}
+
+	if len(file.Services) == 0 {
+		return nil, fmt.Errorf("compose file %s has no services", path)
+	}
+
+	for name, service := range file.Services {
+		if service.Image == "" && service.Build == nil {
+			return nil, fmt.Errorf("service %s has neither image nor build", name)
+		}
+		for _, dep := range service.DependsOn {
+			if _, ok := file.Services[dep]; !ok {
+				return nil, fmt.Errorf("service %s depends on unknown service %s", name, dep)
+			}
+		}
+	}
+
+	return &file, nil
+}
+
+// StartOrder returns the service names so that every service comes after its dependencies
+func (f *File) StartOrder() ([]string, error) {
+	names := make([]string, 0, len(f.Services))
+	for name := range f.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var order []string
+	state := make(map[string]int) // 0 unvisited, 1 visiting, 2 done
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("dependency cycle at service %s", name)
+		case 2:
+			return nil
+		}
+
+		state[name] = 1
+		for _, dep := range f.Services[name].DependsOn {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// ContainerPort returns the port a service listens on, from expose or ports, or the default
+func (s *Service) ContainerPort(defaultPort string) string {
+	if len(s.Expose) > 0 {
+		return strings.TrimSuffix(s.Expose[0], "/tcp")
+	}
+
+	if len(s.Ports) > 0 {
+		port := s.Ports[0]
+		if i := strings.LastIndex(port, ":"); i != -1 {
+			port = port[i+1:]
+		}
+		return strings.TrimSuffix(port, "/tcp")
+	}
+
+	return defaultPort
+}
@@ -0,0 +1,268 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/git"
+	sharedTypes "github.com/karindrlainux/flying-cup/pkg/types"
+)
+
+// ProjectLabel marks every resource of a stack
+const ProjectLabel = "com.docker.compose.project"
+
+// ServiceLabel names the compose service a container runs
+const ServiceLabel = "com.docker.compose.service"
+
+// Stack runs a compose file through the Docker API under a project name
+type Stack struct {
+	Runner  *docker.DockerRunner
+	Builder docker.Builder
+	Project string
+}
+
+// UpOptions configures how a stack is brought up
+type UpOptions struct {
+	File *File
+	// Dir is the directory of the compose file, build contexts are relative to it
+	Dir string
+	// Root is the repository root, which build contexts must stay in
+	Root string
+	// Public services are routed by Traefik, which joins the stack network
+	Public []string
+	// Internal makes the stack network internal, without outbound access
+	Internal bool
+	// PublicLabels returns the routing labels of a public service listening on port
+	PublicLabels func(service, port string) map[string]string
+	// Labels are added to every container, network and volume of the stack
+	Labels map[string]string
+	// Env is added to every service, overriding the compose environment
+	Env    []string
+	Limits docker.ContainerLimits
+	// DefaultPort is used for services that neither expose nor publish a port, in the compose file or the image
+	DefaultPort string
+}
+
+// Up builds, creates and starts every service on an isolated network, returning
+// the container IDs by service name. A failed start tears the stack down again.
+func (s *Stack) Up(ctx context.Context, opts UpOptions) (map[string]string, error) {
+	if err := s.Down(ctx); err != nil {
+		return nil, fmt.Errorf("failed to remove previous stack: %w", err)
+	}
+
+	order, err := opts.File.StartOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range opts.Public {
+		if _, ok := opts.File.Services[name]; !ok {
+			return nil, fmt.Errorf("public service %s is not defined in the compose file", name)
+		}
+	}
+
+	labels := s.labels(opts.Labels)
+
+	networkName := s.NetworkName()
+	if _, err := s.Runner.EnsureNetwork(ctx, networkName, labels, opts.Internal); err != nil {
+		return nil, err
+	}
+
+	for name := range opts.File.Volumes {
+		if err := s.Runner.CreateVolume(ctx, s.Project+"_"+name, labels); err != nil {
+			s.Down(context.WithoutCancel(ctx))
+			return nil, err
+		}
+	}
+
+	containers := make(map[string]string)
+	for _, name := range order {
+		containerID, err := s.startService(ctx, name, opts, networkName, labels)
+		if err != nil {
+			s.Down(context.WithoutCancel(ctx))
+			return nil, fmt.Errorf("failed to start service %s: %w", name, err)
+		}
+		containers[name] = containerID
+	}
+
+	log.Printf("Stack %s started with %d services", s.Project, len(containers))
+	return containers, nil
+}
+
+// NetworkName returns the name of the network shared by the stack's services
+func (s *Stack) NetworkName() string {
+	return s.Project + "_default"
+}
+
+// Down removes every container, network and volume of the stack
+func (s *Stack) Down(ctx context.Context) error {
+	return s.Runner.RemoveResources(ctx, ProjectLabel, s.Project)
+}
+
+func (s *Stack) startService(ctx context.Context, name string, opts UpOptions, networkName string, stackLabels map[string]string) (string, error) {
+	service := opts.File.Services[name]
+	public := contains(opts.Public, name)
+	imageTag, err := s.serviceImage(ctx, name, service, opts.Dir, opts.Root, service.ContainerPort(opts.DefaultPort))
+	if err != nil {
+		return "", err
+	}
+
+	// The port comes from expose or ports, then the image's EXPOSE, then the default
+	port := service.ContainerPort("")
+	if port == "" {
+		if port, err = s.Runner.ExposedPort(ctx, imageTag); err != nil {
+			return "", err
+		}
+	}
+	if port == "" {
+		port = opts.DefaultPort
+	}
+
+	labels := make(map[string]string)
+	for key, value := range stackLabels {
+		labels[key] = value
+	}
+	labels[ServiceLabel] = name
+	if public && opts.PublicLabels != nil {
+		for key, value := range opts.PublicLabels(name, port) {
+			labels[key] = value
+		}
+	}
+
+	env := make([]string, 0, len(service.Environment)+len(opts.Env))
+	for key, value := range service.Environment {
+		env = append(env, key+"="+value)
+	}
+	env = append(env, opts.Env...)
+
+	containerConfig := &container.Config{
+		Image:      imageTag,
+		Labels:     labels,
+		Env:        env,
+		Cmd:        []string(service.Command),
+		Entrypoint: []string(service.Entrypoint),
+		WorkingDir: service.WorkingDir,
+		ExposedPorts: map[nat.Port]struct{}{
+			nat.Port(port + "/tcp"): {},
+		},
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(networkName),
+		RestartPolicy: container.RestartPolicy{
+			Name: "unless-stopped",
+		},
+		Mounts: s.serviceMounts(name, service, opts.File),
+	}
+
+	if err := opts.Limits.Apply(hostConfig); err != nil {
+		return "", fmt.Errorf("failed to apply container limits: %w", err)
+	}
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			networkName: {Aliases: []string{name}},
+		},
+	}
+
+	containerName := s.Project + "-" + name
+	resp, err := s.Runner.Client.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, containerName)
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+
+	if err := s.Runner.Client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return "", fmt.Errorf("failed to start container: %w", err)
+	}
+
+	fmt.Printf("✅ Service %s started as %s\n", name, containerName)
+	return resp.ID, nil
+}
+
+// serviceImage builds the service if it has a build section, or pulls its image
+func (s *Stack) serviceImage(ctx context.Context, name string, service Service, dir, root, port string) (string, error) {
+	if service.Build == nil {
+		if err := s.Runner.PullImage(ctx, service.Image); err != nil {
+			return "", err
+		}
+		return service.Image, nil
+	}
+
+	// Symlinks are resolved, so the context cannot reach host directories through one
+	rel, err := filepath.Rel(root, filepath.Join(dir, service.Build.Context))
+	if err != nil {
+		return "", fmt.Errorf("invalid build context %s: %w", service.Build.Context, err)
+	}
+	contextDir, err := git.ResolvePath(root, rel)
+	if err != nil {
+		return "", fmt.Errorf("invalid build context of service %s: %w", name, err)
+	}
+
+	dockerfile := service.Build.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	app := &sharedTypes.App{
+		Name:          strings.ToLower(s.Project + "-" + name),
+		SourcePath:    contextDir,
+		ContainerPort: port,
+	}
+
+	return s.Builder.BuildImage(ctx, app, dockerfile, false)
+}
+
+// serviceMounts maps named volumes to the stack's volumes. Bind mounts of host paths are not allowed.
+func (s *Stack) serviceMounts(name string, service Service, file *File) []mount.Mount {
+	var mounts []mount.Mount
+
+	for _, entry := range service.Volumes {
+		source, target, ok := strings.Cut(entry, ":")
+		if !ok {
+			// Anonymous volume
+			mounts = append(mounts, mount.Mount{Type: mount.TypeVolume, Target: source})
+			continue
+		}
+
+		target, _, _ = strings.Cut(target, ":")
+
+		if _, named := file.Volumes[source]; !named {
+			log.Printf("Warning: skipping bind mount %s of service %s, host paths are not mounted in previews", entry, name)
+			continue
+		}
+
+		mounts = append(mounts, mount.Mount{
+			Type:   mount.TypeVolume,
+			Source: s.Project + "_" + source,
+			Target: target,
+		})
+	}
+
+	return mounts
+}
+
+// labels returns the stack labels merged with extra labels
+func (s *Stack) labels(extra map[string]string) map[string]string {
+	labels := map[string]string{ProjectLabel: s.Project}
+	for key, value := range extra {
+		labels[key] = value
+	}
+	return labels
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,79 @@
+package compose
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sharedTypes "github.com/karindrlainux/flying-cup/pkg/types"
+)
+
+// recordingBuilder records the source trees it is asked to build
+type recordingBuilder struct {
+	sources []string
+}
+
+func (b *recordingBuilder) BuildImage(ctx context.Context, app *sharedTypes.App, dockerfile string, nonCache bool) (string, error) {
+	b.sources = append(b.sources, app.SourcePath)
+	return app.Name, nil
+}
+
+func (b *recordingBuilder) RemoveImage(ctx context.Context, imageTag string) error {
+	return nil
+}
+
+func TestServiceImageBuildContext(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(outside, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"deploy", "web"} {
+		if err := os.Mkdir(filepath.Join(repo, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(repo, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		dir     string
+		context string
+		want    string
+		wantErr bool
+	}{
+		{name: "context next to the compose file", dir: repo, context: "web", want: filepath.Join(repo, "web")},
+		{name: "context above the compose file", dir: filepath.Join(repo, "deploy"), context: "..", want: repo},
+		{name: "context outside the repository", dir: repo, context: "..", wantErr: true},
+		{name: "context behind a symlink", dir: repo, context: "link", wantErr: true},
+		{name: "context below a symlink", dir: repo, context: "link/etc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &recordingBuilder{}
+			stack := &Stack{Builder: builder, Project: "pr-app-1"}
+
+			_, err := stack.serviceImage(context.Background(), "web", Service{Build: &Build{Context: tt.context}}, tt.dir, repo, "8080")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("built from %v, want an error", builder.sources)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(builder.sources) != 1 || builder.sources[0] != tt.want {
+				t.Errorf("built from %v, want %s", builder.sources, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package deployment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/karindrlainux/flying-cup/pkg/metrics"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+var previewsEvicted = metrics.NewCounter("flying_cup_previews_evicted_total", "Previews torn down to make room for another one")
+
+// ErrNoCapacity delays a deploy until a quota leaves room for its preview
+var ErrNoCapacity = errors.New("preview quota reached")
+
+// capacityRetry is how often a deploy waiting for capacity checks the quotas again
+const capacityRetry = 30 * time.Second
+
+// Quota policies, applied when a new preview would exceed a quota
+const (
+	// QuotaEvict tears down the least recently used previews to make room
+	QuotaEvict = "evict"
+	// QuotaQueue keeps the deploy queued until room is left
+	QuotaQueue = "queue"
+)
+
+// Quotas bound the previews running on the host; zero fields are unlimited
+type Quotas struct {
+	MaxPreviews        int
+	MaxPreviewsPerRepo int
+	// MaxMemory bounds the sum of the memory limits of the running previews, in bytes
+	MaxMemory int64
+	Policy    string
+}
+
+// CapacityOptions configures the admission of new previews
+type CapacityOptions struct {
+	Quotas Quotas
+	// Memory is the memory limit expected of a new preview, before its manifest is read
+	Memory int64
+	// TryLock locks a pull request unless it is being deployed, before evicting its preview
+	TryLock func(key string) (unlock func(), ok bool)
+	// OnEvict tells a pull request its preview was torn down
+	OnEvict func(ctx context.Context, webhook *webhook.GithubPRWebhook, reason string)
+}
+
+// occupant is a preview counted against the quotas
+type occupant struct {
+	key    string
+	repo   string
+	memory int64
+	status *providers.DeploymentStatus
+	// busy occupants are being deployed and cannot be evicted
+	busy bool
+}
+
+// Capacity admits new previews within the quotas, evicting the least recently used
+// previews or delaying the deploy as configured
+type Capacity struct {
+	provider providers.Provider
+	expiry   *ExpiryScheduler
+	options  CapacityOptions
+
+	mu sync.Mutex
+	// reserved holds the pull requests admitted and still deploying
+	reserved map[string]string
+	// waiting holds the pull requests told they wait for capacity
+	waiting map[string]bool
+}
+
+// NewCapacity creates the admission of previews deployed by provider
+func NewCapacity(provider providers.Provider, expiry *ExpiryScheduler, options CapacityOptions) *Capacity {
+	return &Capacity{
+		provider: provider,
+		expiry:   expiry,
+		options:  options,
+		reserved: make(map[string]string),
+		waiting:  make(map[string]bool),
+	}
+}
+
+// Enabled reports whether any quota is set
+func (c *Capacity) Enabled() bool {
+	q := c.options.Quotas
+	return q.MaxPreviews > 0 || q.MaxPreviewsPerRepo > 0 || q.MaxMemory > 0
+}
+
+// Admit reserves room for the preview of a job until Release. A redeploy replaces the
+// preview of its pull request, so that preview does not count. When a quota is reached,
+// the least recently used previews are evicted with the evict policy; otherwise, or if
+// none can be evicted, an error wrapping ErrNoCapacity is returned.
+func (c *Capacity) Admit(ctx context.Context, job *Job) error {
+	if !c.Enabled() {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	occupants, err := c.occupantsLocked(ctx, job.Key())
+	if err != nil {
+		return err
+	}
+
+	repo := job.Webhook.Repository.Name
+	skipped := make(map[string]bool)
+	for {
+		reason, sameRepo, memory := c.exceeded(occupants, repo)
+		if reason == "" {
+			break
+		}
+
+		if c.options.Quotas.Policy != QuotaEvict {
+			return fmt.Errorf("%w: %s", ErrNoCapacity, reason)
+		}
+
+		victim := c.leastRecentlyUsed(occupants, repo, sameRepo, memory, skipped)
+		if victim == nil {
+			return fmt.Errorf("%w: %s and no preview can be evicted", ErrNoCapacity, reason)
+		}
+
+		if err := c.evict(ctx, victim, reason); err != nil {
+			log.Printf("❌ Failed to evict preview %s: %v", victim.status.ID, err)
+			skipped[victim.key] = true
+			continue
+		}
+		delete(occupants, victim.key)
+	}
+
+	c.reserved[job.Key()] = repo
+	delete(c.waiting, job.Key())
+	return nil
+}
+
+// Release frees the room reserved for a job once its deploy ended; the preview then
+// counts as deployed, unless it failed
+func (c *Capacity) Release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.reserved, key)
+}
+
+// Wait records a pull request waiting for capacity, and reports whether it waits for
+// the first time, to tell it only once
+func (c *Capacity) Wait(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.waiting[key] {
+		return false
+	}
+	c.waiting[key] = true
+	return true
+}
+
+// Forget drops a closed pull request
+func (c *Capacity) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.waiting, key)
+}
+
+// exceeded describes the quota a new preview of repo would exceed, and tells whether
+// only the previews of repo, or only running previews, can make room for it
+func (c *Capacity) exceeded(occupants map[string]*occupant, repo string) (reason string, sameRepo, memory bool) {
+	quotas := c.options.Quotas
+
+	total, inRepo := 0, 0
+	reserved := c.options.Memory
+	for _, o := range occupants {
+		total++
+		if o.repo == repo {
+			inRepo++
+		}
+		reserved += o.memory
+	}
+
+	switch {
+	case quotas.MaxPreviewsPerRepo > 0 && inRepo >= quotas.MaxPreviewsPerRepo:
+		return fmt.Sprintf("%s already has %d previews", repo, inRepo), true, false
+	case quotas.MaxPreviews > 0 && total >= quotas.MaxPreviews:
+		return fmt.Sprintf("%d previews are deployed", total), false, false
+	case quotas.MaxMemory > 0 && reserved > quotas.MaxMemory:
+		return fmt.Sprintf("previews would reserve %s of memory out of %s", units.BytesSize(float64(reserved)), units.BytesSize(float64(quotas.MaxMemory))), false, true
+	}
+	return "", false, false
+}
+
+// leastRecentlyUsed picks the preview to evict: the one with the oldest activity among
+// those not deployed right now, not kept by label and, for the memory quota, running
+func (c *Capacity) leastRecentlyUsed(occupants map[string]*occupant, repo string, sameRepo, memory bool, skipped map[string]bool) *occupant {
+	var candidates []*occupant
+	for _, o := range occupants {
+		if o.busy || skipped[o.key] || (sameRepo && o.repo != repo) || (memory && o.memory == 0) {
+			continue
+		}
+		if c.expiry.Kept(o.key) {
+			continue
+		}
+		candidates = append(candidates, o)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := c.expiry.LastActivity(candidates[i].key), c.expiry.LastActivity(candidates[j].key)
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return candidates[i].key < candidates[j].key
+	})
+	return candidates[0]
+}
+
+// evict tears down a preview and tells its pull request, unless it started deploying
+func (c *Capacity) evict(ctx context.Context, victim *occupant, reason string) error {
+	unlock, ok := c.options.TryLock(victim.key)
+	if !ok {
+		return fmt.Errorf("a deploy of %s is running", victim.key)
+	}
+	defer unlock()
+
+	log.Printf("🪂 Evicting preview %s, the least recently used: %s", victim.status.ID, reason)
+	if err := c.expiry.Evict(ctx, victim.key, victim.status); err != nil {
+		return err
+	}
+	previewsEvicted.Inc()
+
+	if hook, _ := c.expiry.Lookup(victim.key); hook != nil && c.options.OnEvict != nil {
+		c.options.OnEvict(ctx, hook, reason)
+	}
+	return nil
+}
+
+// occupantsLocked returns the previews counted against the quotas, except the one of
+// the pull request being admitted: deployed and sleeping previews, deploys in progress
+// and the admitted deploys not registered by the provider yet
+func (c *Capacity) occupantsLocked(ctx context.Context, admitted string) (map[string]*occupant, error) {
+	deployments, err := c.provider.ListDeployments(ctx, providers.DeploymentFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	occupants := make(map[string]*occupant)
+	for _, status := range deployments {
+		key := JobKey(status.Repo, status.PR)
+		if key == admitted {
+			continue
+		}
+
+		switch status.Phase {
+		case providers.PhaseFailed, providers.PhaseStopped:
+			continue
+		case providers.PhaseReady, providers.PhaseSleeping:
+			occupants[key] = &occupant{key: key, repo: status.Repo, memory: status.Memory, status: status}
+		default:
+			occupants[key] = &occupant{key: key, repo: status.Repo, memory: c.options.Memory, status: status, busy: true}
+		}
+	}
+
+	for key, repo := range c.reserved {
+		if key == admitted {
+			continue
+		}
+		// The deployed preview being replaced is counted as being deployed
+		occupants[key] = &occupant{key: key, repo: repo, memory: max(c.options.Memory, memoryOf(occupants[key])), busy: true}
+	}
+
+	return occupants, nil
+}
+
+func memoryOf(o *occupant) int64 {
+	if o == nil {
+		return 0
+	}
+	return o.memory
+}
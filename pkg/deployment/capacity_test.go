@@ -0,0 +1,165 @@
+package deployment
+
+import (
+	"testing"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// testOccupants indexes occupants by key
+func testOccupants(occupants ...*occupant) map[string]*occupant {
+	indexed := make(map[string]*occupant)
+	for _, o := range occupants {
+		indexed[o.key] = o
+	}
+	return indexed
+}
+
+func TestCapacityExceeded(t *testing.T) {
+	occupants := testOccupants(
+		&occupant{key: "app#1", repo: "app", memory: 256 << 20},
+		&occupant{key: "app#2", repo: "app", memory: 256 << 20},
+		&occupant{key: "api#1", repo: "api"},
+	)
+
+	tests := []struct {
+		name         string
+		quotas       Quotas
+		repo         string
+		wantExceeded bool
+		wantSameRepo bool
+		wantMemory   bool
+	}{
+		{name: "unlimited", repo: "app"},
+		{name: "room left", quotas: Quotas{MaxPreviews: 4, MaxPreviewsPerRepo: 3, MaxMemory: 1 << 30}, repo: "app"},
+		{name: "repository full", quotas: Quotas{MaxPreviewsPerRepo: 2}, repo: "app", wantExceeded: true, wantSameRepo: true},
+		{name: "other repository has room", quotas: Quotas{MaxPreviewsPerRepo: 2}, repo: "api"},
+		{name: "host full", quotas: Quotas{MaxPreviews: 3}, repo: "web", wantExceeded: true},
+		{name: "repository quota checked first", quotas: Quotas{MaxPreviews: 3, MaxPreviewsPerRepo: 2}, repo: "app", wantExceeded: true, wantSameRepo: true},
+		// The new preview is expected to reserve 256MiB too
+		{name: "memory full", quotas: Quotas{MaxMemory: 512 << 20}, repo: "web", wantExceeded: true, wantMemory: true},
+		{name: "memory fits exactly", quotas: Quotas{MaxMemory: 768 << 20}, repo: "web"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Capacity{options: CapacityOptions{Quotas: tt.quotas, Memory: 256 << 20}}
+
+			reason, sameRepo, memory := c.exceeded(occupants, tt.repo)
+			if (reason != "") != tt.wantExceeded {
+				t.Fatalf("exceeded %q, want exceeded: %t", reason, tt.wantExceeded)
+			}
+			if sameRepo != tt.wantSameRepo {
+				t.Errorf("same repository only: %t, want %t", sameRepo, tt.wantSameRepo)
+			}
+			if memory != tt.wantMemory {
+				t.Errorf("running previews only: %t, want %t", memory, tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestCapacityLeastRecentlyUsed(t *testing.T) {
+	now := time.Now()
+	kept := &webhook.GithubPRWebhook{}
+	kept.PullRequest.Labels = []webhook.Label{{Name: "keep"}}
+
+	expiry := &ExpiryScheduler{
+		options: ExpiryOptions{KeepLabel: "keep"},
+		records: map[string]*previewRecord{
+			"app#1": {LastActivity: now.Add(-3 * time.Hour)},
+			"app#2": {LastActivity: now.Add(-2 * time.Hour)},
+			"api#1": {LastActivity: now.Add(-time.Hour)},
+			"api#2": {LastActivity: now.Add(-4 * time.Hour), Webhook: kept},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		occupants map[string]*occupant
+		repo      string
+		sameRepo  bool
+		memory    bool
+		skipped   map[string]bool
+		want      string
+	}{
+		{
+			name: "oldest activity",
+			occupants: testOccupants(
+				&occupant{key: "api#1", repo: "api"},
+				&occupant{key: "app#2", repo: "app"},
+				&occupant{key: "app#1", repo: "app"},
+			),
+			want: "app#1",
+		},
+		{
+			name: "kept and busy previews are not evicted",
+			occupants: testOccupants(
+				&occupant{key: "api#2", repo: "api"},
+				&occupant{key: "app#1", repo: "app", busy: true},
+				&occupant{key: "app#2", repo: "app"},
+			),
+			want: "app#2",
+		},
+		{
+			name: "skipped previews are not evicted again",
+			occupants: testOccupants(
+				&occupant{key: "app#1", repo: "app"},
+				&occupant{key: "api#1", repo: "api"},
+			),
+			skipped: map[string]bool{"app#1": true},
+			want:    "api#1",
+		},
+		{
+			name: "same repository only",
+			occupants: testOccupants(
+				&occupant{key: "app#1", repo: "app"},
+				&occupant{key: "api#1", repo: "api"},
+			),
+			repo:     "api",
+			sameRepo: true,
+			want:     "api#1",
+		},
+		{
+			name: "running previews only for the memory quota",
+			occupants: testOccupants(
+				&occupant{key: "app#1", repo: "app"},
+				&occupant{key: "app#2", repo: "app", memory: 256 << 20},
+			),
+			memory: true,
+			want:   "app#2",
+		},
+		{
+			name: "untracked previews first, by key",
+			occupants: testOccupants(
+				&occupant{key: "web#2", repo: "web"},
+				&occupant{key: "web#1", repo: "web"},
+				&occupant{key: "app#1", repo: "app"},
+			),
+			want: "web#1",
+		},
+		{
+			name: "nothing to evict",
+			occupants: testOccupants(
+				&occupant{key: "api#2", repo: "api"},
+				&occupant{key: "app#1", repo: "app", busy: true},
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Capacity{expiry: expiry}
+
+			victim := c.leastRecentlyUsed(tt.occupants, tt.repo, tt.sameRepo, tt.memory, tt.skipped)
+			got := ""
+			if victim != nil {
+				got = victim.key
+			}
+			if got != tt.want {
+				t.Errorf("evicting %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
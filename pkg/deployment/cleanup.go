@@ -2,6 +2,7 @@ package deployment
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 
@@ -26,12 +27,36 @@ func CleanupPullRequest(ctx context.Context, repoName, prName string, prNumber i
 	return nil
 }
 
-// CleanupAllDeployments removes all active deployments
-func CleanupAllDeployments(provider providers.Provider) error {
+// CleanupAllDeployments removes every deployment matching the filter and returns them.
+// With dryRun, the deployments are only listed.
+func CleanupAllDeployments(ctx context.Context, provider providers.Provider, filter providers.DeploymentFilter, dryRun bool) ([]*providers.DeploymentStatus, error) {
 	log.Printf("Starting cleanup of all deployments")
 
-	// TODO: Implement cleanup of all deployments
-	// This would require the provider to support listing all deployments
-	log.Printf("✅ Successfully cleaned up all deployments")
-	return nil
+	deployments, err := provider.ListDeployments(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	var errs []error
+	for _, d := range deployments {
+		if dryRun {
+			log.Printf("Would remove %s (PR #%d of %s, %s)", d.ID, d.PR, d.Repo, d.Phase)
+			continue
+		}
+
+		if err := CleanupPullRequest(ctx, d.Repo, d.Title, d.PR, provider); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", d.ID, err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return deployments, err
+	}
+
+	if dryRun {
+		log.Printf("Dry run: %d deployments would be removed", len(deployments))
+	} else {
+		log.Printf("✅ Successfully cleaned up %d deployments", len(deployments))
+	}
+	return deployments, nil
 }
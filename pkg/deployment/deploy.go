@@ -25,10 +25,65 @@ func DeployPullRequest(ctx context.Context, webhook *webhook.GithubPRWebhook, pr
 
 	// Wait for deployment to be ready
 	log.Printf("Waiting for deployment to be ready...")
-	time.Sleep(5 * time.Second)
+	select {
+	case <-time.After(5 * time.Second):
+	case <-ctx.Done():
+		return "", fmt.Errorf("deployment cancelled: %w", ctx.Err())
+	}
 
 	log.Printf("✅ Successfully deployed PR #%d", webhook.Number)
 	log.Printf("🌐 Preview available at: %s", previewURL)
 
 	return previewURL, nil
 }
+
+// RollbackPullRequest runs an earlier release of a pull request without building it
+func RollbackPullRequest(ctx context.Context, webhook *webhook.GithubPRWebhook, release Release, provider providers.Provider) (string, error) {
+	deployer, ok := provider.(providers.ImageDeployer)
+	if !ok {
+		return "", fmt.Errorf("the deployment provider does not support rollbacks")
+	}
+
+	// Older releases were recorded without their manifest and cannot run without the clone
+	if release.Manifest == nil {
+		return "", fmt.Errorf("commit %s was recorded without its manifest and cannot be rolled back to, push it again instead", release.SHA)
+	}
+
+	log.Printf("Rolling back PR #%d (%s) to %s", webhook.Number, webhook.Repository.Name, release.SHA)
+
+	// The preview is labelled with the commit it runs
+	rollback := *webhook
+	rollback.PullRequest.Head.Sha = release.SHA
+
+	previewURL, err := deployer.DeployImage(ctx, &rollback, providers.ReleaseSpec{
+		Image:    release.Image,
+		Manifest: release.Manifest,
+		Port:     release.Port,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to roll back deployment: %w", err)
+	}
+
+	log.Printf("✅ Rolled back PR #%d to %s", webhook.Number, release.SHA)
+	return previewURL, nil
+}
+
+// DeployedCommit returns the ready deployment of a pull request if it already runs the
+// head commit of the webhook, which makes redelivered and resumed deploys idempotent
+func DeployedCommit(ctx context.Context, webhook *webhook.GithubPRWebhook, provider providers.Provider) (*providers.DeploymentStatus, error) {
+	deployments, err := provider.ListDeployments(ctx, providers.DeploymentFilter{
+		Repo:  webhook.Repository.Name,
+		PR:    webhook.Number,
+		Phase: providers.PhaseReady,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	for _, status := range deployments {
+		if status.SHA != "" && status.SHA == webhook.PullRequest.Head.Sha {
+			return status, nil
+		}
+	}
+	return nil, nil
+}
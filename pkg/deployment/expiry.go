@@ -0,0 +1,384 @@
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/metrics"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+var previewsExpired = metrics.NewCounter("flying_cup_previews_expired_total", "Previews torn down after their TTL")
+
+// TTLPolicy bounds the lifetime of the previews of a repository; zero disables a bound
+type TTLPolicy struct {
+	// MaxAge counts from the first deploy of a pull request
+	MaxAge time.Duration
+	// IdleTTL counts from the last activity on the preview, e.g. a push or a wake
+	IdleTTL time.Duration
+}
+
+// ExpiryOptions configures an expiry scheduler
+type ExpiryOptions struct {
+	Default TTLPolicy
+	// Repos overrides the default policy per repository
+	Repos map[string]TTLPolicy
+	// Warning is how long before the teardown the pull request is warned
+	Warning time.Duration
+	// KeepLabel exempts a pull request from expiry
+	KeepLabel string
+	// Lock keeps deploys of a pull request from racing with its teardown
+	Lock func(key string) (unlock func())
+	// Webhook returns the latest webhook of a pull request, to warn about previews
+	// tracked before their records, optional
+	Webhook func(key string) *webhook.GithubPRWebhook
+}
+
+// ExpiryEvent tells a pull request about the expiry of its preview
+type ExpiryEvent struct {
+	Webhook *webhook.GithubPRWebhook
+	// Expired is false for the warning before the teardown
+	Expired bool
+	At      time.Time
+	Reason  string
+}
+
+// previewRecord is what the scheduler knows about the preview of a pull request
+type previewRecord struct {
+	Webhook      *webhook.GithubPRWebhook `json:"webhook,omitempty"`
+	FirstSeen    time.Time                `json:"first_seen"`
+	LastActivity time.Time                `json:"last_activity"`
+	// WarnedFor is the expiry the pull request was warned about, at WarnedAt
+	WarnedFor time.Time `json:"warned_for,omitempty"`
+	WarnedAt  time.Time `json:"warned_at,omitempty"`
+	Expired   bool      `json:"expired,omitempty"`
+}
+
+// ExpiryScheduler tears down previews that outlived their TTL, after warning their pull request
+type ExpiryScheduler struct {
+	path     string
+	options  ExpiryOptions
+	provider providers.Provider
+
+	mu      sync.Mutex
+	records map[string]*previewRecord
+}
+
+// NewExpiryScheduler opens the preview records stored at path
+func NewExpiryScheduler(path string, provider providers.Provider, options ExpiryOptions) (*ExpiryScheduler, error) {
+	s := &ExpiryScheduler{path: path, options: options, provider: provider, records: make(map[string]*previewRecord)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read preview records: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.records); err != nil {
+		return nil, fmt.Errorf("failed to decode preview records: %w", err)
+	}
+
+	return s, nil
+}
+
+// Policy returns the TTL policy of a repository
+func (s *ExpiryScheduler) Policy(repoName string) TTLPolicy {
+	if policy, exists := s.options.Repos[repoName]; exists {
+		return policy
+	}
+	return s.options.Default
+}
+
+// Track records a push to a pull request, which counts as activity and revives an expired
+// preview. A revived preview starts its maximum age again.
+func (s *ExpiryScheduler) Track(webhook *webhook.GithubPRWebhook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.recordLocked(JobKey(webhook.Repository.Name, webhook.Number))
+	if record.Expired {
+		record.FirstSeen = time.Now()
+	}
+	record.Webhook = webhook
+	record.LastActivity = time.Now()
+	record.WarnedFor = time.Time{}
+	record.Expired = false
+	s.saveLocked()
+}
+
+// UpdateLabels records the new labels of a pull request
+func (s *ExpiryScheduler) UpdateLabels(webhook *webhook.GithubPRWebhook) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.records[JobKey(webhook.Repository.Name, webhook.Number)]
+	if !exists || record.Webhook == nil {
+		return
+	}
+	record.Webhook.PullRequest.Labels = webhook.PullRequest.Labels
+	s.saveLocked()
+}
+
+// Touch records activity on the preview of a pull request, which delays its idle expiry
+func (s *ExpiryScheduler) Touch(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, exists := s.records[key]; exists {
+		record.LastActivity = time.Now()
+		record.WarnedFor = time.Time{}
+		s.saveLocked()
+	}
+}
+
+// Lookup returns the latest webhook of a pull request, and whether its preview expired
+func (s *ExpiryScheduler) Lookup(key string) (*webhook.GithubPRWebhook, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.records[key]
+	if !exists {
+		return nil, false
+	}
+	return record.Webhook, record.Expired
+}
+
+// ExpiresAt returns when the preview of a pull request expires, zero if it never does
+func (s *ExpiryScheduler) ExpiresAt(key string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.records[key]
+	if !exists || record.Webhook == nil {
+		return time.Time{}
+	}
+	expiresAt, _ := s.expiryLocked(record, record.Webhook.Repository.Name)
+	return expiresAt
+}
+
+// Forget drops the record of a closed pull request
+func (s *ExpiryScheduler) Forget(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	s.saveLocked()
+}
+
+// Run checks the previews every interval until ctx is done
+func (s *ExpiryScheduler) Run(ctx context.Context, interval time.Duration, notify func(ctx context.Context, event ExpiryEvent)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Check(ctx, notify); err != nil {
+			log.Printf("Warning: preview expiry check failed: %v", err)
+		}
+	}
+}
+
+// Check warns the pull requests whose preview expires within the warning period and
+// tears down the expired previews. Previews never seen before start their TTL now.
+// Previews whose pull request cannot be warned, as no webhook is known for it, are
+// left running until the next push.
+func (s *ExpiryScheduler) Check(ctx context.Context, notify func(ctx context.Context, event ExpiryEvent)) error {
+	deployments, err := s.provider.ListDeployments(ctx, providers.DeploymentFilter{})
+	if err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	now := time.Now()
+	for _, status := range deployments {
+		// Sleeping previews still hold their containers, so they expire too
+		if status.Phase != providers.PhaseReady && status.Phase != providers.PhaseSleeping {
+			continue
+		}
+
+		key := JobKey(status.Repo, status.PR)
+
+		s.mu.Lock()
+		_, known := s.records[key]
+		changed := !known
+		record := s.recordLocked(key)
+		if record.Webhook == nil && s.options.Webhook != nil {
+			record.Webhook = s.options.Webhook(key)
+			changed = changed || record.Webhook != nil
+		}
+		hook := record.Webhook
+		if hook == nil || (s.options.KeepLabel != "" && hook.PullRequest.HasLabel(s.options.KeepLabel)) {
+			if changed {
+				s.saveLocked()
+			}
+			s.mu.Unlock()
+			continue
+		}
+
+		expiresAt, reason := s.expiryLocked(record, status.Repo)
+		if expiresAt.IsZero() {
+			if changed {
+				s.saveLocked()
+			}
+			s.mu.Unlock()
+			continue
+		}
+
+		// Pull requests are always warned, so a late warning postpones the teardown
+		warn := !now.Before(expiresAt.Add(-s.options.Warning)) && !record.WarnedFor.Equal(expiresAt)
+		if warn {
+			record.WarnedFor = expiresAt
+			record.WarnedAt = now
+		}
+		teardownAt := expiresAt
+		if record.WarnedFor.Equal(expiresAt) {
+			teardownAt = later(expiresAt, record.WarnedAt.Add(s.options.Warning))
+		}
+		if warn || changed {
+			s.saveLocked()
+		}
+		s.mu.Unlock()
+
+		if warn {
+			log.Printf("⏰ Preview of PR #%d (%s) expires at %s: %s", status.PR, status.Repo, teardownAt.Format(time.RFC3339), reason)
+			notify(ctx, ExpiryEvent{Webhook: hook, At: teardownAt, Reason: reason})
+		}
+
+		if now.Before(teardownAt) {
+			continue
+		}
+
+		if err := s.expire(ctx, key, status); err != nil {
+			log.Printf("❌ Failed to tear down expired preview %s: %v", status.ID, err)
+			continue
+		}
+
+		notify(ctx, ExpiryEvent{Webhook: hook, Expired: true, At: now, Reason: reason})
+	}
+
+	return nil
+}
+
+// expire tears down a preview, keeping its record so it can be woken up
+func (s *ExpiryScheduler) expire(ctx context.Context, key string, status *providers.DeploymentStatus) error {
+	if s.options.Lock != nil {
+		unlock := s.options.Lock(key)
+		defer unlock()
+	}
+
+	log.Printf("⌛ Tearing down expired preview %s", status.ID)
+	if err := s.Evict(ctx, key, status); err != nil {
+		return err
+	}
+	previewsExpired.Inc()
+	return nil
+}
+
+// Evict tears down a preview, keeping its record so it can be woken up or redeployed
+// on the next push. Callers must hold the lock of the pull request.
+func (s *ExpiryScheduler) Evict(ctx context.Context, key string, status *providers.DeploymentStatus) error {
+	if err := CleanupPullRequest(ctx, status.Repo, status.Title, status.PR, s.provider); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recordLocked(key).Expired = true
+	s.saveLocked()
+	return nil
+}
+
+// LastActivity returns the last activity on the preview of a pull request, zero if unknown
+func (s *ExpiryScheduler) LastActivity(key string) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if record, exists := s.records[key]; exists {
+		return record.LastActivity
+	}
+	return time.Time{}
+}
+
+// Kept reports whether a pull request carries the keep label
+func (s *ExpiryScheduler) Kept(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, exists := s.records[key]
+	return exists && record.Webhook != nil && s.options.KeepLabel != "" && record.Webhook.PullRequest.HasLabel(s.options.KeepLabel)
+}
+
+// expiryLocked returns the earliest expiry of a preview under its repository's policy, with its reason
+func (s *ExpiryScheduler) expiryLocked(record *previewRecord, repoName string) (time.Time, string) {
+	policy := s.Policy(repoName)
+
+	var expiresAt time.Time
+	var reason string
+	if policy.MaxAge > 0 {
+		expiresAt = record.FirstSeen.Add(policy.MaxAge)
+		reason = fmt.Sprintf("older than %s", policy.MaxAge)
+	}
+	if policy.IdleTTL > 0 {
+		idleAt := record.LastActivity.Add(policy.IdleTTL)
+		if expiresAt.IsZero() || idleAt.Before(expiresAt) {
+			expiresAt = idleAt
+			reason = fmt.Sprintf("no activity for %s", policy.IdleTTL)
+		}
+	}
+	return expiresAt, reason
+}
+
+// recordLocked returns the record of a pull request, creating it if needed
+func (s *ExpiryScheduler) recordLocked(key string) *previewRecord {
+	record, exists := s.records[key]
+	if !exists {
+		now := time.Now()
+		record = &previewRecord{FirstSeen: now, LastActivity: now}
+		s.records[key] = record
+	}
+	return record
+}
+
+// saveLocked writes the records atomically; failures are only logged since the records
+// can be rebuilt from the running previews
+func (s *ExpiryScheduler) saveLocked() {
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		log.Printf("Warning: failed to encode preview records: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		log.Printf("Warning: failed to create preview records directory: %v", err)
+		return
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Warning: failed to write preview records: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		log.Printf("Warning: failed to write preview records: %v", err)
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,83 @@
+package deployment
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// fakeProvider lists fixed deployments and records the cleanups
+type fakeProvider struct {
+	deployments []*providers.DeploymentStatus
+	cleaned     []int
+}
+
+func (p *fakeProvider) Init(config interface{}) error { return nil }
+
+func (p *fakeProvider) CreateDeployment(ctx context.Context, webhook *webhook.GithubPRWebhook) (string, error) {
+	return "", nil
+}
+
+func (p *fakeProvider) CleanupDeployment(ctx context.Context, repoName, prName string, prNumber int) error {
+	p.cleaned = append(p.cleaned, prNumber)
+	return nil
+}
+
+func (p *fakeProvider) GetDeploymentStatus(ctx context.Context, deploymentID string) (*providers.DeploymentStatus, error) {
+	return nil, nil
+}
+
+func (p *fakeProvider) ListDeployments(ctx context.Context, filter providers.DeploymentFilter) ([]*providers.DeploymentStatus, error) {
+	return p.deployments, nil
+}
+
+func TestTrackRevivesExpiredPreview(t *testing.T) {
+	tests := []struct {
+		name     string
+		expired  bool
+		wantWarn bool
+	}{
+		{name: "expired preview starts its maximum age again", expired: true},
+		{name: "running preview keeps its age", expired: false, wantWarn: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{deployments: []*providers.DeploymentStatus{
+				{ID: "app-pr-login-1", Repo: "app", PR: 1, Title: "login", Phase: providers.PhaseReady},
+			}}
+			expiry, err := NewExpiryScheduler(filepath.Join(t.TempDir(), "expiry.json"), provider, ExpiryOptions{
+				Default: TTLPolicy{MaxAge: 24 * time.Hour},
+				Warning: time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			twoDaysAgo := time.Now().Add(-48 * time.Hour)
+			expiry.records["app#1"] = &previewRecord{FirstSeen: twoDaysAgo, LastActivity: twoDaysAgo, Expired: tt.expired}
+
+			hook := testJob("app", 1, PriorityNormal).Webhook
+			hook.PullRequest.Title = "login"
+			expiry.Track(hook)
+
+			var events []ExpiryEvent
+			if err := expiry.Check(context.Background(), func(ctx context.Context, event ExpiryEvent) {
+				events = append(events, event)
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			if warned := len(events) > 0; warned != tt.wantWarn {
+				t.Errorf("warned: %t (%+v), want %t", warned, events, tt.wantWarn)
+			}
+			if len(provider.cleaned) > 0 {
+				t.Errorf("preview torn down right after the push")
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package deployment
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// Release is a commit deployed to the preview of a pull request
+type Release struct {
+	SHA string `json:"sha"`
+	// Image is the image the commit ran from, pulled again if the local one is gone
+	Image string `json:"image"`
+	// Manifest and Port are what the commit ran with, so a rollback does not depend on the
+	// branch head. Env is resolved again from the manifest, so secrets are not stored.
+	Manifest   *manifest.Manifest `json:"manifest,omitempty"`
+	Port       string             `json:"port,omitempty"`
+	DeployedAt time.Time          `json:"deployed_at"`
+}
+
+// History records the commits deployed to each pull request, newest first, to roll back
+// to one of them. Rollbacks are not recorded, so rolling back twice goes further back.
+type History struct {
+	path  string
+	limit int
+
+	mu       sync.Mutex
+	releases map[string][]Release
+}
+
+// OpenHistory opens the deployment history stored at path, keeping limit releases per
+// pull request
+func OpenHistory(path string, limit int) (*History, error) {
+	h := &History{path: path, limit: max(limit, 1), releases: make(map[string][]Release)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deployment history: %w", err)
+	}
+	if err := json.Unmarshal(data, &h.releases); err != nil {
+		return nil, fmt.Errorf("failed to decode deployment history: %w", err)
+	}
+
+	return h, nil
+}
+
+// Record adds a deployed commit to the history of a pull request, replacing an earlier
+// deploy of the same commit
+func (h *History) Record(key string, release Release) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	releases := []Release{release}
+	for _, existing := range h.releases[key] {
+		if existing.SHA != release.SHA && len(releases) < h.limit {
+			releases = append(releases, existing)
+		}
+	}
+	h.releases[key] = releases
+	h.saveLocked()
+}
+
+// RecordDeployment records the head commit of a pull request once its deploy succeeded
+func (h *History) RecordDeployment(ctx context.Context, webhook *webhook.GithubPRWebhook, provider providers.Provider) error {
+	deployed, err := DeployedCommit(ctx, webhook, provider)
+	if err != nil {
+		return err
+	}
+	if deployed == nil {
+		return fmt.Errorf("no ready deployment of %s found", webhook.PullRequest.Head.Sha)
+	}
+
+	release := Release{SHA: deployed.SHA, Image: deployed.Image, DeployedAt: time.Now()}
+	if deployer, ok := provider.(providers.ImageDeployer); ok {
+		if spec, ok := deployer.RunningRelease(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number); ok {
+			release.Manifest = spec.Manifest
+			release.Port = spec.Port
+		}
+	}
+
+	h.Record(JobKey(webhook.Repository.Name, webhook.Number), release)
+	return nil
+}
+
+// Releases returns the deployed commits of a pull request, newest first
+func (h *History) Releases(key string) []Release {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return append([]Release{}, h.releases[key]...)
+}
+
+// Find returns the release of a pull request whose SHA starts with sha
+func (h *History) Find(key, sha string) (Release, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, release := range h.releases[key] {
+		if sha != "" && strings.HasPrefix(release.SHA, strings.ToLower(sha)) {
+			return release, true
+		}
+	}
+	return Release{}, false
+}
+
+// Previous returns the release deployed before the commit a pull request runs, or the
+// latest release if the commit is not in the history, e.g. after a failed build
+func (h *History) Previous(key, currentSHA string) (Release, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	releases := h.releases[key]
+	for i, release := range releases {
+		if release.SHA == currentSHA {
+			if i+1 < len(releases) {
+				return releases[i+1], true
+			}
+			return Release{}, false
+		}
+	}
+	if len(releases) > 0 {
+		return releases[0], true
+	}
+	return Release{}, false
+}
+
+// Forget drops the history of a closed pull request
+func (h *History) Forget(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, exists := h.releases[key]; !exists {
+		return
+	}
+	delete(h.releases, key)
+	h.saveLocked()
+}
+
+// saveLocked writes the history atomically; failures are only logged since the history
+// only serves rollbacks
+func (h *History) saveLocked() {
+	data, err := json.MarshalIndent(h.releases, "", "  ")
+	if err != nil {
+		log.Printf("Warning: failed to encode deployment history: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		log.Printf("Warning: failed to create deployment history directory: %v", err)
+		return
+	}
+
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		log.Printf("Warning: failed to write deployment history: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		log.Printf("Warning: failed to write deployment history: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package deployment
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+// testHistory returns a history of app#1 holding the commits c3, c2 and c1, newest first
+func testHistory(t *testing.T) *History {
+	t.Helper()
+
+	history, err := OpenHistory(filepath.Join(t.TempDir(), "history.json"), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sha := range []string{"c1aaaa", "c2bbbb", "c3cccc"} {
+		history.Record("app#1", Release{SHA: sha, Image: "app:" + sha})
+	}
+	return history
+}
+
+func TestHistoryPrevious(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		current string
+		want    string
+	}{
+		{name: "release before the running one", key: "app#1", current: "c3cccc", want: "c2bbbb"},
+		{name: "after a rollback", key: "app#1", current: "c2bbbb", want: "c1aaaa"},
+		{name: "oldest release runs", key: "app#1", current: "c1aaaa"},
+		{name: "running commit never deployed", key: "app#1", current: "c4dddd", want: "c3cccc"},
+		{name: "no history", key: "app#2", current: "c3cccc"},
+	}
+
+	history := testHistory(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, found := history.Previous(tt.key, tt.current)
+			if found != (tt.want != "") {
+				t.Fatalf("found %t, want %q", found, tt.want)
+			}
+			if release.SHA != tt.want {
+				t.Errorf("previous release %q, want %q", release.SHA, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryFind(t *testing.T) {
+	tests := []struct {
+		name string
+		sha  string
+		want string
+	}{
+		{name: "full SHA", sha: "c2bbbb", want: "c2bbbb"},
+		{name: "short SHA", sha: "c1a", want: "c1aaaa"},
+		{name: "upper case", sha: "C3C", want: "c3cccc"},
+		{name: "unknown SHA", sha: "ffff"},
+		{name: "empty SHA", sha: ""},
+	}
+
+	history := testHistory(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release, found := history.Find("app#1", tt.sha)
+			if found != (tt.want != "") {
+				t.Fatalf("found %t, want %q", found, tt.want)
+			}
+			if release.SHA != tt.want {
+				t.Errorf("found release %q, want %q", release.SHA, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistoryRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.json")
+	history, err := OpenHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history.Record("app#1", Release{SHA: "c1aaaa"})
+	history.Record("app#1", Release{SHA: "c2bbbb", Manifest: &manifest.Manifest{Port: 3000}, Port: "3000"})
+	// A redeploy of c1 moves it ahead of c2, which the limit drops on the next deploy
+	history.Record("app#1", Release{SHA: "c1aaaa"})
+	history.Record("app#1", Release{SHA: "c3cccc"})
+
+	reopened, err := OpenHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	releases := reopened.Releases("app#1")
+	if len(releases) != 2 || releases[0].SHA != "c3cccc" || releases[1].SHA != "c1aaaa" {
+		t.Fatalf("releases %+v, want c3cccc then c1aaaa", releases)
+	}
+
+	history.Record("app#1", Release{SHA: "c2bbbb", Manifest: &manifest.Manifest{Port: 3000}, Port: "3000"})
+	reopened, err = OpenHistory(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, _ := reopened.Find("app#1", "c2bbbb")
+	if release.Manifest == nil || release.Manifest.Port != 3000 || release.Port != "3000" {
+		t.Errorf("release %+v lost the manifest and port it ran with", release)
+	}
+}
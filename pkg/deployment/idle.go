@@ -0,0 +1,305 @@
+package deployment
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/metrics"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+)
+
+var (
+	previewsSlept = metrics.NewCounter("flying_cup_previews_slept_total", "Previews scaled to zero for lack of traffic")
+	previewsWoken = metrics.NewCounter("flying_cup_previews_woken_total", "Sleeping previews started again by a request")
+)
+
+// ErrUnknownPreview is returned when waking a host no tracked deployment serves
+var ErrUnknownPreview = errors.New("no preview is tracked for this host")
+
+// activityInterval throttles how often requests count as activity for preview expiry
+const activityInterval = time.Minute
+
+// IdleOptions configures an idle scaler
+type IdleOptions struct {
+	// After is how long a preview runs without requests before it is stopped
+	After time.Duration
+	// IgnoreRouter is the Traefik router of the wake endpoint, whose requests are not traffic
+	IgnoreRouter string
+	// Lock keeps deploys of a pull request from racing with its sleep and wake up
+	Lock func(key string) (unlock func())
+	// OnActivity is called at most once a minute per pull request receiving requests
+	OnActivity func(key string)
+}
+
+// wakeCall is a wake up in progress, shared by the requests arriving meanwhile
+type wakeCall struct {
+	done chan struct{}
+	err  error
+}
+
+// IdleScaler stops previews without traffic and starts them again on their next request
+type IdleScaler struct {
+	provider providers.Provider
+	sleeper  providers.Sleeper
+	options  IdleOptions
+
+	mu          sync.Mutex
+	lastRequest map[string]time.Time
+	lastTouch   map[string]time.Time
+	waking      map[string]*wakeCall
+}
+
+// NewIdleScaler creates an idle scaler for the previews of provider
+func NewIdleScaler(provider providers.Provider, sleeper providers.Sleeper, options IdleOptions) *IdleScaler {
+	return &IdleScaler{
+		provider:    provider,
+		sleeper:     sleeper,
+		options:     options,
+		lastRequest: make(map[string]time.Time),
+		lastTouch:   make(map[string]time.Time),
+		waking:      make(map[string]*wakeCall),
+	}
+}
+
+// Observe records a request to a preview host
+func (s *IdleScaler) Observe(host string) {
+	ref, found := s.sleeper.DeploymentForHost(host)
+	if !found {
+		return
+	}
+
+	key := JobKey(ref.Repo, ref.PR)
+	now := time.Now()
+
+	s.mu.Lock()
+	s.lastRequest[ref.ID] = now
+	touch := now.Sub(s.lastTouch[key]) >= activityInterval
+	if touch {
+		s.lastTouch[key] = now
+	}
+	s.mu.Unlock()
+
+	if touch && s.options.OnActivity != nil {
+		s.options.OnActivity(key)
+	}
+}
+
+// Wake starts the preview serving host if it sleeps, and waits until it is ready or ctx
+// is done. The wake up goes on in the background when ctx is done first.
+func (s *IdleScaler) Wake(ctx context.Context, host string) (providers.PreviewRef, error) {
+	ref, found := s.sleeper.DeploymentForHost(host)
+	if !found {
+		return ref, ErrUnknownPreview
+	}
+
+	s.Observe(host)
+
+	s.mu.Lock()
+	call, exists := s.waking[ref.ID]
+	if !exists {
+		call = &wakeCall{done: make(chan struct{})}
+		s.waking[ref.ID] = call
+		go s.wake(ref, call)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return ref, call.err
+	case <-ctx.Done():
+		return ref, ctx.Err()
+	}
+}
+
+func (s *IdleScaler) wake(ref providers.PreviewRef, call *wakeCall) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.waking, ref.ID)
+		s.mu.Unlock()
+		close(call.done)
+	}()
+
+	if s.options.Lock != nil {
+		unlock := s.options.Lock(JobKey(ref.Repo, ref.PR))
+		defer unlock()
+	}
+
+	if ref.Phase == providers.PhaseSleeping {
+		previewsWoken.Inc()
+	}
+
+	// Not tied to a request, so a client giving up does not abort the wake up
+	call.err = s.sleeper.Wake(context.Background(), ref.ID)
+	if call.err != nil {
+		log.Printf("❌ Failed to wake up preview %s: %v", ref.ID, call.err)
+	}
+}
+
+// Run checks the previews every interval until ctx is done
+func (s *IdleScaler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.Check(ctx); err != nil {
+			log.Printf("Warning: idle preview check failed: %v", err)
+		}
+	}
+}
+
+// Check stops the ready previews without requests since they started, or since their
+// last request, for longer than the idle period
+func (s *IdleScaler) Check(ctx context.Context) error {
+	deployments, err := s.provider.ListDeployments(ctx, providers.DeploymentFilter{Phase: providers.PhaseReady})
+	if err != nil {
+		return fmt.Errorf("failed to list deployments: %w", err)
+	}
+
+	now := time.Now()
+	for _, status := range deployments {
+		// Untracked previews cannot be woken up
+		if status.StartedAt.IsZero() {
+			continue
+		}
+
+		s.mu.Lock()
+		lastActive := later(status.StartedAt, s.lastRequest[status.ID])
+		s.mu.Unlock()
+
+		if now.Sub(lastActive) < s.options.After {
+			continue
+		}
+
+		err := s.sleep(ctx, status)
+		if errors.Is(err, providers.ErrNotSleepable) {
+			continue
+		}
+		if err != nil {
+			log.Printf("❌ Failed to scale preview %s to zero: %v", status.ID, err)
+			continue
+		}
+		previewsSlept.Inc()
+	}
+
+	return nil
+}
+
+func (s *IdleScaler) sleep(ctx context.Context, status *providers.DeploymentStatus) error {
+	if s.options.Lock != nil {
+		unlock := s.options.Lock(JobKey(status.Repo, status.PR))
+		defer unlock()
+	}
+
+	log.Printf("💤 Preview %s had no requests for %s", status.ID, s.options.After)
+	return s.sleeper.Sleep(ctx, status.ID)
+}
+
+// accessLogEntry holds the fields of a Traefik JSON access log line used to track traffic
+type accessLogEntry struct {
+	RequestHost string `json:"RequestHost"`
+	RouterName  string `json:"RouterName"`
+}
+
+// TailAccessLog follows a Traefik JSON access log until ctx is done, observing the host
+// of every request. It starts at the end of the file and reopens it once rotated.
+func (s *IdleScaler) TailAccessLog(ctx context.Context, path string) {
+	var file *os.File
+	var reader *bufio.Reader
+	var offset int64
+	var partial string
+	fromStart := false
+
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		if file == nil {
+			opened, err := os.Open(path)
+			if err == nil {
+				whence := io.SeekEnd
+				if fromStart {
+					whence = io.SeekStart
+				}
+				offset, err = opened.Seek(0, whence)
+				if err != nil {
+					opened.Close()
+				} else {
+					file, reader = opened, bufio.NewReader(opened)
+					log.Printf("👀 Following Traefik access log %s", path)
+				}
+			}
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("Warning: failed to open access log: %v", err)
+			}
+		}
+
+		if file != nil {
+			offset += s.readAccessLog(reader, &partial)
+
+			// A rotated or truncated log is read again from its start
+			if info, err := os.Stat(path); err != nil || info.Size() < offset || !sameFile(file, info) {
+				file.Close()
+				file, reader, partial, fromStart = nil, nil, "", true
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readAccessLog observes the complete lines available, keeping a partial line in
+// partial for the next read. It returns how many bytes it consumed.
+func (s *IdleScaler) readAccessLog(reader *bufio.Reader, partial *string) int64 {
+	var read int64
+	for {
+		chunk, err := reader.ReadString('\n')
+		read += int64(len(chunk))
+		if err != nil {
+			*partial += chunk
+			return read
+		}
+
+		line := *partial + chunk
+		*partial = ""
+
+		var entry accessLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil || entry.RequestHost == "" {
+			continue
+		}
+		if s.options.IgnoreRouter != "" && strings.HasPrefix(entry.RouterName, s.options.IgnoreRouter) {
+			continue
+		}
+		s.Observe(entry.RequestHost)
+	}
+}
+
+func sameFile(file *os.File, info os.FileInfo) bool {
+	opened, err := file.Stat()
+	return err == nil && os.SameFile(opened, info)
+}
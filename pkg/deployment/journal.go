@@ -0,0 +1,188 @@
+package deployment
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// journalEntry is a persisted job
+type journalEntry struct {
+	ID       string                   `json:"id"`
+	Webhook  *webhook.GithubPRWebhook `json:"webhook"`
+	Priority Priority                 `json:"priority"`
+	Force    bool                     `json:"force,omitempty"`
+	Enqueued time.Time                `json:"enqueued"`
+	Attempts int                      `json:"attempts"`
+	Rollback *Release                 `json:"rollback,omitempty"`
+	Cleanup  bool                     `json:"cleanup,omitempty"`
+}
+
+// Journal persists the jobs of a queue until they complete, so they survive a restart.
+// It holds at most one job per pull request, like the queue.
+type Journal struct {
+	path    string
+	entries map[string]*journalEntry
+	mu      sync.Mutex
+}
+
+// OpenJournal opens the journal file at path, creating it on first write
+func OpenJournal(path string) (*Journal, error) {
+	j := &Journal{path: path, entries: make(map[string]*journalEntry)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return j, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue journal: %w", err)
+	}
+
+	var entries []*journalEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode queue journal: %w", err)
+	}
+	for _, entry := range entries {
+		j.entries[JobKey(entry.Webhook.Repository.Name, entry.Webhook.Number)] = entry
+	}
+
+	return j, nil
+}
+
+// Pending returns the persisted jobs in the order they were enqueued
+func (j *Journal) Pending() []*Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(j.entries))
+	for _, entry := range j.entries {
+		jobs = append(jobs, &Job{
+			ID:       entry.ID,
+			Webhook:  entry.Webhook,
+			Priority: entry.Priority,
+			Force:    entry.Force,
+			Enqueued: entry.Enqueued,
+			Attempts: entry.Attempts,
+			Rollback: entry.Rollback,
+			Cleanup:  entry.Cleanup,
+		})
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Enqueued.Before(jobs[b].Enqueued) })
+	return jobs
+}
+
+// Put persists a job, replacing the job of the same pull request
+func (j *Journal) Put(job *Job) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key := job.Key()
+	previous, existed := j.entries[key]
+	j.entries[key] = &journalEntry{
+		ID:       job.ID,
+		Webhook:  job.Webhook,
+		Priority: job.Priority,
+		Force:    job.Force,
+		Enqueued: job.Enqueued,
+		Attempts: job.Attempts,
+		Rollback: job.Rollback,
+		Cleanup:  job.Cleanup,
+	}
+
+	if err := j.save(); err != nil {
+		// Keep the entries matching the file
+		if existed {
+			j.entries[key] = previous
+		} else {
+			delete(j.entries, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Done removes a completed job, unless a newer job of the pull request replaced it
+func (j *Journal) Done(job *Job) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if entry, exists := j.entries[job.Key()]; !exists || entry.ID != job.ID {
+		return nil
+	}
+	delete(j.entries, job.Key())
+	return j.save()
+}
+
+// Remove drops the job of a pull request, e.g. once it is closed
+func (j *Journal) Remove(key string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, exists := j.entries[key]; !exists {
+		return nil
+	}
+	delete(j.entries, key)
+	return j.save()
+}
+
+// save writes the journal file atomically; callers must hold the lock
+func (j *Journal) save() error {
+	entries := make([]*journalEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Enqueued.Before(entries[b].Enqueued) })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode queue journal: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return fmt.Errorf("failed to create queue journal directory: %w", err)
+	}
+
+	if err := writeFileSync(j.path, data); err != nil {
+		return fmt.Errorf("failed to write queue journal: %w", err)
+	}
+	return nil
+}
+
+// writeFileSync replaces the file at path with data, syncing the data and the rename to
+// disk so the file survives a crash once it returns
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Sync the directory so the rename is durable too
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
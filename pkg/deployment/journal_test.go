@@ -0,0 +1,118 @@
+package deployment
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "queue.json")
+
+	journal, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	deploy := testJob("app", 1, PriorityNormal)
+	deploy.ID, deploy.Enqueued, deploy.Attempts = "deploy", now, 2
+	cleanup := testJob("app", 2, PriorityHigh)
+	cleanup.ID, cleanup.Enqueued, cleanup.Cleanup = "cleanup", now.Add(-time.Minute), true
+	rollback := testJob("api", 1, PriorityHigh)
+	rollback.ID, rollback.Enqueued, rollback.Force = "rollback", now.Add(time.Minute), true
+	rollback.Rollback = &Release{SHA: "abc123", Image: "pr-api-1:abc123", Port: "3000"}
+
+	for _, job := range []*Job{deploy, cleanup, rollback} {
+		if err := journal.Put(job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A newer job of a pull request replaces its entry
+	replaced := testJob("app", 1, PriorityNormal)
+	replaced.ID, replaced.Enqueued = "replaced", now
+	if err := journal.Put(replaced); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending := reopened.Pending()
+	wantIDs := []string{"cleanup", "replaced", "rollback"}
+	if len(pending) != len(wantIDs) {
+		t.Fatalf("%d jobs pending, want %d", len(pending), len(wantIDs))
+	}
+	for i, job := range pending {
+		if job.ID != wantIDs[i] {
+			t.Errorf("job %d is %s, want %s", i, job.ID, wantIDs[i])
+		}
+	}
+
+	if !pending[0].Cleanup || pending[0].Priority != PriorityHigh || pending[0].Key() != "app#2" {
+		t.Errorf("cleanup job not restored: %+v", pending[0])
+	}
+	if pending[1].Attempts != 0 || !pending[1].Enqueued.Equal(now) {
+		t.Errorf("replaced job not restored: %+v", pending[1])
+	}
+	if !pending[2].Force || pending[2].Rollback == nil || pending[2].Rollback.SHA != "abc123" || pending[2].Rollback.Port != "3000" {
+		t.Errorf("rollback job not restored: %+v", pending[2])
+	}
+
+	// Done ignores a job replaced since, and removes the current one
+	if err := reopened.Done(deploy); err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.Pending()) != 3 {
+		t.Errorf("Done removed a job replaced since")
+	}
+	if err := reopened.Done(pending[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	final, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(final.Pending()) != 2 {
+		t.Errorf("%d jobs pending after Done, want 2", len(final.Pending()))
+	}
+
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestJournalPutFailureKeepsEntries(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := OpenJournal(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := testJob("app", 1, PriorityNormal)
+	first.ID = "first"
+	if err := journal.Put(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The journal cannot be replaced while its path is a directory
+	if err := os.Mkdir(filepath.Join(dir, "queue.json.tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	second := testJob("app", 1, PriorityNormal)
+	second.ID = "second"
+	if err := journal.Put(second); err == nil {
+		t.Fatal("Put succeeded without writing the journal")
+	}
+
+	pending := journal.Pending()
+	if len(pending) != 1 || pending[0].ID != "first" {
+		t.Errorf("pending jobs after a failed Put: %+v, want the first job only", pending)
+	}
+}
@@ -0,0 +1,550 @@
+package deployment
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/metrics"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+var (
+	queueDepth   = metrics.NewGauge("flying_cup_queue_depth", "Deploy jobs waiting for a worker")
+	queueRunning = metrics.NewGauge("flying_cup_queue_running", "Deploy jobs being run by a worker")
+	queueWait    = metrics.NewCounter("flying_cup_queue_wait_seconds_total", "Total time deploy jobs spent waiting for a worker")
+	queueJobs    = metrics.NewCounter("flying_cup_queue_jobs_total", "Deploy jobs started")
+	queueRetries = metrics.NewCounter("flying_cup_queue_retries_total", "Deploy jobs retried after a transient failure")
+)
+
+var (
+	// ErrSuperseded cancels a deploy when a newer event arrives for the same pull request
+	ErrSuperseded = errors.New("deployment superseded by a newer event")
+	// ErrAborted cancels a deploy when its pull request is closed
+	ErrAborted = errors.New("deployment aborted")
+	// ErrShutdown cancels the deploys still running when the drain deadline of a shutdown passes
+	ErrShutdown = errors.New("controller shutting down")
+)
+
+// shutdownGrace bounds how long cancelled deploys may take to stop on shutdown
+const shutdownGrace = 30 * time.Second
+
+// Priority orders queued jobs, higher first
+type Priority int
+
+const (
+	PriorityNormal Priority = 0
+	// PriorityHigh jumps the queue, e.g. for manual redeploys
+	PriorityHigh Priority = 10
+)
+
+// Job is a queued deploy of a pull request
+type Job struct {
+	// ID tells the jobs of a pull request apart, generated when empty
+	ID       string
+	Webhook  *webhook.GithubPRWebhook
+	Priority Priority
+	// Force deploys even if the commit is already deployed, e.g. for manual redeploys
+	Force    bool
+	Enqueued time.Time
+	// Attempts counts the previous attempts that failed on a transient error
+	Attempts int
+	// Rollback runs an earlier release instead of building the head commit
+	Rollback *Release
+	// Cleanup tears the preview down instead of deploying it, once the pull request is closed
+	Cleanup bool
+
+	seq       uint64
+	notBefore time.Time
+	retry     RetryPolicy
+}
+
+// Key identifies the pull request a job deploys
+func (j *Job) Key() string {
+	return JobKey(j.Webhook.Repository.Name, j.Webhook.Number)
+}
+
+// WillRetry reports whether the queue retries the job after it failed with err
+func (j *Job) WillRetry(err error) bool {
+	return IsTransient(err) && j.Attempts+1 < j.retry.MaxAttempts
+}
+
+// JobKey identifies the jobs of a pull request
+func JobKey(repoName string, prNumber int) string {
+	return fmt.Sprintf("%s#%d", repoName, prNumber)
+}
+
+// Queue runs deploy jobs on a bounded pool of workers, by priority then arrival.
+// Jobs of the same pull request never run at the same time: a newer job replaces
+// the waiting one and cancels the running one.
+type Queue struct {
+	workers int
+	retry   RetryPolicy
+	journal *Journal
+	run     func(ctx context.Context, job *Job) error
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting jobHeap
+	running int
+	seq     uint64
+	closed  bool
+	// active holds the pull requests being deployed or cleaned up
+	active map[string]*activeJob
+	// last holds the latest job of each open pull request, for redeploys
+	last map[string]*Job
+}
+
+// QueueOptions configures a queue
+type QueueOptions struct {
+	Workers int
+	Retry   RetryPolicy
+	// Journal persists the jobs until they complete, optional
+	Journal *Journal
+}
+
+// NewQueue creates a queue running jobs with run. Jobs failing with a transient
+// error are retried according to the retry policy.
+func NewQueue(options QueueOptions, run func(ctx context.Context, job *Job) error) *Queue {
+	workers := max(options.Workers, 1)
+	retry := options.Retry
+	if retry.MaxAttempts < 1 {
+		retry.MaxAttempts = 1
+	}
+
+	q := &Queue{
+		workers: workers,
+		retry:   retry,
+		journal: options.Journal,
+		run:     run,
+		last:    make(map[string]*Job),
+		active:  make(map[string]*activeJob),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Start resumes the jobs of the journal and launches the workers, which stop once ctx is done
+func (q *Queue) Start(ctx context.Context) {
+	if q.journal != nil {
+		pending := q.journal.Pending()
+		q.mu.Lock()
+		for _, job := range pending {
+			q.pushLocked(job)
+		}
+		q.mu.Unlock()
+
+		if len(pending) > 0 {
+			log.Printf("Resuming %d deploy jobs from the journal", len(pending))
+		}
+	}
+
+	for i := 0; i < q.workers; i++ {
+		go q.work(ctx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		q.mu.Lock()
+		q.closed = true
+		q.mu.Unlock()
+		q.cond.Broadcast()
+	}()
+
+	log.Printf("Deploy queue started with %d workers", q.workers)
+}
+
+// activeJob is a running deploy, or a cleanup holding the lock of a pull request
+type activeJob struct {
+	cancel context.CancelCauseFunc
+}
+
+// Shutdown stops starting jobs and waits for the running ones, and for the cleanups
+// holding a lock, until ctx is done, then cancels the jobs. Unfinished jobs stay in
+// the journal and resume on the next start.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+
+	done := make(chan struct{})
+	go func() {
+		q.mu.Lock()
+		for len(q.active) > 0 {
+			q.cond.Wait()
+		}
+		q.mu.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	for key, active := range q.active {
+		log.Printf("Interrupting deploy of %s", key)
+		active.cancel(ErrShutdown)
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(shutdownGrace):
+		log.Printf("Warning: deploys did not stop within %s", shutdownGrace)
+	}
+	return fmt.Errorf("deploy jobs interrupted: %w", ctx.Err())
+}
+
+// Enqueue persists a job in the journal and adds it to the queue. It returns the
+// position of the job among the waiting jobs, or 0 if a worker is free to start it
+// right away. A waiting job of the same pull request is replaced and a running one
+// is cancelled. Once the queue is shutting down, jobs are only persisted, to start
+// on the next start.
+func (q *Queue) Enqueue(job *Job) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed && q.journal == nil {
+		return 0, ErrShutdown
+	}
+
+	key := job.Key()
+	q.seq++
+	job.seq = q.seq
+	if job.ID == "" {
+		job.ID = fmt.Sprintf("%d-%d", time.Now().UnixNano(), q.seq)
+	}
+	if job.Enqueued.IsZero() {
+		job.Enqueued = time.Now()
+	}
+
+	superseded := q.waitingLocked(key)
+	if superseded != nil {
+		// Keep the place in the queue of the replaced job
+		job.seq = superseded.seq
+		if superseded.Priority > job.Priority {
+			job.Priority = superseded.Priority
+		}
+		if superseded.Enqueued.Before(job.Enqueued) {
+			job.Enqueued = superseded.Enqueued
+		}
+	}
+
+	// The replaced job stays queued if the new one cannot be persisted
+	if q.journal != nil {
+		if err := q.journal.Put(job); err != nil {
+			return 0, fmt.Errorf("failed to persist deploy job: %w", err)
+		}
+	}
+
+	if superseded != nil {
+		log.Printf("Deploy job for %s superseded before it started", key)
+		q.removeWaitingLocked(key)
+	}
+
+	if active, running := q.active[key]; running {
+		log.Printf("Cancelling in-flight deploy of %s", key)
+		active.cancel(ErrSuperseded)
+	}
+
+	if q.closed {
+		log.Printf("Deploy job for %s persisted, it starts on the next start", key)
+		q.trackLocked(job)
+		return 0, nil
+	}
+
+	q.pushLocked(job)
+
+	position := q.positionLocked(job)
+	if _, running := q.active[key]; running && position == 0 {
+		// Waits for the cancelled deploy to stop
+		position = 1
+	}
+	return position, nil
+}
+
+// pushLocked adds a job to the waiting jobs and wakes the workers
+func (q *Queue) pushLocked(job *Job) {
+	if job.seq == 0 {
+		q.seq++
+		job.seq = q.seq
+	}
+	job.retry = q.retry
+
+	heap.Push(&q.waiting, job)
+	q.trackLocked(job)
+	queueDepth.Set(float64(len(q.waiting)))
+	q.cond.Broadcast()
+}
+
+// trackLocked records the latest job of a pull request, which redeploys start from.
+// A closed pull request can no longer be redeployed.
+func (q *Queue) trackLocked(job *Job) {
+	if job.Cleanup {
+		delete(q.last, job.Key())
+		return
+	}
+	q.last[job.Key()] = job
+}
+
+// Lock waits until no job of the pull request runs and keeps new ones from starting
+// until the returned function is called
+func (q *Queue) Lock(key string) (unlock func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.lockLocked(key)
+}
+
+// TryLock locks a pull request like Lock, unless a job of it runs or it is already locked
+func (q *Queue) TryLock(key string) (unlock func(), ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.active[key] != nil {
+		return nil, false
+	}
+	return q.lockLocked(key), true
+}
+
+func (q *Queue) lockLocked(key string) (unlock func()) {
+	for q.active[key] != nil {
+		q.cond.Wait()
+	}
+	q.active[key] = &activeJob{cancel: func(error) {}}
+
+	return func() {
+		q.mu.Lock()
+		delete(q.active, key)
+		q.mu.Unlock()
+		q.cond.Broadcast()
+	}
+}
+
+// Position returns the position of the waiting job of a pull request, or 0 if none waits
+func (q *Queue) Position(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range q.waiting {
+		if job.Key() == key {
+			return q.positionLocked(job)
+		}
+	}
+	return 0
+}
+
+// waitingLocked returns the waiting job of a pull request, if any
+func (q *Queue) waitingLocked(key string) *Job {
+	for _, job := range q.waiting {
+		if job.Key() == key {
+			return job
+		}
+	}
+	return nil
+}
+
+// removeWaitingLocked removes and returns the waiting job of a pull request, if any
+func (q *Queue) removeWaitingLocked(key string) *Job {
+	for i, job := range q.waiting {
+		if job.Key() == key {
+			heap.Remove(&q.waiting, i)
+			return job
+		}
+	}
+	return nil
+}
+
+// nextLocked removes and returns the first waiting job whose pull request is not
+// active and whose retry delay is over
+func (q *Queue) nextLocked() *Job {
+	var next *Job
+	index := -1
+	now := time.Now()
+	for i, job := range q.waiting {
+		if q.active[job.Key()] != nil || job.notBefore.After(now) {
+			continue
+		}
+		if next == nil || q.waiting.before(job, next) {
+			next, index = job, i
+		}
+	}
+	if next != nil {
+		heap.Remove(&q.waiting, index)
+	}
+	return next
+}
+
+// Last returns the latest job enqueued for a pull request, or nil
+func (q *Queue) Last(key string) *Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.last[key]
+}
+
+// Forget drops the latest job of a closed pull request
+func (q *Queue) Forget(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.last, key)
+}
+
+// Len returns the number of waiting jobs
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.waiting)
+}
+
+// positionLocked counts the jobs that will start before job, minus the free workers
+func (q *Queue) positionLocked(job *Job) int {
+	ahead := 0
+	for _, other := range q.waiting {
+		if other != job && q.waiting.before(other, job) {
+			ahead++
+		}
+	}
+
+	position := ahead + 1 - (q.workers - q.running)
+	if position < 0 {
+		return 0
+	}
+	return position
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		q.mu.Lock()
+		var job *Job
+		for !q.closed {
+			if job = q.nextLocked(); job != nil {
+				break
+			}
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+
+		jobCtx, cancel := context.WithCancelCause(ctx)
+		q.active[job.Key()] = &activeJob{cancel: cancel}
+		q.running++
+		queueDepth.Set(float64(len(q.waiting)))
+		queueRunning.Set(float64(q.running))
+		q.mu.Unlock()
+
+		queueJobs.Inc()
+		queueWait.Add(time.Since(job.Enqueued).Seconds())
+		err := q.runJob(jobCtx, job)
+		cause := context.Cause(jobCtx)
+		cancel(nil)
+
+		q.mu.Lock()
+		delete(q.active, job.Key())
+		q.running--
+		queueRunning.Set(float64(q.running))
+		q.finishLocked(job, err, cause)
+		q.mu.Unlock()
+		q.cond.Broadcast()
+	}
+}
+
+func (q *Queue) runJob(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("❌ Deploy job panic for %s: %v", job.Key(), r)
+			err = fmt.Errorf("deploy job panic: %v", r)
+		}
+	}()
+
+	return q.run(ctx, job)
+}
+
+// finishLocked schedules the retry of a job that failed on a transient error or waits
+// for capacity, or removes it from the journal. Jobs interrupted by a shutdown stay in the journal.
+// cause tells why the job was cancelled, if it was.
+func (q *Queue) finishLocked(job *Job, err error, cause error) {
+	key := job.Key()
+
+	if cause != nil && !errors.Is(cause, ErrSuperseded) && !errors.Is(cause, ErrAborted) {
+		log.Printf("Deploy job for %s interrupted, it resumes on the next start", key)
+		if q.journal != nil {
+			if err := q.journal.Put(job); err != nil {
+				log.Printf("Warning: failed to checkpoint %s: %v", key, err)
+			}
+		}
+		return
+	}
+
+	// Jobs waiting for capacity are not failing, they do not use up their attempts
+	if errors.Is(err, ErrNoCapacity) && cause == nil && q.last[key] == job {
+		job.notBefore = time.Now().Add(capacityRetry)
+		q.pushLocked(job)
+		time.AfterFunc(capacityRetry, q.cond.Broadcast)
+		return
+	}
+
+	if err != nil && cause == nil && job.WillRetry(err) && q.last[key] == job {
+		job.Attempts++
+		delay := q.retry.Delay(job.Attempts)
+		job.notBefore = time.Now().Add(delay)
+
+		if q.journal != nil {
+			if err := q.journal.Put(job); err != nil {
+				log.Printf("Warning: failed to persist the retry of %s: %v", key, err)
+			}
+		}
+
+		log.Printf("🔁 Retrying deploy of %s in %s (attempt %d of %d): %v", key, delay, job.Attempts+1, q.retry.MaxAttempts, err)
+		queueRetries.Inc()
+		q.pushLocked(job)
+		time.AfterFunc(delay, q.cond.Broadcast)
+		return
+	}
+
+	if q.journal != nil {
+		if err := q.journal.Done(job); err != nil {
+			log.Printf("Warning: failed to remove %s from the queue journal: %v", key, err)
+		}
+	}
+}
+
+// Cancelled reports whether a deploy was cancelled by the queue, rather than having failed
+func Cancelled(ctx context.Context) bool {
+	cause := context.Cause(ctx)
+	return errors.Is(cause, ErrSuperseded) || errors.Is(cause, ErrAborted) || errors.Is(cause, ErrShutdown)
+}
+
+// jobHeap orders jobs by priority, then by arrival
+type jobHeap []*Job
+
+func (h jobHeap) before(a, b *Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.seq < b.seq
+}
+
+func (h jobHeap) Len() int           { return len(h) }
+func (h jobHeap) Less(i, j int) bool { return h.before(h[i], h[j]) }
+func (h jobHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *jobHeap) Push(x any)        { *h = append(*h, x.(*Job)) }
+
+func (h *jobHeap) Pop() any {
+	old := *h
+	job := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return job
+}
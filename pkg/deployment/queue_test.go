@@ -0,0 +1,210 @@
+package deployment
+
+import (
+	"container/heap"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+func TestJobHeapOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []*Job
+		want []int
+	}{
+		{
+			name: "arrival order at the same priority",
+			jobs: []*Job{
+				{Priority: PriorityNormal, seq: 3},
+				{Priority: PriorityNormal, seq: 1},
+				{Priority: PriorityNormal, seq: 2},
+			},
+			want: []int{1, 2, 3},
+		},
+		{
+			name: "higher priority first",
+			jobs: []*Job{
+				{Priority: PriorityNormal, seq: 1},
+				{Priority: PriorityHigh, seq: 3},
+				{Priority: PriorityNormal, seq: 2},
+				{Priority: PriorityHigh, seq: 4},
+			},
+			want: []int{3, 4, 1, 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h jobHeap
+			for _, job := range tt.jobs {
+				heap.Push(&h, job)
+			}
+
+			var got []int
+			for h.Len() > 0 {
+				got = append(got, int(heap.Pop(&h).(*Job).seq))
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("popped %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("popped %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// testJob returns a job deploying pull request number of repo
+func testJob(repo string, number int, priority Priority) *Job {
+	hook := &webhook.GithubPRWebhook{Number: number}
+	hook.Repository.Name = repo
+	return &Job{Webhook: hook, Priority: priority}
+}
+
+func TestEnqueueSupersedes(t *testing.T) {
+	tests := []struct {
+		name string
+		// first and second are enqueued for the same pull request, other for another one in between
+		first, second *Job
+		wantPriority  Priority
+		wantLast      bool
+	}{
+		{
+			name:         "newer deploy replaces the waiting one",
+			first:        testJob("app", 1, PriorityNormal),
+			second:       testJob("app", 1, PriorityNormal),
+			wantPriority: PriorityNormal,
+			wantLast:     true,
+		},
+		{
+			name:         "replacement keeps the higher priority",
+			first:        testJob("app", 1, PriorityHigh),
+			second:       testJob("app", 1, PriorityNormal),
+			wantPriority: PriorityHigh,
+			wantLast:     true,
+		},
+		{
+			name:         "cleanup replaces the waiting deploy",
+			first:        testJob("app", 1, PriorityNormal),
+			second:       &Job{Webhook: testJob("app", 1, PriorityHigh).Webhook, Priority: PriorityHigh, Cleanup: true},
+			wantPriority: PriorityHigh,
+			wantLast:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No worker is started, so the jobs stay waiting
+			q := NewQueue(QueueOptions{Workers: 1}, nil)
+
+			if _, err := q.Enqueue(tt.first); err != nil {
+				t.Fatal(err)
+			}
+			other := testJob("app", 2, PriorityNormal)
+			if _, err := q.Enqueue(other); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := q.Enqueue(tt.second); err != nil {
+				t.Fatal(err)
+			}
+
+			if q.Len() != 2 {
+				t.Fatalf("%d jobs waiting, want 2", q.Len())
+			}
+
+			key := tt.second.Key()
+			waiting := q.waitingLocked(key)
+			if waiting != tt.second {
+				t.Fatalf("waiting job of %s is %+v, want the newer one", key, waiting)
+			}
+			if waiting.Priority != tt.wantPriority {
+				t.Errorf("priority %d, want %d", waiting.Priority, tt.wantPriority)
+			}
+			if !q.waiting.before(waiting, other) {
+				t.Errorf("replacement lost the place of the replaced job in the queue")
+			}
+			if got := q.Last(key) != nil; got != tt.wantLast {
+				t.Errorf("last job tracked: %t, want %t", got, tt.wantLast)
+			}
+		})
+	}
+}
+
+func TestEnqueueCancelsRunningJob(t *testing.T) {
+	q := NewQueue(QueueOptions{Workers: 1}, nil)
+
+	job := testJob("app", 1, PriorityNormal)
+	var cause error
+	q.active[job.Key()] = &activeJob{cancel: func(err error) { cause = err }}
+
+	position, err := q.Enqueue(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(cause, ErrSuperseded) {
+		t.Errorf("running job cancelled with %v, want %v", cause, ErrSuperseded)
+	}
+	if position != 1 {
+		t.Errorf("position %d, want 1 while the cancelled job stops", position)
+	}
+}
+
+func TestEnqueueWhileClosed(t *testing.T) {
+	q := NewQueue(QueueOptions{Workers: 1}, nil)
+	q.closed = true
+
+	if _, err := q.Enqueue(testJob("app", 1, PriorityNormal)); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("enqueue without a journal returned %v, want %v", err, ErrShutdown)
+	}
+
+	journal, err := OpenJournal(filepath.Join(t.TempDir(), "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q = NewQueue(QueueOptions{Workers: 1, Journal: journal}, nil)
+	q.closed = true
+
+	if _, err := q.Enqueue(testJob("app", 1, PriorityNormal)); err != nil {
+		t.Fatalf("enqueue with a journal returned %v", err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("%d jobs waiting, want none until the next start", q.Len())
+	}
+	if pending := journal.Pending(); len(pending) != 1 {
+		t.Errorf("%d jobs persisted, want 1", len(pending))
+	}
+}
+
+func TestEnqueuePersistFailureKeepsWaitingJob(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := OpenJournal(filepath.Join(dir, "queue.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := NewQueue(QueueOptions{Workers: 1, Journal: journal}, nil)
+
+	first := testJob("app", 1, PriorityNormal)
+	if _, err := q.Enqueue(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// The journal cannot be replaced while its temporary path is a directory
+	if err := os.Mkdir(filepath.Join(dir, "queue.json.tmp"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.Enqueue(testJob("app", 1, PriorityNormal)); err == nil {
+		t.Fatal("Enqueue succeeded without persisting the job")
+	}
+	if waiting := q.waitingLocked(first.Key()); waiting != first {
+		t.Errorf("waiting job is %+v, want the one that was persisted", waiting)
+	}
+}
@@ -0,0 +1,57 @@
+package deployment
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/git"
+)
+
+// maxBackoff caps the delay between two attempts of a job
+const maxBackoff = 10 * time.Minute
+
+// RetryPolicy retries jobs that failed on a transient error with exponential backoff
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, so 1 disables retries
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled for each following one
+	Backoff time.Duration
+}
+
+// Delay returns how long to wait before the given retry, starting at 1
+func (p RetryPolicy) Delay(retry int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < retry && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
+
+// IsTransient reports whether err may not happen again on a retry, e.g. a clone
+// network error or an unreachable Docker daemon. Build failures, timeouts of the
+// preview itself and cancellations are final.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var buildErr *docker.BuildError
+	if errors.As(err, &buildErr) {
+		return false
+	}
+
+	if errors.Is(err, git.ErrNetwork) || client.IsErrConnectionFailed(err) {
+		return true
+	}
+	if errdefs.IsUnavailable(err) || errdefs.IsDeadline(err) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
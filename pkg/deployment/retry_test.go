@@ -0,0 +1,66 @@
+package deployment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/git"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		backoff time.Duration
+		retry   int
+		want    time.Duration
+	}{
+		{"first retry", 30 * time.Second, 1, 30 * time.Second},
+		{"doubled", 30 * time.Second, 2, time.Minute},
+		{"doubled twice", 30 * time.Second, 3, 2 * time.Minute},
+		{"capped", 30 * time.Second, 10, maxBackoff},
+		{"backoff above the cap", time.Hour, 1, maxBackoff},
+		{"no backoff", 0, 3, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := RetryPolicy{MaxAttempts: 3, Backoff: tt.backoff}
+			if got := policy.Delay(tt.retry); got != tt.want {
+				t.Errorf("Delay(%d) = %s, want %s", tt.retry, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"cancelled", fmt.Errorf("deploy: %w", context.Canceled), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"build failure", &docker.BuildError{Cause: docker.BuildCauseFailed, Err: errors.New("exit code 1")}, false},
+		{"build timeout", &docker.BuildError{Cause: docker.BuildCauseTimeout, Err: context.DeadlineExceeded}, false},
+		{"clone network error", fmt.Errorf("failed to clone repository: %w", git.ErrNetwork), true},
+		{"docker unavailable", errdefs.Unavailable(errors.New("daemon restarting")), true},
+		{"network timeout", fmt.Errorf("failed to pull: %w", &net.DNSError{Err: "timeout", IsTimeout: true}), true},
+		{"network error without timeout", &net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{"other error", errors.New("invalid manifest"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsTransient(tt.err); got != tt.want {
+				t.Errorf("IsTransient(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -8,19 +8,58 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
 	sharedTypes "github.com/karindrlainux/flying-cup/pkg/types"
 )
 
+// Builder builds preview images from an app's source tree
+type Builder interface {
+	// BuildImage builds the app and returns the image tag, available to the Docker daemon
+	BuildImage(ctx context.Context, app *sharedTypes.App, dockerfile string, nonCache bool) (string, error)
+
+	// RemoveImage removes a previously built image
+	RemoveImage(ctx context.Context, imageTag string) error
+}
+
+// ManagedLabel marks the images built by the controller, so they can be garbage collected
+const ManagedLabel = "com.flying-cup.managed"
+
+// Builder backends
+const (
+	BackendDocker   = "docker"
+	BackendBuildKit = "buildkit"
+)
+
+// NewBuilder creates a builder for the given backend. The Docker client is used to
+// build with the Docker Engine, or to load images built by a standalone buildkitd.
+func NewBuilder(backend, buildkitHost string, limits BuildLimits, cli *client.Client) (Builder, error) {
+	switch backend {
+	case "", BackendDocker:
+		return &DockerBuilder{Client: cli, Limits: limits}, nil
+	case BackendBuildKit:
+		if buildkitHost == "" {
+			return nil, fmt.Errorf("BUILDKIT_HOST is required for the buildkit builder")
+		}
+		return &BuildKitBuilder{Address: buildkitHost, Client: cli, Limits: limits}, nil
+	default:
+		return nil, fmt.Errorf("unsupported builder backend: %s", backend)
+	}
+}
+
+// DockerBuilder builds images with the Docker Engine API
 type DockerBuilder struct {
 	Client *client.Client
+	Limits BuildLimits
 }
 
-// createTarArchive creates a tar.gz archive from the given directory
-func (d *DockerBuilder) createTarArchive(sourceDir string) (io.ReadCloser, error) {
+// createTarArchive creates a tar.gz archive from the given directory, adding extraFiles at the archive root
+func (d *DockerBuilder) createTarArchive(sourceDir string, extraFiles map[string][]byte) (io.ReadCloser, error) {
 	pr, pw := io.Pipe()
 
 	go func() {
@@ -81,28 +120,69 @@ func (d *DockerBuilder) createTarArchive(sourceDir string) (io.ReadCloser, error
 
 		if err != nil {
 			pw.CloseWithError(err)
+			return
+		}
+
+		for name, content := range extraFiles {
+			header := &tar.Header{
+				Name:    name,
+				Mode:    0644,
+				Size:    int64(len(content)),
+				ModTime: time.Now(),
+			}
+
+			if err := tw.WriteHeader(header); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+
+			if _, err := tw.Write(content); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
 		}
 	}()
 
 	return pr, nil
 }
 
+// BuildImage builds the app with the Docker Engine builder
 func (d *DockerBuilder) BuildImage(ctx context.Context, app *sharedTypes.App, dockerfile string, nonCache bool) (string, error) {
 
 	imageTag := fmt.Sprintf("%s:latest", app.Name)
 
+	dockerfile, extraFiles, err := resolveDockerfile(app, dockerfile)
+	if err != nil {
+		return "", err
+	}
+
 	fmt.Printf("Building image %s with dockerfile %s\n", imageTag, dockerfile)
 
+	ctx, cancel := withBuildTimeout(ctx, d.Limits)
+	defer cancel()
+
 	// Build options
 	buildOptions := types.ImageBuildOptions{
-		Dockerfile: dockerfile,
-		Tags:       []string{imageTag},
-		NoCache:    nonCache,
-		Remove:     true,
+		Dockerfile:  dockerfile,
+		Tags:        []string{imageTag},
+		NoCache:     nonCache,
+		Remove:      true,
+		ForceRemove: true,
+		Labels:      map[string]string{ManagedLabel: "true"},
+	}
+
+	if d.Limits.Memory > 0 {
+		buildOptions.Memory = d.Limits.Memory
+		buildOptions.MemorySwap = d.Limits.Memory
+	}
+
+	if d.Limits.CPUs > 0 {
+		buildOptions.CPUPeriod = 100000
+		buildOptions.CPUQuota = int64(d.Limits.CPUs * 100000)
 	}
 
 	// Create tar archive from the cloned repository
-	buildContext, err := d.createTarArchive(app.SourcePath)
+	buildContext, err := d.createTarArchive(app.SourcePath, extraFiles)
 	if err != nil {
 		return "", fmt.Errorf("failed to create build context: %w", err)
 	}
@@ -111,19 +191,48 @@ func (d *DockerBuilder) BuildImage(ctx context.Context, app *sharedTypes.App, do
 	// Build the image using Docker API
 	buildResponse, err := d.Client.ImageBuild(ctx, buildContext, buildOptions)
 	if err != nil {
-		return "", fmt.Errorf("failed to build docker image: %w", err)
+		return "", newBuildError(ctx, d.Limits, err)
 	}
 	defer buildResponse.Body.Close()
 
-	// Stream the build output
-	_, err = io.Copy(os.Stdout, buildResponse.Body)
+	// Stream the build output, failing on the first build step error
+	err = jsonmessage.DisplayJSONMessagesStream(buildResponse.Body, os.Stdout, 0, false, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to stream build output: %w", err)
+		return "", newBuildError(ctx, d.Limits, err)
 	}
 
 	return imageTag, nil
 }
 
+// resolveDockerfile picks the Dockerfile to build with. When the repository has none, or the
+// manifest forces a detector, a Dockerfile is generated and returned as an extra context file.
+func resolveDockerfile(app *sharedTypes.App, dockerfile string) (string, map[string][]byte, error) {
+	build := &manifest.BuildConfig{}
+	if app.Manifest != nil {
+		build = &app.Manifest.Build
+	}
+
+	if build.Dockerfile != "" {
+		dockerfile = build.Dockerfile
+	}
+
+	if build.Detector == "" {
+		if _, err := os.Stat(filepath.Join(app.SourcePath, dockerfile)); err == nil {
+			return dockerfile, nil, nil
+		}
+	}
+
+	detector, generated, err := GenerateDockerfile(app.SourcePath, build.Detector, build, app.ContainerPort)
+	if err != nil {
+		return "", nil, err
+	}
+
+	fmt.Printf("No Dockerfile used, generated one with %s detector:\n%s\n", detector, generated)
+
+	return GeneratedDockerfile, map[string][]byte{GeneratedDockerfile: []byte(generated)}, nil
+}
+
+// RemoveImage removes an image from the Docker daemon
 func (d *DockerBuilder) RemoveImage(ctx context.Context, imageTag string) error {
 
 	_, err := d.Client.ImageRemove(ctx, imageTag, image.RemoveOptions{Force: true})
@@ -0,0 +1,165 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	sharedTypes "github.com/karindrlainux/flying-cup/pkg/types"
+	bkclient "github.com/moby/buildkit/client"
+	"github.com/tonistiigi/fsutil"
+	"golang.org/x/sync/errgroup"
+)
+
+// BuildKitBuilder builds images on a standalone buildkitd, which can run on a separate
+// host or rootless. The result is exported as a Docker image and loaded into the daemon.
+type BuildKitBuilder struct {
+	// Address of buildkitd, e.g. tcp://buildkitd:1234 or unix:///run/buildkit/buildkitd.sock
+	Address string
+	Client  *client.Client
+	// Limits.Timeout is enforced per build; memory and CPU limits are configured on buildkitd itself
+	Limits BuildLimits
+}
+
+// BuildImage builds the app with buildkitd and loads the image into the Docker daemon
+func (b *BuildKitBuilder) BuildImage(ctx context.Context, app *sharedTypes.App, dockerfile string, nonCache bool) (string, error) {
+	imageTag := fmt.Sprintf("%s:latest", app.Name)
+
+	dockerfile, extraFiles, err := resolveDockerfile(app, dockerfile)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Printf("Building image %s with dockerfile %s on buildkitd %s\n", imageTag, dockerfile, b.Address)
+
+	contextFS, err := fsutil.NewFS(app.SourcePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open build context: %w", err)
+	}
+
+	// A generated Dockerfile is not part of the source tree, so it gets its own local mount
+	dockerfileDir := filepath.Join(app.SourcePath, filepath.Dir(dockerfile))
+	if content, ok := extraFiles[dockerfile]; ok {
+		dockerfileDir, err = os.MkdirTemp("", "flying-cup-dockerfile-")
+		if err != nil {
+			return "", fmt.Errorf("failed to create dockerfile directory: %w", err)
+		}
+		defer os.RemoveAll(dockerfileDir)
+
+		if err := os.WriteFile(filepath.Join(dockerfileDir, dockerfile), content, 0644); err != nil {
+			return "", fmt.Errorf("failed to write generated dockerfile: %w", err)
+		}
+	}
+
+	dockerfileFS, err := fsutil.NewFS(dockerfileDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to open dockerfile directory: %w", err)
+	}
+
+	frontendAttrs := map[string]string{
+		"filename":              filepath.Base(dockerfile),
+		"label:" + ManagedLabel: "true",
+	}
+	if nonCache {
+		frontendAttrs["no-cache"] = ""
+	}
+
+	ctx, cancel := withBuildTimeout(ctx, b.Limits)
+	defer cancel()
+
+	bk, err := bkclient.New(ctx, b.Address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to buildkitd: %w", err)
+	}
+	defer bk.Close()
+
+	// The docker exporter streams an image tarball, which is piped straight into ImageLoad
+	pr, pw := io.Pipe()
+
+	solveOpt := bkclient.SolveOpt{
+		Frontend:      "dockerfile.v0",
+		FrontendAttrs: frontendAttrs,
+		LocalMounts: map[string]fsutil.FS{
+			"context":    contextFS,
+			"dockerfile": dockerfileFS,
+		},
+		Exports: []bkclient.ExportEntry{{
+			Type:  bkclient.ExporterDocker,
+			Attrs: map[string]string{"name": imageTag},
+			Output: func(map[string]string) (io.WriteCloser, error) {
+				return pw, nil
+			},
+		}},
+	}
+
+	statusCh := make(chan *bkclient.SolveStatus)
+	eg, egCtx := errgroup.WithContext(ctx)
+
+	eg.Go(func() error {
+		_, err := bk.Solve(egCtx, nil, solveOpt, statusCh)
+		if err != nil {
+			pw.CloseWithError(err)
+			return newBuildError(ctx, b.Limits, err)
+		}
+		return pw.Close()
+	})
+
+	eg.Go(func() error {
+		printBuildKitStatus(statusCh)
+		return nil
+	})
+
+	eg.Go(func() error {
+		resp, err := b.Client.ImageLoad(egCtx, pr, client.ImageLoadWithQuiet(true))
+		if err != nil {
+			pr.CloseWithError(err)
+			return fmt.Errorf("failed to load image into docker: %w", err)
+		}
+		defer resp.Body.Close()
+
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	})
+
+	if err := eg.Wait(); err != nil {
+		return "", err
+	}
+
+	return imageTag, nil
+}
+
+// RemoveImage removes an image from the Docker daemon
+func (b *BuildKitBuilder) RemoveImage(ctx context.Context, imageTag string) error {
+	_, err := b.Client.ImageRemove(ctx, imageTag, image.RemoveOptions{Force: true})
+
+	if err != nil {
+		return fmt.Errorf("failed to remove Docker image: %w", err)
+	}
+
+	return nil
+}
+
+// printBuildKitStatus streams step names and logs to stdout, like the Docker build output
+func printBuildKitStatus(statusCh chan *bkclient.SolveStatus) {
+	printed := make(map[string]bool)
+
+	for status := range statusCh {
+		for _, v := range status.Vertexes {
+			key := v.Digest.String()
+			if v.Started != nil && !printed[key] {
+				printed[key] = true
+				fmt.Printf("%s\n", v.Name)
+			}
+			if v.Error != "" {
+				fmt.Printf("ERROR %s: %s\n", v.Name, v.Error)
+			}
+		}
+		for _, l := range status.Logs {
+			os.Stdout.Write(l.Data)
+		}
+	}
+}
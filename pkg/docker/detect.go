@@ -0,0 +1,266 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+// GeneratedDockerfile is the name of the Dockerfile injected into the build context
+const GeneratedDockerfile = "Dockerfile.flying-cup"
+
+// Detector recognizes a language in a source tree and generates a Dockerfile for it
+type Detector struct {
+	Name     string
+	Detect   func(sourcePath string) bool
+	Generate func(sourcePath string, cfg manifest.DetectorConfig, port string) (string, error)
+}
+
+// Detectors are tried in order when a repository has no Dockerfile
+var Detectors = []Detector{
+	{Name: "go", Detect: detectGo, Generate: generateGoDockerfile},
+	{Name: "node", Detect: detectNode, Generate: generateNodeDockerfile},
+	{Name: "python", Detect: detectPython, Generate: generatePythonDockerfile},
+	{Name: "static", Detect: detectStatic, Generate: generateStaticDockerfile},
+}
+
+// GenerateDockerfile detects the language of the source tree and returns a generated Dockerfile.
+// If name is not empty, that detector is used without running detection.
+func GenerateDockerfile(sourcePath, name string, build *manifest.BuildConfig, port string) (string, string, error) {
+	for _, d := range Detectors {
+		if name != "" && d.Name != name {
+			continue
+		}
+		if name == "" && !d.Detect(sourcePath) {
+			continue
+		}
+
+		dockerfile, err := d.Generate(sourcePath, build.DetectorConfig(d.Name), port)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to generate %s Dockerfile: %w", d.Name, err)
+		}
+		return d.Name, dockerfile, nil
+	}
+
+	if name != "" {
+		return "", "", fmt.Errorf("unknown detector: %s", name)
+	}
+	return "", "", fmt.Errorf("no Dockerfile found and no supported language detected")
+}
+
+func fileExists(sourcePath, name string) bool {
+	_, err := os.Stat(filepath.Join(sourcePath, name))
+	return err == nil
+}
+
+func orDefault(value, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// Go
+
+func detectGo(sourcePath string) bool {
+	return fileExists(sourcePath, "go.mod")
+}
+
+func generateGoDockerfile(sourcePath string, cfg manifest.DetectorConfig, port string) (string, error) {
+	version := orDefault(cfg.Version, goVersionFromMod(sourcePath))
+	build := orDefault(cfg.Build, fmt.Sprintf("CGO_ENABLED=0 go build -o /out/app %s", orDefault(cfg.Dir, ".")))
+	start := orDefault(cfg.Start, "/app/app")
+
+	return fmt.Sprintf(`FROM golang:%s-alpine AS builder
+WORKDIR /src
+COPY go.mod go.sum* ./
+RUN %s
+COPY . .
+RUN %s
+
+FROM alpine:3.20
+RUN apk --no-cache add ca-certificates
+WORKDIR /app
+COPY --from=builder /out/app /app/app
+ENV PORT=%s
+EXPOSE %s
+CMD %s
+`, version, orDefault(cfg.Install, "go mod download"), build, port, port, start), nil
+}
+
+// goVersionFromMod returns the major.minor Go version declared in go.mod
+func goVersionFromMod(sourcePath string) string {
+	file, err := os.Open(filepath.Join(sourcePath, "go.mod"))
+	if err != nil {
+		return "1.23"
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "go" {
+			parts := strings.Split(fields[1], ".")
+			if len(parts) >= 2 {
+				return parts[0] + "." + parts[1]
+			}
+			return fields[1]
+		}
+	}
+
+	return "1.23"
+}
+
+// Node
+
+type packageJSON struct {
+	Main    string            `json:"main"`
+	Scripts map[string]string `json:"scripts"`
+}
+
+func detectNode(sourcePath string) bool {
+	return fileExists(sourcePath, "package.json")
+}
+
+func generateNodeDockerfile(sourcePath string, cfg manifest.DetectorConfig, port string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(sourcePath, "package.json"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read package.json: %w", err)
+	}
+
+	var pkg packageJSON
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("failed to parse package.json: %w", err)
+	}
+
+	install := "npm install"
+	switch {
+	case fileExists(sourcePath, "package-lock.json"):
+		install = "npm ci"
+	case fileExists(sourcePath, "yarn.lock"):
+		install = "yarn install --frozen-lockfile"
+	case fileExists(sourcePath, "pnpm-lock.yaml"):
+		install = "corepack enable && pnpm install --frozen-lockfile"
+	}
+	install = orDefault(cfg.Install, install)
+
+	build := cfg.Build
+	if build == "" && pkg.Scripts["build"] != "" {
+		build = "npm run build"
+	}
+
+	start := cfg.Start
+	if start == "" {
+		switch {
+		case pkg.Scripts["start"] != "":
+			start = "npm start"
+		case pkg.Main != "":
+			start = "node " + pkg.Main
+		default:
+			start = "node index.js"
+		}
+	}
+
+	buildStep := ""
+	if build != "" {
+		buildStep = "RUN " + build + "\n"
+	}
+
+	return fmt.Sprintf(`FROM node:%s-alpine AS builder
+WORKDIR /app
+COPY package.json package-lock.json* yarn.lock* pnpm-lock.yaml* ./
+RUN %s
+COPY . .
+%s
+FROM node:%s-alpine
+WORKDIR /app
+ENV NODE_ENV=production
+ENV PORT=%s
+COPY --from=builder /app ./
+EXPOSE %s
+CMD %s
+`, orDefault(cfg.Version, "20"), install, buildStep, orDefault(cfg.Version, "20"), port, port, start), nil
+}
+
+// Python
+
+func detectPython(sourcePath string) bool {
+	return fileExists(sourcePath, "requirements.txt") || fileExists(sourcePath, "pyproject.toml")
+}
+
+func generatePythonDockerfile(sourcePath string, cfg manifest.DetectorConfig, port string) (string, error) {
+	install := "pip install --no-cache-dir --prefix=/install ."
+	copyDeps := "COPY . ."
+	if fileExists(sourcePath, "requirements.txt") {
+		install = "pip install --no-cache-dir --prefix=/install -r requirements.txt"
+		copyDeps = "COPY requirements.txt ./"
+	}
+	install = orDefault(cfg.Install, install)
+
+	start := cfg.Start
+	if start == "" {
+		switch {
+		case fileExists(sourcePath, "manage.py"):
+			start = "python manage.py runserver 0.0.0.0:$PORT"
+		case fileExists(sourcePath, "main.py"):
+			start = "python main.py"
+		default:
+			start = "python app.py"
+		}
+	}
+
+	buildStep := ""
+	if cfg.Build != "" {
+		buildStep = "RUN " + cfg.Build + "\n"
+	}
+
+	return fmt.Sprintf(`FROM python:%s-slim AS builder
+WORKDIR /app
+%s
+RUN %s
+
+FROM python:%s-slim
+WORKDIR /app
+ENV PYTHONUNBUFFERED=1
+ENV PORT=%s
+COPY --from=builder /install /usr/local
+COPY . .
+%sEXPOSE %s
+CMD %s
+`, orDefault(cfg.Version, "3.12"), copyDeps, install, orDefault(cfg.Version, "3.12"), port, buildStep, port, start), nil
+}
+
+// Static
+
+var staticDirs = []string{".", "public", "dist", "build"}
+
+func detectStatic(sourcePath string) bool {
+	return staticDir(sourcePath) != ""
+}
+
+func staticDir(sourcePath string) string {
+	for _, dir := range staticDirs {
+		if fileExists(sourcePath, filepath.Join(dir, "index.html")) {
+			return dir
+		}
+	}
+	return ""
+}
+
+func generateStaticDockerfile(sourcePath string, cfg manifest.DetectorConfig, port string) (string, error) {
+	dir := orDefault(cfg.Dir, staticDir(sourcePath))
+	if dir == "" {
+		return "", fmt.Errorf("no index.html found")
+	}
+
+	return fmt.Sprintf(`FROM nginx:%s-alpine
+RUN sed -i 's/listen\(\s*\)80;/listen\1%s;/' /etc/nginx/conf.d/default.conf
+COPY %s /usr/share/nginx/html
+EXPOSE %s
+`, orDefault(cfg.Version, "1.27"), port, dir, port), nil
+}
@@ -0,0 +1,198 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	sharedTypes "github.com/karindrlainux/flying-cup/pkg/types"
+)
+
+// testSource writes files, by path relative to the source tree, into a temporary source tree
+func testSource(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestGenerateDockerfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		detector     string
+		build        manifest.BuildConfig
+		wantDetector string
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:         "go",
+			files:        map[string]string{"go.mod": "module example.com/app\n\ngo 1.22.3\n"},
+			wantDetector: "go",
+			want:         []string{"FROM golang:1.22-alpine", "RUN go mod download", "CGO_ENABLED=0 go build -o /out/app .", "EXPOSE 3000", "CMD /app/app"},
+		},
+		{
+			name:         "go with overrides",
+			files:        map[string]string{"go.mod": "module example.com/app\n"},
+			build:        manifest.BuildConfig{Go: manifest.DetectorConfig{Version: "1.21", Dir: "./cmd/server", Start: "/app/app serve"}},
+			wantDetector: "go",
+			want:         []string{"FROM golang:1.21-alpine", "go build -o /out/app ./cmd/server", "CMD /app/app serve"},
+		},
+		{
+			name: "node with build and start scripts",
+			files: map[string]string{
+				"package.json":      `{"scripts": {"build": "vite build", "start": "node dist/server.js"}}`,
+				"package-lock.json": "{}",
+			},
+			wantDetector: "node",
+			want:         []string{"FROM node:20-alpine", "RUN npm ci", "RUN npm run build", "CMD npm start"},
+		},
+		{
+			name: "node with a main file",
+			files: map[string]string{
+				"package.json": `{"main": "server.js"}`,
+				"yarn.lock":    "",
+			},
+			wantDetector: "node",
+			want:         []string{"RUN yarn install --frozen-lockfile", "CMD node server.js"},
+		},
+		{
+			name:    "node with an invalid package.json",
+			files:   map[string]string{"package.json": "{"},
+			wantErr: true,
+		},
+		{
+			name:         "python with requirements",
+			files:        map[string]string{"requirements.txt": "django\n", "manage.py": ""},
+			wantDetector: "python",
+			want:         []string{"FROM python:3.12-slim", "COPY requirements.txt ./", "-r requirements.txt", "CMD python manage.py runserver 0.0.0.0:$PORT"},
+		},
+		{
+			name:         "python project",
+			files:        map[string]string{"pyproject.toml": "", "main.py": ""},
+			wantDetector: "python",
+			want:         []string{"pip install --no-cache-dir --prefix=/install .", "CMD python main.py"},
+		},
+		{
+			name:         "static site in public",
+			files:        map[string]string{"public/index.html": "<html></html>"},
+			wantDetector: "static",
+			want:         []string{"FROM nginx:1.27-alpine", `listen\13000;`, "COPY public /usr/share/nginx/html"},
+		},
+		{
+			name:         "go is detected before static",
+			files:        map[string]string{"go.mod": "module example.com/app\n", "index.html": ""},
+			wantDetector: "go",
+			want:         []string{"FROM golang:"},
+		},
+		{
+			name:         "manifest forces a detector",
+			files:        map[string]string{"go.mod": "module example.com/app\n", "index.html": ""},
+			detector:     "static",
+			wantDetector: "static",
+			want:         []string{"COPY . /usr/share/nginx/html"},
+		},
+		{
+			name:     "manifest forces an unknown detector",
+			files:    map[string]string{"go.mod": "module example.com/app\n"},
+			detector: "rust",
+			wantErr:  true,
+		},
+		{
+			name:    "nothing detected",
+			files:   map[string]string{"README.md": ""},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detector, dockerfile, err := GenerateDockerfile(testSource(t, tt.files), tt.detector, &tt.build, "3000")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("generated a %s Dockerfile, want an error", detector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if detector != tt.wantDetector {
+				t.Errorf("detector %s, want %s", detector, tt.wantDetector)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(dockerfile, want) {
+					t.Errorf("Dockerfile lacks %q:\n%s", want, dockerfile)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveDockerfile(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         map[string]string
+		build         *manifest.BuildConfig
+		want          string
+		wantGenerated bool
+	}{
+		{
+			name:  "repository Dockerfile",
+			files: map[string]string{"Dockerfile": "FROM scratch\n", "go.mod": "module example.com/app\n"},
+			want:  "Dockerfile",
+		},
+		{
+			name:  "manifest Dockerfile",
+			files: map[string]string{"docker/app.Dockerfile": "FROM scratch\n", "go.mod": "module example.com/app\n"},
+			build: &manifest.BuildConfig{Dockerfile: "docker/app.Dockerfile"},
+			want:  "docker/app.Dockerfile",
+		},
+		{
+			name:          "no Dockerfile",
+			files:         map[string]string{"go.mod": "module example.com/app\n"},
+			want:          GeneratedDockerfile,
+			wantGenerated: true,
+		},
+		{
+			name:          "manifest forces a detector over the Dockerfile",
+			files:         map[string]string{"Dockerfile": "FROM scratch\n", "go.mod": "module example.com/app\n"},
+			build:         &manifest.BuildConfig{Detector: "go"},
+			want:          GeneratedDockerfile,
+			wantGenerated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &sharedTypes.App{SourcePath: testSource(t, tt.files), ContainerPort: "8080"}
+			if tt.build != nil {
+				app.Manifest = &manifest.Manifest{Build: *tt.build}
+			}
+
+			dockerfile, extra, err := resolveDockerfile(app, "Dockerfile")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dockerfile != tt.want {
+				t.Errorf("building with %s, want %s", dockerfile, tt.want)
+			}
+			if _, generated := extra[GeneratedDockerfile]; generated != tt.wantGenerated {
+				t.Errorf("generated a Dockerfile: %t, want %t", generated, tt.wantGenerated)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ExecResult is the outcome of a command run inside a container
+type ExecResult struct {
+	ExitCode int
+	Output   string
+}
+
+// Exec runs a command inside a running container and waits for it to finish.
+// Stdout and stderr are combined in the output.
+func (d *DockerRunner) Exec(ctx context.Context, containerID string, cmd []string, env []string) (ExecResult, error) {
+	exec, err := d.Client.ContainerExecCreate(ctx, containerID, container.ExecOptions{
+		Cmd:          cmd,
+		Env:          env,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return ExecResult{}, fmt.Errorf("failed to create exec: %w", err)
+	}
+
+	attach, err := d.Client.ContainerExecAttach(ctx, exec.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return ExecResult{}, fmt.Errorf("failed to attach exec: %w", err)
+	}
+	defer attach.Close()
+
+	// Closing the connection on cancellation unblocks the copy below
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			attach.Close()
+		case <-done:
+		}
+	}()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, attach.Reader); err != nil && ctx.Err() == nil {
+		return ExecResult{}, fmt.Errorf("failed to read exec output: %w", err)
+	}
+	if ctx.Err() != nil {
+		return ExecResult{Output: output.String()}, ctx.Err()
+	}
+
+	inspect, err := d.Client.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return ExecResult{}, fmt.Errorf("failed to inspect exec: %w", err)
+	}
+
+	return ExecResult{ExitCode: inspect.ExitCode, Output: output.String()}, nil
+}
+
+// WaitForExec runs cmd every interval until it exits with code 0, or ctx is done
+func (d *DockerRunner) WaitForExec(ctx context.Context, containerID string, cmd []string, interval time.Duration) error {
+	for {
+		result, err := d.Exec(ctx, containerID, cmd, nil)
+		if err == nil && result.ExitCode == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("timed out waiting for %v: %w", cmd, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
+
+// CopyFilesToContainer copies host files into a directory of the container, keeping their base names.
+// Only regular files are copied; symlinks must be resolved by the caller.
+func (d *DockerRunner) CopyFilesToContainer(ctx context.Context, containerID, dstDir string, paths []string) error {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+
+	for _, path := range paths {
+		info, err := os.Lstat(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", path)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		header := &tar.Header{
+			Name:    filepath.Base(path),
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := d.Client.CopyToContainer(ctx, containerID, dstDir, &archive, container.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("failed to copy files to container: %w", err)
+	}
+
+	return nil
+}
+
+// TailLogs returns the last lines of a container's combined stdout and stderr
+func (d *DockerRunner) TailLogs(ctx context.Context, containerID string, lines int) (string, error) {
+	logs, err := d.Client.ContainerLogs(ctx, containerID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Tail:       strconv.Itoa(lines),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read container logs: %w", err)
+	}
+	defer logs.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, logs); err != nil {
+		return "", fmt.Errorf("failed to read container logs: %w", err)
+	}
+
+	return output.String(), nil
+}
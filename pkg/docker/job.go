@@ -0,0 +1,93 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// JobOptions configures a one-shot container
+type JobOptions struct {
+	Name  string
+	Image string
+	Cmd   []string
+	Env   []string
+	// Networks are joined by the job, the first one when it is created
+	Networks []string
+	Labels   map[string]string
+	Limits   ContainerLimits
+}
+
+// RunJob runs a one-shot container to completion and removes it. Stdout and
+// stderr are combined in the output, which is returned even if ctx is done first.
+func (d *DockerRunner) RunJob(ctx context.Context, opts JobOptions) (ExecResult, error) {
+	// Remove a container left over by an interrupted run
+	d.Client.ContainerRemove(ctx, opts.Name, container.RemoveOptions{Force: true})
+
+	containerConfig := &container.Config{
+		Image:  opts.Image,
+		Cmd:    opts.Cmd,
+		Env:    opts.Env,
+		Labels: opts.Labels,
+	}
+
+	networkMode := ""
+	if len(opts.Networks) > 0 {
+		networkMode = opts.Networks[0]
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(networkMode),
+	}
+
+	if err := opts.Limits.Apply(hostConfig); err != nil {
+		return ExecResult{}, fmt.Errorf("failed to apply container limits: %w", err)
+	}
+
+	resp, err := d.Client.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, opts.Name)
+	if err != nil {
+		return ExecResult{}, fmt.Errorf("failed to create job container: %w", err)
+	}
+	defer d.Client.ContainerRemove(context.WithoutCancel(ctx), resp.ID, container.RemoveOptions{Force: true})
+
+	for _, networkName := range opts.Networks[min(len(opts.Networks), 1):] {
+		if err := d.Client.NetworkConnect(ctx, networkName, resp.ID, nil); err != nil {
+			return ExecResult{}, fmt.Errorf("failed to connect job container to network %s: %w", networkName, err)
+		}
+	}
+
+	waitCh, errCh := d.Client.ContainerWait(ctx, resp.ID, container.WaitConditionNextExit)
+
+	if err := d.Client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return ExecResult{}, fmt.Errorf("failed to start job container: %w", err)
+	}
+
+	result := ExecResult{}
+	var waitErr error
+	select {
+	case status := <-waitCh:
+		result.ExitCode = int(status.StatusCode)
+		if status.Error != nil {
+			waitErr = fmt.Errorf("job container failed: %s", status.Error.Message)
+		}
+	case err := <-errCh:
+		waitErr = fmt.Errorf("failed to wait for job container: %w", err)
+	}
+
+	// Collect the output even on timeout, to show how far the job got
+	logs, err := d.Client.ContainerLogs(context.WithoutCancel(ctx), resp.ID, container.LogsOptions{ShowStdout: true, ShowStderr: true})
+	if err == nil {
+		var output bytes.Buffer
+		stdcopy.StdCopy(&output, &output, logs)
+		logs.Close()
+		result.Output = output.String()
+	}
+
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	return result, waitErr
+}
@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BuildLimits bounds the time and resources a single image build may use
+type BuildLimits struct {
+	// Timeout for the whole build, zero means no timeout
+	Timeout time.Duration
+
+	// Memory limit in bytes, zero means unlimited
+	Memory int64
+
+	// CPUs is the number of CPUs the build may use, zero means unlimited
+	CPUs float64
+}
+
+// BuildCause describes why a build failed
+type BuildCause string
+
+const (
+	BuildCauseFailed    BuildCause = "failed"
+	BuildCauseTimeout   BuildCause = "timeout"
+	BuildCauseOOM       BuildCause = "oom"
+	BuildCauseCancelled BuildCause = "cancelled"
+)
+
+// BuildError is returned by builders when an image build fails
+type BuildError struct {
+	Cause  BuildCause
+	Limits BuildLimits
+	Err    error
+}
+
+func (e *BuildError) Error() string {
+	switch e.Cause {
+	case BuildCauseTimeout:
+		return fmt.Sprintf("build timed out after %s: %v", e.Limits.Timeout, e.Err)
+	case BuildCauseOOM:
+		return fmt.Sprintf("build ran out of memory: %v", e.Err)
+	case BuildCauseCancelled:
+		return fmt.Sprintf("build cancelled: %v", e.Err)
+	default:
+		return fmt.Sprintf("build failed: %v", e.Err)
+	}
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+// newBuildError classifies a build failure from the build context and error output.
+// A step killed with exit code 137 under a memory limit is reported as out of memory.
+func newBuildError(ctx context.Context, limits BuildLimits, err error) *BuildError {
+	cause := BuildCauseFailed
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		cause = BuildCauseTimeout
+	case errors.Is(ctx.Err(), context.Canceled):
+		cause = BuildCauseCancelled
+	case isOOMKill(err, limits):
+		cause = BuildCauseOOM
+	}
+
+	return &BuildError{Cause: cause, Limits: limits, Err: err}
+}
+
+// isOOMKill reports whether a step was killed by the memory limit. Without a limit, exit
+// code 137 is a plain SIGKILL, e.g. a daemon restart.
+func isOOMKill(err error, limits BuildLimits) bool {
+	if limits.Memory <= 0 {
+		return false
+	}
+
+	msg := err.Error()
+	return strings.Contains(msg, "code: 137") ||
+		strings.Contains(strings.ToLower(msg), "out of memory")
+}
+
+// withBuildTimeout applies the build timeout to ctx
+func withBuildTimeout(ctx context.Context, limits BuildLimits) (context.Context, context.CancelFunc) {
+	if limits.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, limits.Timeout)
+}
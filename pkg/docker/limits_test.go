@@ -0,0 +1,45 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestNewBuildError(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timedOut, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	killed := errors.New("The command '/bin/sh -c npm run build' returned a non-zero code: 137")
+	limited := BuildLimits{Memory: 512 << 20}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		limits BuildLimits
+		err    error
+		want   BuildCause
+	}{
+		{name: "failed step", ctx: context.Background(), limits: limited, err: errors.New("returned a non-zero code: 1"), want: BuildCauseFailed},
+		{name: "timeout", ctx: timedOut, limits: limited, err: killed, want: BuildCauseTimeout},
+		{name: "cancelled", ctx: cancelled, limits: limited, err: killed, want: BuildCauseCancelled},
+		{name: "killed under a memory limit", ctx: context.Background(), limits: limited, err: killed, want: BuildCauseOOM},
+		{name: "out of memory message", ctx: context.Background(), limits: limited, err: errors.New("fatal error: runtime: out of memory"), want: BuildCauseOOM},
+		{name: "killed without a memory limit", ctx: context.Background(), err: killed, want: BuildCauseFailed},
+		{name: "out of memory message without a memory limit", ctx: context.Background(), err: errors.New("Out of memory"), want: BuildCauseFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buildErr := newBuildError(tt.ctx, tt.limits, tt.err)
+			if buildErr.Cause != tt.want {
+				t.Errorf("cause %s, want %s", buildErr.Cause, tt.want)
+			}
+			if !errors.Is(buildErr, tt.err) {
+				t.Errorf("%v does not wrap %v", buildErr, tt.err)
+			}
+		})
+	}
+}
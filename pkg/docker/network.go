@@ -0,0 +1,162 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// EnsureNetwork creates a bridge network unless a network with the same name exists. An
+// existing network that is internal when it should not be, or the other way round, is
+// removed and created again, disconnecting its containers.
+func (d *DockerRunner) EnsureNetwork(ctx context.Context, name string, labels map[string]string, internal bool) (string, error) {
+	existing, err := d.Client.NetworkList(ctx, network.ListOptions{Filters: filters.NewArgs(filters.Arg("name", name))})
+	if err != nil {
+		return "", fmt.Errorf("failed to list networks: %w", err)
+	}
+
+	// The name filter matches substrings, so compare exactly
+	for _, n := range existing {
+		if n.Name != name {
+			continue
+		}
+		if n.Internal == internal {
+			return n.ID, nil
+		}
+
+		fmt.Printf("🌐 Network %s changes from internal=%t to internal=%t, recreating it\n", name, n.Internal, internal)
+		if err := d.RemoveNetwork(ctx, n.ID); err != nil {
+			return "", err
+		}
+	}
+
+	resp, err := d.Client.NetworkCreate(ctx, name, network.CreateOptions{
+		Driver:   "bridge",
+		Internal: internal,
+		Labels:   labels,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create network %s: %w", name, err)
+	}
+
+	fmt.Printf("🌐 Network %s created\n", name)
+	return resp.ID, nil
+}
+
+// ConnectNetwork connects a container to a network unless it is already connected
+func (d *DockerRunner) ConnectNetwork(ctx context.Context, networkName, containerName string) error {
+	info, err := d.Client.ContainerInspect(ctx, containerName)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", containerName, err)
+	}
+
+	if info.NetworkSettings != nil {
+		if _, connected := info.NetworkSettings.Networks[networkName]; connected {
+			return nil
+		}
+	}
+
+	if err := d.Client.NetworkConnect(ctx, networkName, containerName, nil); err != nil {
+		return fmt.Errorf("failed to connect %s to network %s: %w", containerName, networkName, err)
+	}
+
+	return nil
+}
+
+// RemoveNetwork disconnects the containers still attached to a network, such as the proxy, and removes it
+func (d *DockerRunner) RemoveNetwork(ctx context.Context, networkID string) error {
+	inspect, err := d.Client.NetworkInspect(ctx, networkID, network.InspectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to inspect network %s: %w", networkID, err)
+	}
+
+	for containerID := range inspect.Containers {
+		if err := d.Client.NetworkDisconnect(ctx, networkID, containerID, true); err != nil {
+			return fmt.Errorf("failed to disconnect %s from network %s: %w", containerID, inspect.Name, err)
+		}
+	}
+
+	if err := d.Client.NetworkRemove(ctx, networkID); err != nil {
+		return fmt.Errorf("failed to remove network %s: %w", inspect.Name, err)
+	}
+
+	return nil
+}
+
+// CreateVolume creates a named volume with the given labels
+func (d *DockerRunner) CreateVolume(ctx context.Context, name string, labels map[string]string) error {
+	_, err := d.Client.VolumeCreate(ctx, volume.CreateOptions{Name: name, Labels: labels})
+	if err != nil {
+		return fmt.Errorf("failed to create volume %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// PullImage pulls an image, streaming progress to stdout
+func (d *DockerRunner) PullImage(ctx context.Context, ref string) error {
+	fmt.Printf("Pulling image %s\n", ref)
+
+	resp, err := d.Client.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", ref, err)
+	}
+	defer resp.Close()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(resp, os.Stdout, 0, false, nil); err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", ref, err)
+	}
+
+	return nil
+}
+
+// RemoveResources removes every container, network and volume carrying the given label
+func (d *DockerRunner) RemoveResources(ctx context.Context, labelKey, labelValue string) error {
+	labelFilter := filters.NewArgs(filters.Arg("label", fmt.Sprintf("%s=%s", labelKey, labelValue)))
+
+	containers, err := d.Client.ContainerList(ctx, container.ListOptions{All: true, Filters: labelFilter})
+	if err != nil {
+		return fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	// Containers first, as networks and volumes in use cannot be removed
+	for _, c := range containers {
+		if err := d.Client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true, RemoveVolumes: true}); err != nil {
+			return fmt.Errorf("failed to remove container %s: %w", c.ID, err)
+		}
+		fmt.Printf("🧹 Container removed: %s\n", c.Names)
+	}
+
+	networks, err := d.Client.NetworkList(ctx, network.ListOptions{Filters: labelFilter})
+	if err != nil {
+		return fmt.Errorf("failed to list networks: %w", err)
+	}
+
+	for _, n := range networks {
+		if err := d.RemoveNetwork(ctx, n.ID); err != nil {
+			return err
+		}
+		fmt.Printf("🧹 Network removed: %s\n", n.Name)
+	}
+
+	volumes, err := d.Client.VolumeList(ctx, volume.ListOptions{Filters: labelFilter})
+	if err != nil {
+		return fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	for _, v := range volumes.Volumes {
+		if err := d.Client.VolumeRemove(ctx, v.Name, true); err != nil {
+			return fmt.Errorf("failed to remove volume %s: %w", v.Name, err)
+		}
+		fmt.Printf("🧹 Volume removed: %s\n", v.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,90 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// ErrContainerUnreachable is returned by WaitForPort when the controller shares no
+// network with the container, so readiness cannot be probed
+var ErrContainerUnreachable = errors.New("container is not reachable from the controller")
+
+// ExposedPort returns the lowest TCP port exposed by an image, or "" if it exposes none
+func (d *DockerRunner) ExposedPort(ctx context.Context, imageTag string) (string, error) {
+	inspect, err := d.Client.ImageInspect(ctx, imageTag)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %s: %w", imageTag, err)
+	}
+	if inspect.Config == nil {
+		return "", nil
+	}
+
+	var ports []int
+	for port := range inspect.Config.ExposedPorts {
+		proto, number := nat.SplitProtoPort(port)
+		if proto != "tcp" {
+			continue
+		}
+		if p, err := strconv.Atoi(number); err == nil {
+			ports = append(ports, p)
+		}
+	}
+	if len(ports) == 0 {
+		return "", nil
+	}
+
+	sort.Ints(ports)
+	return strconv.Itoa(ports[0]), nil
+}
+
+// WaitForPort polls the container's addresses every interval until one accepts TCP
+// connections on port. It fails when the container stops or restarts, and when ctx
+// is done; if no address ever answered before the deadline, the error is ErrContainerUnreachable.
+func (d *DockerRunner) WaitForPort(ctx context.Context, containerID, port string, interval time.Duration) error {
+	refused := false
+
+	for {
+		info, err := d.Client.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+
+		if info.State != nil && (info.State.Restarting || !info.State.Running) {
+			return fmt.Errorf("container exited with code %d before listening on port %s", info.State.ExitCode, port)
+		}
+
+		if info.NetworkSettings != nil {
+			for _, endpoint := range info.NetworkSettings.Networks {
+				if endpoint.IPAddress == "" {
+					continue
+				}
+
+				conn, err := net.DialTimeout("tcp", net.JoinHostPort(endpoint.IPAddress, port), time.Second)
+				if err == nil {
+					conn.Close()
+					return nil
+				}
+				if errors.Is(err, syscall.ECONNREFUSED) {
+					refused = true
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			if !refused && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return ErrContainerUnreachable
+			}
+			return fmt.Errorf("container is not listening on port %s: %w", port, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
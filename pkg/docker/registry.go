@@ -0,0 +1,307 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/registry"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// RegistryConfig configures pushing preview images to an OCI registry
+type RegistryConfig struct {
+	// URL is the registry host with an optional path prefix, e.g. localhost:5000 or ghcr.io/acme/previews
+	URL      string
+	Username string
+	Password string
+
+	// Insecure talks plain HTTP to the registry API
+	Insecure bool
+
+	// DeleteOnCleanup deletes the pushed tags when the preview is cleaned up, and the tags
+	// of the commits no longer retained
+	DeleteOnCleanup bool
+}
+
+// Registry pushes images to, and deletes tags from, an OCI registry
+type Registry struct {
+	Client *client.Client
+	Config RegistryConfig
+	http   *http.Client
+}
+
+// NewRegistry creates a registry client for the given config
+func NewRegistry(cli *client.Client, config RegistryConfig) *Registry {
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	return &Registry{Client: cli, Config: config, http: http.DefaultClient}
+}
+
+// ImageRef returns the registry reference for an image name and tag
+func (r *Registry) ImageRef(name, tag string) string {
+	return fmt.Sprintf("%s/%s:%s", r.Config.URL, strings.ToLower(name), tag)
+}
+
+// Push tags the local image for the registry and pushes it, returning the remote reference
+func (r *Registry) Push(ctx context.Context, imageTag, name, tag string) (string, error) {
+	ref := r.ImageRef(name, tag)
+
+	if err := r.Client.ImageTag(ctx, imageTag, ref); err != nil {
+		return "", fmt.Errorf("failed to tag image %s as %s: %w", imageTag, ref, err)
+	}
+
+	auth, err := registry.EncodeAuthConfig(registry.AuthConfig{
+		Username:      r.Config.Username,
+		Password:      r.Config.Password,
+		ServerAddress: r.host(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode registry auth: %w", err)
+	}
+
+	fmt.Printf("Pushing image %s\n", ref)
+
+	resp, err := r.Client.ImagePush(ctx, ref, image.PushOptions{RegistryAuth: auth})
+	if err != nil {
+		return "", fmt.Errorf("failed to push image %s: %w", ref, err)
+	}
+	defer resp.Close()
+
+	if err := jsonmessage.DisplayJSONMessagesStream(resp, os.Stdout, 0, false, nil); err != nil {
+		return "", fmt.Errorf("failed to push image %s: %w", ref, err)
+	}
+
+	return ref, nil
+}
+
+// DeleteImage deletes a pushed reference from the registry via the distribution API.
+// The registry must allow deletes (REGISTRY_STORAGE_DELETE_ENABLED=true for registry:2).
+func (r *Registry) DeleteImage(ctx context.Context, ref string) error {
+	repository, tag, err := r.splitRef(ref)
+	if err != nil {
+		return err
+	}
+
+	manifestURL := fmt.Sprintf("%s/v2/%s/manifests/", r.baseURL(), repository)
+
+	// Resolve the tag to its manifest digest, which is what the API deletes by
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifestURL+tag, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		"application/vnd.docker.distribution.manifest.v2+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.oci.image.index.v1+json",
+	}, ", "))
+
+	resp, err := r.do(req, repository)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", ref, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to resolve %s: registry returned %s", ref, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return fmt.Errorf("failed to resolve %s: registry returned no digest", ref)
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodDelete, manifestURL+digest, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err = r.do(req, repository)
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", ref, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("failed to delete %s: registry returned %s", ref, resp.Status)
+	}
+
+	fmt.Printf("🧹 Deleted %s from registry\n", ref)
+	return nil
+}
+
+// Tags lists the tags pushed for an image name, none if nothing was pushed for it
+func (r *Registry) Tags(ctx context.Context, name string) ([]string, error) {
+	repository, _, err := r.splitRef(r.ImageRef(name, "latest"))
+	if err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	next := fmt.Sprintf("%s/v2/%s/tags/list", r.baseURL(), repository)
+	for next != "" {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := r.do(req, repository)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags of %s: %w", repository, err)
+		}
+
+		var body struct {
+			Tags []string `json:"tags"`
+		}
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&body)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return tags, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to list tags of %s: registry returned %s", repository, resp.Status)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode tags of %s: %w", repository, err)
+		}
+
+		tags = append(tags, body.Tags...)
+		next = r.nextPage(resp.Header.Get("Link"))
+	}
+
+	return tags, nil
+}
+
+// nextPage returns the URL of the next page of a paginated list from its Link header,
+// e.g. </v2/app/tags/list?last=b&n=100>; rel="next"
+func (r *Registry) nextPage(link string) string {
+	target, params, found := strings.Cut(link, ";")
+	if !found || !strings.Contains(params, `rel="next"`) {
+		return ""
+	}
+
+	target = strings.Trim(strings.TrimSpace(target), "<>")
+	if strings.HasPrefix(target, "/") {
+		return r.baseURL() + target
+	}
+	return target
+}
+
+// do sends a registry API request, authenticating with basic auth or a bearer token as challenged
+func (r *Registry) do(req *http.Request, repository string) (*http.Response, error) {
+	if r.Config.Username != "" {
+		req.SetBasicAuth(r.Config.Username, r.Config.Password)
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return resp, nil
+	}
+
+	token, err := r.fetchToken(req.Context(), challenge, repository)
+	if err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return r.http.Do(retry)
+}
+
+// fetchToken exchanges the configured credentials for a bearer token with push and delete scope
+func (r *Registry) fetchToken(ctx context.Context, challenge, repository string) (string, error) {
+	params := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[key] = strings.Trim(value, `"`)
+		}
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid registry auth challenge: %s", challenge)
+	}
+
+	query := realm.Query()
+	query.Set("service", params["service"])
+	query.Set("scope", fmt.Sprintf("repository:%s:pull,push,delete", repository))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if r.Config.Username != "" {
+		req.SetBasicAuth(r.Config.Username, r.Config.Password)
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch registry token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch registry token: %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode registry token: %w", err)
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
+
+// host returns the registry host without the path prefix
+func (r *Registry) host() string {
+	host, _, _ := strings.Cut(r.Config.URL, "/")
+	return host
+}
+
+func (r *Registry) baseURL() string {
+	if r.Config.Insecure {
+		return "http://" + r.host()
+	}
+	return "https://" + r.host()
+}
+
+// splitRef splits a reference pushed by this registry into repository and tag
+func (r *Registry) splitRef(ref string) (string, string, error) {
+	path, ok := strings.CutPrefix(ref, r.host()+"/")
+	if !ok {
+		return "", "", fmt.Errorf("image %s does not belong to registry %s", ref, r.host())
+	}
+
+	colon := strings.LastIndex(path, ":")
+	if colon == -1 {
+		return "", "", fmt.Errorf("image %s has no tag", ref)
+	}
+
+	return path[:colon], path[colon+1:], nil
+}
@@ -0,0 +1,150 @@
+//go:build integration
+
+package docker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/nat"
+)
+
+// registryImage runs the registry the test pushes to, and is pushed itself
+const registryImage = "registry:2"
+
+// startRegistry runs a registry allowing deletes on a random local port, and returns its host
+func startRegistry(t *testing.T, ctx context.Context, cli *client.Client) string {
+	t.Helper()
+
+	pull, err := cli.ImagePull(ctx, registryImage, image.PullOptions{})
+	if err != nil {
+		t.Fatalf("failed to pull %s: %v", registryImage, err)
+	}
+	io.Copy(io.Discard, pull)
+	pull.Close()
+
+	created, err := cli.ContainerCreate(ctx,
+		&container.Config{
+			Image:        registryImage,
+			Env:          []string{"REGISTRY_STORAGE_DELETE_ENABLED=true"},
+			ExposedPorts: nat.PortSet{"5000/tcp": {}},
+		},
+		&container.HostConfig{
+			PortBindings: nat.PortMap{"5000/tcp": {{HostIP: "127.0.0.1"}}},
+		},
+		nil, nil, "")
+	if err != nil {
+		t.Fatalf("failed to create registry: %v", err)
+	}
+	t.Cleanup(func() {
+		cli.ContainerRemove(context.Background(), created.ID, container.RemoveOptions{Force: true, RemoveVolumes: true})
+	})
+
+	if err := cli.ContainerStart(ctx, created.ID, container.StartOptions{}); err != nil {
+		t.Fatalf("failed to start registry: %v", err)
+	}
+
+	info, err := cli.ContainerInspect(ctx, created.ID)
+	if err != nil {
+		t.Fatalf("failed to inspect registry: %v", err)
+	}
+	bindings := info.NetworkSettings.Ports["5000/tcp"]
+	if len(bindings) == 0 {
+		t.Fatal("registry port is not published")
+	}
+	host := "127.0.0.1:" + bindings[0].HostPort
+
+	for deadline := time.Now().Add(30 * time.Second); ; {
+		resp, err := http.Get("http://" + host + "/v2/")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return host
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("registry at %s did not start", host)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// manifestStatus returns the status of a HEAD request for the manifest of repository:tag
+func manifestStatus(t *testing.T, host, repository, tag string) int {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("http://%s/v2/%s/manifests/%s", host, repository, tag), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/vnd.docker.distribution.manifest.v2+json, application/vnd.oci.image.manifest.v1+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRegistryPushAndDelete(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		t.Skipf("Docker is not available: %v", err)
+	}
+	defer cli.Close()
+	if _, err := cli.Ping(ctx); err != nil {
+		t.Skipf("Docker is not available: %v", err)
+	}
+
+	host := startRegistry(t, ctx, cli)
+	registry := NewRegistry(cli, RegistryConfig{URL: host + "/previews/", Insecure: true})
+
+	ref, err := registry.Push(ctx, registryImage, "App-PR-1", "abc123")
+	if err != nil {
+		t.Fatalf("Push failed: %v", err)
+	}
+	t.Cleanup(func() {
+		cli.ImageRemove(context.Background(), ref, image.RemoveOptions{})
+	})
+
+	if want := host + "/previews/app-pr-1:abc123"; ref != want {
+		t.Errorf("pushed %s, want %s", ref, want)
+	}
+	if status := manifestStatus(t, host, "previews/app-pr-1", "abc123"); status != http.StatusOK {
+		t.Fatalf("pushed manifest returned %d, want %d", status, http.StatusOK)
+	}
+	if tags, err := registry.Tags(ctx, "App-PR-1"); err != nil || len(tags) != 1 || tags[0] != "abc123" {
+		t.Errorf("tags %v (%v), want the pushed one", tags, err)
+	}
+
+	if err := registry.DeleteImage(ctx, ref); err != nil {
+		t.Fatalf("DeleteImage failed: %v", err)
+	}
+	if status := manifestStatus(t, host, "previews/app-pr-1", "abc123"); status != http.StatusNotFound {
+		t.Errorf("deleted manifest returned %d, want %d", status, http.StatusNotFound)
+	}
+
+	if tags, err := registry.Tags(ctx, "App-PR-1"); err != nil || len(tags) != 0 {
+		t.Errorf("tags %v (%v) left after the delete", tags, err)
+	}
+
+	// Deleting again, e.g. when a cleanup is retried, is not an error
+	if err := registry.DeleteImage(ctx, ref); err != nil {
+		t.Errorf("deleting a missing tag failed: %v", err)
+	}
+
+	if err := registry.DeleteImage(ctx, "ghcr.io/acme/app:abc123"); err == nil {
+		t.Error("deleting an image of another registry succeeded")
+	}
+}
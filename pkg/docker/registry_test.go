@@ -0,0 +1,54 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryTags(t *testing.T) {
+	pages := map[string]string{
+		"":       `{"name": "previews/pr-app-1", "tags": ["c1aaaa", "c2bbbb"]}`,
+		"c2bbbb": `{"name": "previews/pr-app-1", "tags": ["c3cccc"]}`,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/previews/pr-app-1/tags/list" {
+			http.Error(w, `{"errors": [{"code": "NAME_UNKNOWN"}]}`, http.StatusNotFound)
+			return
+		}
+
+		last := r.URL.Query().Get("last")
+		if last == "" {
+			w.Header().Set("Link", `</v2/previews/pr-app-1/tags/list?last=c2bbbb&n=2>; rel="next"`)
+		}
+		fmt.Fprint(w, pages[last])
+	}))
+	defer server.Close()
+
+	registry := NewRegistry(nil, RegistryConfig{URL: strings.TrimPrefix(server.URL, "http://") + "/previews", Insecure: true})
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "pr-app-1", want: []string{"c1aaaa", "c2bbbb", "c3cccc"}},
+		{name: "PR-App-1", want: []string{"c1aaaa", "c2bbbb", "c3cccc"}},
+		{name: "pr-app-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags, err := registry.Tags(context.Background(), tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(tags, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("tags %v, want %v", tags, tt.want)
+			}
+		})
+	}
+}
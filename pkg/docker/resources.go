@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-units"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+// ContainerLimits are the resource limits and hardening applied to a preview container
+type ContainerLimits struct {
+	// Memory limit in bytes, zero means unlimited
+	Memory int64
+	// CPUs is the number of CPUs, zero means unlimited
+	CPUs float64
+	// PidsLimit caps the number of processes, zero means unlimited
+	PidsLimit int64
+
+	NoNewPrivileges bool
+	CapDrop         []string
+
+	// ReadOnly mounts the root filesystem read-only, with Tmpfs mounted writable
+	ReadOnly bool
+	// Tmpfs entries are "path" or "path:options", e.g. /tmp:size=64m
+	Tmpfs []string
+
+	// Ulimits entries are "name=soft:hard", e.g. nofile=1024:4096
+	Ulimits []string
+}
+
+// WithOverrides returns the limits with the repository manifest overrides applied. The
+// manifest comes from the pull request, so it can only tighten the controller's limits and
+// hardening: larger limits are clamped and relaxed hardening flags are ignored.
+func (l ContainerLimits) WithOverrides(r manifest.Resources) (ContainerLimits, error) {
+	if r.Memory != "" {
+		memory, err := units.RAMInBytes(r.Memory)
+		if err != nil {
+			return l, fmt.Errorf("invalid memory limit %q: %w", r.Memory, err)
+		}
+		l.Memory = tighten(l.Memory, memory, "memory limit")
+	}
+	if r.CPUs > 0 {
+		l.CPUs = tighten(l.CPUs, r.CPUs, "CPU limit")
+	}
+	if r.Pids > 0 {
+		l.PidsLimit = tighten(l.PidsLimit, r.Pids, "pids limit")
+	}
+	if r.NoNewPrivileges != nil && *r.NoNewPrivileges {
+		l.NoNewPrivileges = true
+	}
+	for _, capability := range r.CapDrop {
+		if !slices.ContainsFunc(l.CapDrop, func(c string) bool { return strings.EqualFold(c, capability) }) {
+			l.CapDrop = append(l.CapDrop, capability)
+		}
+	}
+	if r.ReadOnly != nil && *r.ReadOnly {
+		l.ReadOnly = true
+	}
+	if r.Tmpfs != nil {
+		l.Tmpfs = r.Tmpfs
+	}
+	if r.Ulimits != nil {
+		ulimits, err := tightenUlimits(l.Ulimits, r.Ulimits)
+		if err != nil {
+			return l, err
+		}
+		l.Ulimits = ulimits
+	}
+
+	return l, nil
+}
+
+// tighten returns the lower of a limit and its override, zero meaning unlimited
+func tighten[T int64 | float64](limit, override T, name string) T {
+	if limit > 0 && override > limit {
+		fmt.Printf("⚠️  Warning: %s %v of the manifest exceeds the maximum, using %v\n", name, override, limit)
+		return limit
+	}
+	return override
+}
+
+// tightenUlimits lowers the configured ulimits to the overrides. Ulimits the controller
+// does not set cannot be added, as they would raise the daemon defaults.
+func tightenUlimits(base, overrides []string) ([]string, error) {
+	limits := make(map[string]*units.Ulimit)
+	var names []string
+	for _, entry := range base {
+		ulimit, err := units.ParseUlimit(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ulimit %q: %w", entry, err)
+		}
+		limits[ulimit.Name] = ulimit
+		names = append(names, ulimit.Name)
+	}
+
+	for _, entry := range overrides {
+		override, err := units.ParseUlimit(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ulimit %q: %w", entry, err)
+		}
+		ulimit, exists := limits[override.Name]
+		if !exists {
+			fmt.Printf("⚠️  Warning: ignoring ulimit %s of the manifest, only configured ulimits can be lowered\n", override.Name)
+			continue
+		}
+		ulimit.Soft = min(ulimit.Soft, override.Soft)
+		ulimit.Hard = min(ulimit.Hard, override.Hard)
+	}
+
+	ulimits := make([]string, 0, len(names))
+	for _, name := range names {
+		ulimits = append(ulimits, limits[name].String())
+	}
+	return ulimits, nil
+}
+
+// Apply sets the limits on a container host config
+func (l ContainerLimits) Apply(hostConfig *container.HostConfig) error {
+	if l.Memory > 0 {
+		hostConfig.Memory = l.Memory
+		hostConfig.MemorySwap = l.Memory
+	}
+	if l.CPUs > 0 {
+		hostConfig.NanoCPUs = int64(l.CPUs * 1e9)
+	}
+	if l.PidsLimit > 0 {
+		pids := l.PidsLimit
+		hostConfig.PidsLimit = &pids
+	}
+	if l.NoNewPrivileges {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "no-new-privileges:true")
+	}
+	hostConfig.CapDrop = append(hostConfig.CapDrop, l.CapDrop...)
+
+	if l.ReadOnly {
+		hostConfig.ReadonlyRootfs = true
+		hostConfig.Tmpfs = make(map[string]string)
+		for _, entry := range l.Tmpfs {
+			path, options, _ := strings.Cut(entry, ":")
+			hostConfig.Tmpfs[path] = options
+		}
+	}
+
+	for _, entry := range l.Ulimits {
+		ulimit, err := units.ParseUlimit(entry)
+		if err != nil {
+			return fmt.Errorf("invalid ulimit %q: %w", entry, err)
+		}
+		hostConfig.Ulimits = append(hostConfig.Ulimits, &container.Ulimit{
+			Name: ulimit.Name,
+			Soft: ulimit.Soft,
+			Hard: ulimit.Hard,
+		})
+	}
+
+	return nil
+}
+
+// Labels records the applied limits as flying-cup.* container labels
+func (l ContainerLimits) Labels() map[string]string {
+	labels := map[string]string{
+		"flying-cup.limits.memory":              strconv.FormatInt(l.Memory, 10),
+		"flying-cup.limits.cpus":                strconv.FormatFloat(l.CPUs, 'f', -1, 64),
+		"flying-cup.limits.pids":                strconv.FormatInt(l.PidsLimit, 10),
+		"flying-cup.security.no-new-privileges": strconv.FormatBool(l.NoNewPrivileges),
+		"flying-cup.security.cap-drop":          strings.Join(l.CapDrop, ","),
+		"flying-cup.security.read-only":         strconv.FormatBool(l.ReadOnly),
+		"flying-cup.limits.ulimits":             strings.Join(l.Ulimits, ","),
+	}
+
+	if l.ReadOnly {
+		labels["flying-cup.security.tmpfs"] = strings.Join(l.Tmpfs, ",")
+	}
+
+	return labels
+}
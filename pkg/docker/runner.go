@@ -3,10 +3,10 @@ package docker
 import (
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/go-connections/nat"
 
 	"github.com/docker/docker/client"
@@ -17,29 +17,44 @@ type DockerRunner struct {
 	Client *client.Client
 }
 
-// RunContainerWithTraefik runs a container with Traefik integration
-func (d *DockerRunner) RunContainerWithTraefik(ctx context.Context, app *sharedTypes.App, imageTag, containerName string, labels map[string]string) (string, error) {
+// RunContainerWithTraefik runs a container with Traefik integration, applying the given limits
+func (d *DockerRunner) RunContainerWithTraefik(ctx context.Context, app *sharedTypes.App, imageTag, containerName string, labels map[string]string, limits ContainerLimits) (string, error) {
 	containerPortBind := fmt.Sprintf("%s/tcp", app.ContainerPort)
 
 	containerConfig := &container.Config{
 		Image:  imageTag,
 		Labels: labels,
+		Env:    app.Env,
 		ExposedPorts: map[nat.Port]struct{}{
 			nat.Port(containerPortBind): {},
 		},
 	}
 
+	// The first network is the container's own, the others are connected after creation
+	networkMode := "web"
+	var extraNetworks []string
+	if len(app.Networks) > 0 {
+		networkMode = app.Networks[0]
+		extraNetworks = app.Networks[1:]
+	}
+
 	hostConfig := &container.HostConfig{
 		// No PortBindings needed - Traefik handles routing
-		NetworkMode: "web", // Explicitly attach to the traefik network
+		NetworkMode: container.NetworkMode(networkMode),
 		RestartPolicy: container.RestartPolicy{
 			Name: "unless-stopped",
 		},
 		AutoRemove: false, // Don't auto-remove for PR deployments
 	}
 
-	// Remove existing container if it exists
-	d.RemoveContainerIfExists(ctx, app)
+	if err := limits.Apply(hostConfig); err != nil {
+		return "", fmt.Errorf("failed to apply container limits: %w", err)
+	}
+
+	// Remove a leftover container of the same name, e.g. from a failed deploy
+	if err := d.RemoveContainerByName(ctx, containerName); err != nil {
+		return "", err
+	}
 
 	// Create container
 	resp, err := d.Client.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, containerName)
@@ -47,6 +62,14 @@ func (d *DockerRunner) RunContainerWithTraefik(ctx context.Context, app *sharedT
 		return "", fmt.Errorf("failed to create container: %w", err)
 	}
 
+	// Connect to any additional networks
+	for _, networkName := range extraNetworks {
+		if err := d.Client.NetworkConnect(ctx, networkName, resp.ID, nil); err != nil {
+			d.Client.ContainerRemove(ctx, resp.ID, container.RemoveOptions{Force: true})
+			return "", fmt.Errorf("failed to connect to network %s: %w", networkName, err)
+		}
+	}
+
 	// Start container
 	err = d.Client.ContainerStart(ctx, resp.ID, container.StartOptions{})
 	if err != nil {
@@ -110,51 +133,23 @@ func (d *DockerRunner) StopAndRemoveContainer(ctx context.Context, containerID s
 
 // RemoveContainerIfExists removes a container if it exists
 func (d *DockerRunner) RemoveContainerIfExists(ctx context.Context, app *sharedTypes.App) error {
-	containers, err := d.Client.ContainerList(ctx, container.ListOptions{All: true})
+	return d.RemoveContainerByName(ctx, app.Name)
+}
 
+// RemoveContainerByName stops and removes the container with the given name, if any
+func (d *DockerRunner) RemoveContainerByName(ctx context.Context, name string) error {
+	containers, err := d.Client.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("name", "^/"+name+"$")),
+	})
 	if err != nil {
 		return fmt.Errorf("failed to list containers: %w", err)
 	}
 
 	for _, c := range containers {
-		for _, name := range c.Names {
-			if name == "/"+app.Name {
-				fmt.Printf("🧹 Removing existing container: %s\n", name)
-
-				// Stop the container
-				if err := d.Client.ContainerStop(ctx, c.ID, container.StopOptions{}); err != nil {
-					fmt.Printf("⚠️  Warning: failed to stop container %s: %v\n", c.ID, err)
-				}
-
-				// Remove the container
-				if err := d.Client.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil {
-					return fmt.Errorf("failed to remove container: %w", err)
-				}
-
-				// Wait for container to be fully removed
-				for i := 0; i < 10; i++ {
-					time.Sleep(1 * time.Second)
-
-					// Check if container still exists
-					containers, _ := d.Client.ContainerList(ctx, container.ListOptions{All: true})
-					exists := false
-					for _, c2 := range containers {
-						for _, name2 := range c2.Names {
-							if name2 == "/"+app.Name {
-								exists = true
-								break
-							}
-						}
-					}
-
-					if !exists {
-						fmt.Printf("✅ Container removed: %s\n", name)
-						return nil
-					}
-				}
-
-				return fmt.Errorf("timeout waiting for container removal: %s", name)
-			}
+		fmt.Printf("🧹 Removing existing container: %s\n", name)
+		if err := d.StopAndRemoveContainer(ctx, c.ID); err != nil {
+			return err
 		}
 	}
 
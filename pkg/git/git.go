@@ -1,13 +1,35 @@
 package git
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"strings"
 )
 
+// ErrNetwork marks clones that failed on the network and may succeed when retried
+var ErrNetwork = errors.New("network error while cloning")
+
+// networkFailures are git messages of transient network failures
+var networkFailures = []string{
+	"Could not resolve host",
+	"Connection timed out",
+	"Connection refused",
+	"Connection reset",
+	"Failed to connect",
+	"Operation timed out",
+	"Temporary failure",
+	"The remote end hung up unexpectedly",
+	"early EOF",
+	"RPC failed",
+	"returned error: 5",
+}
+
 func CloneRepository(ctx context.Context, cloneUrl string, branch string, targetPath string) error {
 
 	if _, err := os.Stat(targetPath); err == nil {
@@ -23,11 +45,15 @@ func CloneRepository(ctx context.Context, cloneUrl string, branch string, target
 
 	cmd := exec.CommandContext(ctx, "git", "clone", "-b", branch, cloneUrl, targetPath)
 
+	var stderr bytes.Buffer
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
 
 	if err := cmd.Run(); err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
+			if isNetworkFailure(stderr.String()) {
+				return fmt.Errorf("git clone failed with exit code %d: %w", exitErr.ExitCode(), ErrNetwork)
+			}
 			return fmt.Errorf("git clone failed with exit code %d: %s", exitErr.ExitCode(), exitErr.String())
 		}
 		return fmt.Errorf("failed to clone repository: %w", err)
@@ -44,3 +70,12 @@ func RemoveClonedRepository(ctx context.Context, targetPath string) error {
 
 	return nil
 }
+
+func isNetworkFailure(output string) bool {
+	for _, failure := range networkFailures {
+		if strings.Contains(output, failure) {
+			return true
+		}
+	}
+	return false
+}
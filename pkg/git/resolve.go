@@ -0,0 +1,28 @@
+package git
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// ResolvePath returns the file path names in a cloned repository, with its symlinks resolved.
+// A path that leads outside the repository, directly or through a symlink, is refused, so
+// a pull request cannot read files of the host.
+func ResolvePath(repoPath, path string) (string, error) {
+	root, err := filepath.EvalSymlinks(repoPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve repository path: %w", err)
+	}
+
+	resolved, err := filepath.EvalSymlinks(filepath.Join(root, path))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the repository", path)
+	}
+	return resolved, nil
+}
@@ -0,0 +1,77 @@
+package git
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolvePath(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := t.TempDir()
+	for _, dir := range []string{"web", "..data"} {
+		if err := os.Mkdir(filepath.Join(repo, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range map[string]string{
+		"link":       outside,
+		"secret.sql": filepath.Join(outside, "secret"),
+		"current":    "web",
+		"web/up":     "..",
+		"web/escape": "../..",
+		"dangling":   filepath.Join(outside, "missing"),
+	} {
+		if err := os.Symlink(target, filepath.Join(repo, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{name: "directory", path: "web", want: "web"},
+		{name: "repository root", path: ".", want: "."},
+		{name: "dotted name", path: "..data", want: "..data"},
+		{name: "symlink inside the repository", path: "current", want: "web"},
+		{name: "symlink to the repository root", path: "web/up", want: "."},
+		{name: "absolute path is relative to the repository", path: "/web", want: "web"},
+		{name: "parent directory", path: "../" + filepath.Base(outside), wantErr: true},
+		{name: "symlinked file", path: "secret.sql", wantErr: true},
+		{name: "symlinked directory", path: "link/secret", wantErr: true},
+		{name: "intermediate symlink", path: "link", wantErr: true},
+		{name: "relative symlink", path: "web/escape", wantErr: true},
+		{name: "missing file", path: "missing.sql", wantErr: true},
+		{name: "dangling symlink", path: "dangling", wantErr: true},
+	}
+
+	root, err := filepath.EvalSymlinks(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := ResolvePath(repo, tt.path)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolved %s to %s, want an error", tt.path, resolved)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(root, tt.want); resolved != want {
+				t.Errorf("resolved %s to %s, want %s", tt.path, resolved, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package manifest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileNames are the manifest file names looked up at the repository root, in order
+var FileNames = []string{".flying-cup.yml", ".flying-cup.yaml"}
+
+// Manifest is the per-repository preview configuration
+type Manifest struct {
+	// Port the app listens on; defaults to the port exposed by the image, then 8080
+	Port int `yaml:"port"`
+
+	Build     BuildConfig `yaml:"build"`
+	Resources Resources   `yaml:"resources"`
+
+	// Env is injected into the preview container; values may use {{.PreviewURL}}, {{.Branch}} and {{.SHA}}
+	Env map[string]string `yaml:"env"`
+
+	Compose ComposeConfig `yaml:"compose"`
+
+	// Services are database sidecars started next to the app for each preview
+	Services []ServiceConfig `yaml:"services"`
+
+	Network NetworkConfig `yaml:"network"`
+
+	Jobs JobsConfig `yaml:"jobs"`
+}
+
+// JobsConfig declares commands run around each deploy
+type JobsConfig struct {
+	// Predeploy jobs run after the sidecars are ready and before the app starts
+	Predeploy []JobConfig `yaml:"predeploy"`
+	// Postdeploy jobs run once the app accepts connections
+	Postdeploy []JobConfig `yaml:"postdeploy"`
+}
+
+// JobConfig is a single predeploy or postdeploy job
+type JobConfig struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+	// Image runs the job in a one-shot container of another image instead of the preview image
+	Image string `yaml:"image"`
+	// Exec runs the job inside the running app container (postdeploy only)
+	Exec bool `yaml:"exec"`
+	// Timeout defaults to 10 minutes
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// NetworkConfig controls the preview's network access
+type NetworkConfig struct {
+	// Egress is open or none; none cuts the preview off from everything but its own services and the proxy
+	Egress string `yaml:"egress"`
+}
+
+// ComposeConfig runs a multi-service preview from a compose file in the repository
+type ComposeConfig struct {
+	// File is the compose file path relative to the repository root
+	File string `yaml:"file"`
+	// Public services are routed through Traefik; the first one gets the preview domain
+	Public []string `yaml:"public"`
+}
+
+// BuildConfig controls how the preview image is built
+type BuildConfig struct {
+	// Dockerfile path relative to the repository root
+	Dockerfile string `yaml:"dockerfile"`
+
+	// Detector forces a language detector (go, node, python, static) even if a Dockerfile exists
+	Detector string `yaml:"detector"`
+
+	// Per-detector overrides
+	Go     DetectorConfig `yaml:"go"`
+	Node   DetectorConfig `yaml:"node"`
+	Python DetectorConfig `yaml:"python"`
+	Static DetectorConfig `yaml:"static"`
+}
+
+// DetectorConfig overrides the defaults of a language detector
+type DetectorConfig struct {
+	Version string `yaml:"version"`
+	Install string `yaml:"install"`
+	Build   string `yaml:"build"`
+	Start   string `yaml:"start"`
+	// Dir is the Go main package for go, or the output directory for static
+	Dir string `yaml:"dir"`
+}
+
+// Resources overrides the controller's default container limits and hardening
+type Resources struct {
+	Memory          string   `yaml:"memory"`
+	CPUs            float64  `yaml:"cpus"`
+	Pids            int64    `yaml:"pids"`
+	NoNewPrivileges *bool    `yaml:"no_new_privileges"`
+	CapDrop         []string `yaml:"cap_drop"`
+	ReadOnly        *bool    `yaml:"read_only"`
+	Tmpfs           []string `yaml:"tmpfs"`
+	Ulimits         []string `yaml:"ulimits"`
+}
+
+// ServiceConfig declares a sidecar the app depends on
+type ServiceConfig struct {
+	// Name is the hostname of the sidecar and the prefix of its env vars, e.g. database -> DATABASE_URL
+	Name string `yaml:"name"`
+	// Type is postgres, mysql or redis
+	Type    string `yaml:"type"`
+	Version string `yaml:"version"`
+	// Seed files are loaded with the sidecar's client, in order
+	Seed []string `yaml:"seed"`
+	// Commands run inside the sidecar after seeding
+	Commands []string `yaml:"commands"`
+}
+
+// Load reads the manifest from the repository root, returning an empty manifest if none exists
+func Load(repoPath string) (*Manifest, error) {
+	m := &Manifest{}
+
+	for _, name := range FileNames {
+		data, err := os.ReadFile(filepath.Join(repoPath, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %s: %w", name, err)
+		}
+
+		if err := yaml.Unmarshal(data, m); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s: %w", name, err)
+		}
+
+		return m, nil
+	}
+
+	return m, nil
+}
+
+// DetectorConfig returns the overrides for the named detector
+func (b *BuildConfig) DetectorConfig(name string) DetectorConfig {
+	switch name {
+	case "go":
+		return b.Go
+	case "node":
+		return b.Node
+	case "python":
+		return b.Python
+	case "static":
+		return b.Static
+	default:
+		return DetectorConfig{}
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// metric is a counter or gauge, optionally split by the values of one label
+type metric struct {
+	name  string
+	help  string
+	kind  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+func register(name, help, kind, label string) *metric {
+	m := &metric{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+
+	return m
+}
+
+func (m *metric) add(labelValue string, delta float64) {
+	m.mu.Lock()
+	m.values[labelValue] += delta
+	m.mu.Unlock()
+}
+
+func (m *metric) set(labelValue string, value float64) {
+	m.mu.Lock()
+	m.values[labelValue] = value
+	m.mu.Unlock()
+}
+
+// Counter only goes up
+type Counter struct{ m *metric }
+
+// NewCounter registers a counter
+func NewCounter(name, help string) *Counter {
+	return &Counter{register(name, help, "counter", "")}
+}
+
+func (c *Counter) Add(delta float64) { c.m.add("", delta) }
+func (c *Counter) Inc()              { c.m.add("", 1) }
+
+// CounterVec is a counter split by the values of a label
+type CounterVec struct{ m *metric }
+
+// NewCounterVec registers a counter with one label
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{register(name, help, "counter", label)}
+}
+
+func (c *CounterVec) Add(labelValue string, delta float64) { c.m.add(labelValue, delta) }
+
+// Gauge goes up and down
+type Gauge struct{ m *metric }
+
+// NewGauge registers a gauge
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{register(name, help, "gauge", "")}
+}
+
+func (g *Gauge) Set(value float64) { g.m.set("", value) }
+func (g *Gauge) Add(delta float64) { g.m.add("", delta) }
+
+// GaugeVec is a gauge split by the values of a label
+type GaugeVec struct{ m *metric }
+
+// NewGaugeVec registers a gauge with one label
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	return &GaugeVec{register(name, help, "gauge", label)}
+}
+
+func (g *GaugeVec) Set(labelValue string, value float64) { g.m.set(labelValue, value) }
+
+// WriteTo writes every metric in the Prometheus text format
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	metrics := append([]*metric(nil), registry...)
+	registryMu.Unlock()
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		m.mu.Lock()
+		labelValues := make([]string, 0, len(m.values))
+		for labelValue := range m.values {
+			labelValues = append(labelValues, labelValue)
+		}
+		sort.Strings(labelValues)
+
+		if m.label == "" && len(labelValues) == 0 {
+			fmt.Fprintf(w, "%s 0\n", m.name)
+		}
+		for _, labelValue := range labelValues {
+			if m.label == "" {
+				fmt.Fprintf(w, "%s %g\n", m.name, m.values[labelValue])
+			} else {
+				fmt.Fprintf(w, "%s{%s=%q} %g\n", m.name, m.label, labelValue, m.values[labelValue])
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Handler serves the metrics for Prometheus
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteTo(w)
+	})
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 
 	"github.com/google/go-github/v55/github"
+	"github.com/karindrlainux/flying-cup/pkg/secrets"
 	"github.com/karindrlainux/flying-cup/pkg/webhook"
 )
 
 type GithubNotifier struct {
 	client *github.Client
+	masker secrets.Masker
 }
 
 func NewGithubNotifier(token string) *GithubNotifier {
@@ -17,8 +19,16 @@ func NewGithubNotifier(token string) *GithubNotifier {
 	}
 }
 
+// SetMasker masks secret values in every comment posted
+func (g *GithubNotifier) SetMasker(masker secrets.Masker) {
+	g.masker = masker
+}
+
 func (g *GithubNotifier) CreateCommentPR(ctx context.Context, webhook *webhook.GithubPRWebhook, comment string) error {
-	
+	if g.masker != nil {
+		comment = g.masker.Mask(comment)
+	}
+
 	prComment := &github.IssueComment{
 		Body: &comment,
 	}
@@ -0,0 +1,106 @@
+package providers
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/sidecar"
+)
+
+// A redeploy starts the new release next to the live one, under the other color, routes
+// the preview to it once it is ready, and then removes the live one
+const (
+	colorBlue  = "blue"
+	colorGreen = "green"
+)
+
+// routeSwitchDelay lets Traefik load the route of a new release before the previous one goes
+const routeSwitchDelay = 5 * time.Second
+
+// liveApps returns the app containers of a deployment, running or not
+func liveApps(ctx context.Context, cli *client.Client, deploymentKey string) ([]container.Summary, error) {
+	containers, err := deploymentContainers(ctx, cli, deploymentKey, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var apps []container.Summary
+	for _, c := range containers {
+		if c.Labels["flying-cup.domain"] != "" {
+			apps = append(apps, c)
+		}
+	}
+	return apps, nil
+}
+
+// releaseName names the app container of the next release, with the color the live
+// release does not use
+func releaseName(codeName string, live []container.Summary) string {
+	color := colorBlue
+	for _, c := range live {
+		if strings.TrimPrefix(firstName(c.Names), "/") == codeName+"-"+colorBlue {
+			color = colorGreen
+		}
+	}
+	return codeName + "-" + color
+}
+
+// retire removes app containers replaced by a new release, with their sidecars
+func (t *TraefikProvider) retire(ctx context.Context, runner *docker.DockerRunner, apps []container.Summary) {
+	for _, c := range apps {
+		name := strings.TrimPrefix(firstName(c.Names), "/")
+		log.Printf("🔵 Retiring previous release %s", name)
+
+		if err := runner.StopAndRemoveContainer(ctx, c.ID); err != nil {
+			log.Printf("Warning: failed to remove container %s: %v", name, err)
+		}
+		if err := sidecar.Remove(ctx, runner, name); err != nil {
+			log.Printf("Warning: failed to remove the sidecars of %s: %v", name, err)
+		}
+	}
+}
+
+// discard removes a release that failed to come up, leaving the live one serving
+func (t *TraefikProvider) discard(ctx context.Context, runner *docker.DockerRunner, name string) {
+	log.Printf("🟢 Discarding failed release %s", name)
+
+	if err := runner.RemoveContainerByName(ctx, name); err != nil {
+		log.Printf("Warning: failed to remove container %s: %v", name, err)
+	}
+	if err := sidecar.Remove(ctx, runner, name); err != nil {
+		log.Printf("Warning: failed to remove the sidecars of %s: %v", name, err)
+	}
+}
+
+// keepPrevious tracks the previous deployment of a pull request again after a failed
+// redeploy, if its container is still there to serve the preview
+func (t *TraefikProvider) keepPrevious(ctx context.Context, deploymentKey string, previous *TraefikDeployment) bool {
+	if previous == nil || previous.Project != "" || previous.ContainerID == "" {
+		return false
+	}
+	if previous.Phase != PhaseReady && previous.Phase != PhaseSleeping {
+		return false
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return false
+	}
+	defer cli.Close()
+
+	if _, err := cli.ContainerInspect(ctx, previous.ContainerID); err != nil {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deployments[deploymentKey] = previous
+	log.Printf("🔵 Previous release %s of %s keeps serving", shortSHA(previous.SHA), deploymentKey)
+	return true
+}
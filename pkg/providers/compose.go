@@ -0,0 +1,109 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/karindrlainux/flying-cup/pkg/compose"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/git"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// runComposeStack brings up the repository's compose file as a preview and returns
+// the container ID of the first public service
+func (t *TraefikProvider) runComposeStack(ctx context.Context, cli *client.Client, webhook *webhook.GithubPRWebhook, appManifest *manifest.Manifest, repoPath, project, domain string, env []string, limits docker.ContainerLimits, egress string) (string, error) {
+	// The compose file and build contexts are resolved against the repository root with its
+	// symlinks resolved, so none can lead outside the clone
+	root, err := git.ResolvePath(repoPath, ".")
+	if err != nil {
+		return "", err
+	}
+	composePath, err := git.ResolvePath(root, appManifest.Compose.File)
+	if err != nil {
+		return "", fmt.Errorf("invalid compose file: %w", err)
+	}
+
+	file, err := compose.Load(composePath)
+	if err != nil {
+		return "", err
+	}
+
+	public := appManifest.Compose.Public
+	if len(public) == 0 {
+		return "", fmt.Errorf("compose previews need at least one public service in the manifest")
+	}
+
+	deploymentKey := deploymentKeyFor(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
+	project = strings.ToLower(project)
+
+	t.mu.Lock()
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Project = project
+	}
+	t.mu.Unlock()
+
+	stack := &compose.Stack{
+		Runner:  &docker.DockerRunner{Client: cli},
+		Builder: t.builder,
+		Project: project,
+	}
+
+	labels := t.generateMetadataLabels(webhook)
+	for key, value := range limits.Labels() {
+		labels[key] = value
+	}
+
+	// Services only join the stack network, which the proxy joins to route to the public ones.
+	// It reaches the outside unless egress is restricted.
+	internal := egress == EgressNone
+	routeNetwork := stack.NetworkName()
+
+	containers, err := stack.Up(ctx, compose.UpOptions{
+		File:     file,
+		Dir:      filepath.Dir(composePath),
+		Root:     root,
+		Public:   public,
+		Internal: internal,
+		PublicLabels: func(service, port string) map[string]string {
+			// The first public service gets the preview domain, the others a service-prefixed one
+			serviceDomain := domain
+			if service != public[0] {
+				serviceDomain = fmt.Sprintf("%s-%s", service, domain)
+			}
+			router := t.routeName(codeNameFor(webhook.Repository.Name, webhook.Number) + "-" + service)
+			return t.generateTraefikLabels(webhook, router, serviceDomain, port, routeNetwork)
+		},
+		Labels:      labels,
+		Env:         env,
+		Limits:      limits,
+		DefaultPort: defaultContainerPort,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to start compose stack: %w", err)
+	}
+
+	if err := t.connectProxy(ctx, stack.Runner, stack.NetworkName()); err != nil {
+		stack.Down(context.WithoutCancel(ctx))
+		return "", err
+	}
+
+	log.Printf("Compose stack %s started for PR #%d", project, webhook.Number)
+	return containers[public[0]], nil
+}
+
+// removeComposeStack removes every container, network and volume of a compose preview
+func (t *TraefikProvider) removeComposeStack(ctx context.Context, project string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+
+	stack := &compose.Stack{Runner: &docker.DockerRunner{Client: cli}, Project: project}
+	return stack.Down(ctx)
+}
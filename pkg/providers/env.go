@@ -0,0 +1,81 @@
+package providers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// EnvTemplateData holds the values available to templated environment variables
+type EnvTemplateData struct {
+	PreviewURL string
+	Branch     string
+	SHA        string
+	Repo       string
+	PR         int
+}
+
+// resolveEnv merges the manifest env, the controller's per-repo env and the repo secrets,
+// in increasing order of precedence. Manifest and config values are rendered as templates.
+func (t *TraefikProvider) resolveEnv(webhook *webhook.GithubPRWebhook, appManifest *manifest.Manifest, previewURL string) ([]string, error) {
+	data := EnvTemplateData{
+		PreviewURL: previewURL,
+		Branch:     webhook.PullRequest.Head.Ref,
+		SHA:        webhook.PullRequest.Head.Sha,
+		Repo:       webhook.Repository.Name,
+		PR:         webhook.Number,
+	}
+
+	env := make(map[string]string)
+
+	for _, values := range []map[string]string{appManifest.Env, t.config.RepoEnv[webhook.Repository.Name]} {
+		for key, value := range values {
+			rendered, err := renderEnvValue(key, value, data)
+			if err != nil {
+				return nil, err
+			}
+			env[key] = rendered
+		}
+	}
+
+	if t.config.Secrets != nil {
+		for key, value := range t.config.Secrets.Get(webhook.Repository.Name) {
+			env[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(env))
+	for key := range env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+env[key])
+	}
+
+	return pairs, nil
+}
+
+func renderEnvValue(key, value string, data EnvTemplateData) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+
+	tmpl, err := template.New(key).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid template for env %s: %w", key, err)
+	}
+
+	var rendered strings.Builder
+	if err := tmpl.Execute(&rendered, data); err != nil {
+		return "", fmt.Errorf("failed to render env %s: %w", key, err)
+	}
+
+	return rendered.String(), nil
+}
@@ -0,0 +1,328 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/metrics"
+)
+
+var (
+	gcRemoved = metrics.NewCounterVec("flying_cup_gc_removed_total", "Orphaned resources removed by the garbage collector", "kind")
+	gcOrphans = metrics.NewGaugeVec("flying_cup_gc_orphans", "Orphaned resources found by the last garbage collection", "kind")
+	gcRuns    = metrics.NewCounter("flying_cup_gc_runs_total", "Garbage collection runs")
+	gcErrors  = metrics.NewCounter("flying_cup_gc_errors_total", "Orphaned resources the garbage collector failed to remove")
+)
+
+// GCReport lists the orphaned resources found by a garbage collection
+type GCReport struct {
+	DryRun      bool     `json:"dry_run"`
+	Containers  []string `json:"containers"`
+	Networks    []string `json:"networks"`
+	Volumes     []string `json:"volumes"`
+	Images      []string `json:"images"`
+	Directories []string `json:"directories"`
+	Routes      []string `json:"routes"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
+// GarbageCollector is implemented by providers that can remove orphaned resources
+type GarbageCollector interface {
+	// CollectGarbage removes resources orphaned for longer than grace, or only reports them with dryRun
+	CollectGarbage(ctx context.Context, grace time.Duration, dryRun bool) (*GCReport, error)
+}
+
+// RunGarbageCollector collects garbage every interval until ctx is done
+func RunGarbageCollector(ctx context.Context, collector GarbageCollector, interval, grace time.Duration, dryRun bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if _, err := collector.CollectGarbage(ctx, grace, dryRun); err != nil {
+			log.Printf("Warning: garbage collection failed: %v", err)
+		}
+	}
+}
+
+// CollectGarbage compares the flying-cup Docker resources and clone directories with the
+// tracked deployments. Resources of deployments that are neither tracked nor running, and
+// unused images built by the controller, are removed once older than grace.
+func (t *TraefikProvider) CollectGarbage(ctx context.Context, grace time.Duration, dryRun bool) (*GCReport, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	report := &GCReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-grace)
+	gcRuns.Inc()
+
+	// Deployments are alive while tracked and not failed, or while any of their containers runs
+	t.mu.Lock()
+	tracked := make(map[string]bool)
+	inUseImages := make(map[string]bool)
+	aliveCodeNames := make(map[string]bool)
+	for key, deployment := range t.deployments {
+		if deployment.Phase == PhaseFailed {
+			continue
+		}
+		tracked[key] = true
+		inUseImages[deployment.Image] = true
+		if deployment.Webhook != nil {
+			// Deploys in progress may not have recorded their image yet
+			codeName := codeNameFor(deployment.Webhook.Repository.Name, deployment.Webhook.Number)
+			aliveCodeNames[codeName] = true
+			inUseImages[codeName+":latest"] = true
+		}
+	}
+	t.mu.Unlock()
+
+	alive := make(map[string]bool)
+	for key := range tracked {
+		alive[key] = true
+	}
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", "flying-cup.deployment")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, c := range containers {
+		if c.State == "running" || c.State == "restarting" {
+			alive[c.Labels["flying-cup.deployment"]] = true
+		}
+	}
+	for _, c := range containers {
+		if alive[c.Labels["flying-cup.deployment"]] {
+			aliveCodeNames[codeNameForLabels(c.Labels)] = true
+		}
+	}
+
+	remove := func(kind, name string, created time.Time, removeFn func() error) {
+		if created.After(cutoff) {
+			return
+		}
+
+		switch kind {
+		case "container":
+			report.Containers = append(report.Containers, name)
+		case "network":
+			report.Networks = append(report.Networks, name)
+		case "volume":
+			report.Volumes = append(report.Volumes, name)
+		case "image":
+			report.Images = append(report.Images, name)
+		case "directory":
+			report.Directories = append(report.Directories, name)
+		case "route":
+			report.Routes = append(report.Routes, name)
+		}
+
+		if dryRun {
+			log.Printf("🗑️  [dry run] Would remove orphaned %s %s", kind, name)
+			return
+		}
+
+		if err := removeFn(); err != nil {
+			gcErrors.Inc()
+			report.Errors = append(report.Errors, fmt.Sprintf("%s %s: %v", kind, name, err))
+			return
+		}
+		gcRemoved.Add(kind, 1)
+		log.Printf("🗑️  Removed orphaned %s %s", kind, name)
+	}
+
+	// Containers of dead deployments, and exited containers nothing tracks, e.g. half-created ones
+	for _, c := range containers {
+		deploymentKey := c.Labels["flying-cup.deployment"]
+		if alive[deploymentKey] && (tracked[deploymentKey] || c.State == "running" || c.State == "restarting") {
+			continue
+		}
+
+		id := c.ID
+		remove("container", strings.TrimPrefix(firstName(c.Names), "/"), time.Unix(c.Created, 0), func() error {
+			return cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true, RemoveVolumes: true})
+		})
+	}
+
+	labelFilter := filters.NewArgs(filters.Arg("label", "flying-cup.deployment"))
+
+	networks, err := cli.NetworkList(ctx, network.ListOptions{Filters: labelFilter})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	runner := &docker.DockerRunner{Client: cli}
+	for _, n := range networks {
+		if alive[n.Labels["flying-cup.deployment"]] {
+			continue
+		}
+
+		id := n.ID
+		remove("network", n.Name, n.Created, func() error {
+			return runner.RemoveNetwork(ctx, id)
+		})
+	}
+
+	volumes, err := cli.VolumeList(ctx, volume.ListOptions{Filters: labelFilter})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+	for _, v := range volumes.Volumes {
+		if alive[v.Labels["flying-cup.deployment"]] {
+			continue
+		}
+
+		created, _ := time.Parse(time.RFC3339, v.CreatedAt)
+		name := v.Name
+		remove("volume", name, created, func() error {
+			return cli.VolumeRemove(ctx, name, true)
+		})
+	}
+
+	// Images built by the controller that no container and no tracked deployment uses,
+	// except the commit images kept for rollbacks of live previews
+	allContainers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	for _, c := range allContainers {
+		inUseImages[c.ImageID] = true
+		inUseImages[c.Image] = true
+	}
+
+	images, err := cli.ImageList(ctx, image.ListOptions{Filters: filters.NewArgs(filters.Arg("label", docker.ManagedLabel))})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+	for _, img := range images {
+		if inUseImages[img.ID] || anyInUse(inUseImages, img.RepoTags) || anyRelease(aliveCodeNames, img.RepoTags) {
+			continue
+		}
+
+		name := img.ID
+		if len(img.RepoTags) > 0 {
+			name = img.RepoTags[0]
+		}
+		id := img.ID
+		remove("image", name, time.Unix(img.Created, 0), func() error {
+			_, err := cli.ImageRemove(ctx, id, image.RemoveOptions{Force: true, PruneChildren: true})
+			return err
+		})
+	}
+
+	// Clones of previews that are neither tracked nor running
+	entries, err := os.ReadDir(reposDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", reposDir, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "pr-") || aliveCodeNames[entry.Name()] {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(reposDir, entry.Name())
+		remove("directory", path, info.ModTime(), func() error {
+			return os.RemoveAll(path)
+		})
+	}
+
+	// Routes of previews that are neither tracked nor running, and probe routes left by an
+	// interrupted deploy
+	routes, err := os.ReadDir(t.config.RoutesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read %s: %w", t.config.RoutesDir, err)
+	}
+	aliveRoutes := make(map[string]bool)
+	for codeName := range aliveCodeNames {
+		aliveRoutes[t.routeName(codeName)] = true
+	}
+	for _, entry := range routes {
+		routeName, candidate, ok := routeDeployment(entry.Name())
+		if !ok || (aliveRoutes[routeName] && !candidate) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		path := filepath.Join(t.config.RoutesDir, entry.Name())
+		remove("route", path, info.ModTime(), func() error {
+			return os.Remove(path)
+		})
+	}
+
+	gcOrphans.Set("container", float64(len(report.Containers)))
+	gcOrphans.Set("network", float64(len(report.Networks)))
+	gcOrphans.Set("volume", float64(len(report.Volumes)))
+	gcOrphans.Set("image", float64(len(report.Images)))
+	gcOrphans.Set("directory", float64(len(report.Directories)))
+	gcOrphans.Set("route", float64(len(report.Routes)))
+
+	total := len(report.Containers) + len(report.Networks) + len(report.Volumes) + len(report.Images) + len(report.Directories) + len(report.Routes)
+	if total > 0 {
+		log.Printf("Garbage collection found %d orphaned resources (dry run: %t, errors: %d)", total, dryRun, len(report.Errors))
+	}
+
+	return report, nil
+}
+
+// codeNameForLabels returns the code name of a container from its flying-cup labels
+func codeNameForLabels(labels map[string]string) string {
+	return "pr-" + labels["flying-cup.repo"] + "-" + labels["flying-cup.pr"]
+}
+
+func firstName(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+func anyInUse(inUse map[string]bool, tags []string) bool {
+	for _, tag := range tags {
+		if inUse[tag] {
+			return true
+		}
+	}
+	return false
+}
+
+// anyRelease reports whether a tag is a commit image of a live preview
+func anyRelease(aliveCodeNames map[string]bool, tags []string) bool {
+	for _, tag := range tags {
+		codeName, _, _ := strings.Cut(tag, ":")
+		if aliveCodeNames[codeName] && isReleaseTag(codeName, tag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,193 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/sidecar"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// Statuses of deployed previews reported by the Docker events stream
+const (
+	StatusRunning   = "running"
+	StatusCrashed   = "crashed"
+	StatusOOMKilled = "oom-killed"
+	StatusUnhealthy = "unhealthy"
+)
+
+// healthLogLines is how many log lines are attached to crash notifications
+const healthLogLines = 30
+
+// HealthEvent reports a preview that crashed, was OOM killed or failed its health check
+type HealthEvent struct {
+	Webhook      *webhook.GithubPRWebhook
+	DeploymentID string
+	// Container is the name of the container that went unhealthy
+	Container string
+	Status    string
+	ExitCode  int
+	Restarts  int
+	// Logs holds the final log lines of the container
+	Logs string
+}
+
+// HealthWatcher is implemented by providers that detect crashing previews
+type HealthWatcher interface {
+	// WatchHealth follows the previews until ctx is done, calling onUnhealthy
+	// the first time a deployment goes unhealthy
+	WatchHealth(ctx context.Context, onUnhealthy func(context.Context, HealthEvent))
+}
+
+// WatchHealth subscribes to the Docker events of flying-cup containers, tracking
+// restarts, OOM kills and exits. It reconnects until ctx is done.
+func (t *TraefikProvider) WatchHealth(ctx context.Context, onUnhealthy func(context.Context, HealthEvent)) {
+	for {
+		if err := t.watchEvents(ctx, onUnhealthy); err != nil && ctx.Err() == nil {
+			log.Printf("Warning: Docker events stream failed, reconnecting: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (t *TraefikProvider) watchEvents(ctx context.Context, onUnhealthy func(context.Context, HealthEvent)) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	runner := &docker.DockerRunner{Client: cli}
+
+	messages, errs := cli.Events(ctx, events.ListOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", string(events.ContainerEventType)),
+			filters.Arg("label", "flying-cup.deployment"),
+		),
+	})
+
+	log.Printf("👀 Watching preview containers for crashes")
+
+	for {
+		select {
+		case message := <-messages:
+			event, unhealthy := t.handleContainerEvent(message)
+			if !unhealthy {
+				continue
+			}
+
+			logs, err := runner.TailLogs(ctx, message.Actor.ID, healthLogLines)
+			if err != nil {
+				log.Printf("Warning: %v", err)
+			}
+			event.Logs = strings.TrimRight(logs, "\n")
+
+			onUnhealthy(ctx, event)
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// serves reports whether a container is the app or a sidecar of the live release. Compose
+// previews have a single release, so all their containers count.
+func (d *TraefikDeployment) serves(containerID string, labels map[string]string) bool {
+	if d.Project != "" {
+		return true
+	}
+	if containerID == d.ContainerID {
+		return true
+	}
+	return d.Release != "" && labels[sidecar.OwnerLabel] == d.Release
+}
+
+// handleContainerEvent updates the deployment a container event belongs to, and returns
+// an event to report if the deployment just went unhealthy
+func (t *TraefikProvider) handleContainerEvent(message events.Message) (HealthEvent, bool) {
+	attributes := message.Actor.Attributes
+
+	// Job containers are expected to exit
+	if _, isJob := attributes["flying-cup.job"]; isJob {
+		return HealthEvent{}, false
+	}
+
+	var status string
+	switch {
+	case message.Action == events.ActionOOM:
+		status = StatusOOMKilled
+	case message.Action == events.ActionDie:
+		status = StatusCrashed
+	case message.Action == events.ActionStart, strings.HasPrefix(string(message.Action), "health_status: healthy"):
+		status = StatusRunning
+	case strings.HasPrefix(string(message.Action), "health_status: unhealthy"):
+		status = StatusUnhealthy
+	default:
+		return HealthEvent{}, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deployment, exists := t.deployments[attributes["flying-cup.deployment"]]
+	// Events of deploys in progress and of removed deployments are expected
+	if !exists || deployment.Phase != PhaseReady {
+		return HealthEvent{}, false
+	}
+
+	// Releases other than the live one come and go during redeploys
+	if !deployment.serves(message.Actor.ID, attributes) {
+		return HealthEvent{}, false
+	}
+
+	switch status {
+	case StatusRunning:
+		if deployment.Status == StatusUnhealthy {
+			deployment.Status = StatusRunning
+			log.Printf("💚 Preview %s is healthy again", deployment.ID)
+		} else if message.Action == events.ActionStart && deployment.Status != StatusRunning {
+			// Started again by the restart policy
+			deployment.Restarts++
+			deployment.Status = StatusRunning
+			log.Printf("🔁 Preview %s restarted (%d restarts)", deployment.ID, deployment.Restarts)
+		}
+		return HealthEvent{}, false
+	case StatusCrashed:
+		deployment.ExitCode, _ = strconv.Atoi(attributes["exitCode"])
+		// The die event follows the oom event, keep the more precise status
+		if deployment.Status != StatusOOMKilled {
+			deployment.Status = StatusCrashed
+		}
+	default:
+		deployment.Status = status
+	}
+
+	log.Printf("💥 Preview %s is %s (container %s, exit code %d)", deployment.ID, deployment.Status, attributes["name"], deployment.ExitCode)
+
+	// Report once per deploy, the die event carries the exit code
+	if deployment.Notified || status == StatusOOMKilled {
+		return HealthEvent{}, false
+	}
+	deployment.Notified = true
+
+	return HealthEvent{
+		Webhook:      deployment.Webhook,
+		DeploymentID: deployment.ID,
+		Container:    attributes["name"],
+		Status:       deployment.Status,
+		ExitCode:     deployment.ExitCode,
+		Restarts:     deployment.Restarts,
+	}, true
+}
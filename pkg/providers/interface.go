@@ -2,7 +2,10 @@ package providers
 
 import (
 	"context"
+	"time"
 
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/secrets"
 	"github.com/karindrlainux/flying-cup/pkg/webhook"
 )
 
@@ -17,8 +20,66 @@ type Provider interface {
 	// Clean up a deployment
 	CleanupDeployment(ctx context.Context, repoName, prName string, prNumber int) error
 
-	// Get deployment status
-	GetDeploymentStatus(ctx context.Context, deploymentID string) (string, error)
+	// Get the live status of a deployment
+	GetDeploymentStatus(ctx context.Context, deploymentID string) (*DeploymentStatus, error)
+
+	// List the deployments matching the filter, including those left by a previous controller run
+	ListDeployments(ctx context.Context, filter DeploymentFilter) ([]*DeploymentStatus, error)
+}
+
+// DeploymentFilter selects deployments; zero fields match everything
+type DeploymentFilter struct {
+	Repo  string
+	PR    int
+	Phase Phase
+}
+
+// Match reports whether a deployment passes the filter
+func (f DeploymentFilter) Match(status *DeploymentStatus) bool {
+	return (f.Repo == "" || f.Repo == status.Repo) &&
+		(f.PR == 0 || f.PR == status.PR) &&
+		(f.Phase == "" || f.Phase == status.Phase)
+}
+
+// Phase is the lifecycle stage of a deployment
+type Phase string
+
+const (
+	PhaseQueued   Phase = "queued"
+	PhaseCloning  Phase = "cloning"
+	PhaseBuilding Phase = "building"
+	PhaseStarting Phase = "starting"
+	PhaseReady    Phase = "ready"
+	PhaseFailed   Phase = "failed"
+	PhaseStopped  Phase = "stopped"
+	// PhaseSleeping previews were stopped for lack of traffic and start again on the next request
+	PhaseSleeping Phase = "sleeping"
+)
+
+// DeploymentStatus is the live state of a deployment and its app container
+type DeploymentStatus struct {
+	ID    string `json:"id"`
+	Repo  string `json:"repo"`
+	PR    int    `json:"pr"`
+	Title string `json:"title"`
+	Phase Phase  `json:"phase"`
+	// Error explains why the deployment failed
+	Error string `json:"error,omitempty"`
+	URL   string `json:"url"`
+	Image string `json:"image"`
+	SHA   string `json:"sha"`
+
+	// ContainerState is the Docker state of the app container, e.g. running or restarting
+	ContainerState string `json:"container_state,omitempty"`
+	// Health is healthy, unhealthy or starting for images with a health check, none otherwise
+	Health       string    `json:"health,omitempty"`
+	RestartCount int       `json:"restart_count"`
+	ExitCode     int       `json:"exit_code"`
+	StartedAt    time.Time `json:"started_at"`
+	// Uptime since the container last started, zero unless it is running
+	Uptime time.Duration `json:"uptime"`
+	// Memory is the memory limit of the running app container in bytes, zero if unlimited or stopped
+	Memory int64 `json:"memory,omitempty"`
 }
 
 // Config holds common configuration for all providers
@@ -26,6 +87,39 @@ type Config struct {
 	Domain      string
 	Port        int
 	Environment string
+
+	// Image builder backend (docker or buildkit) and buildkitd address
+	Builder      string
+	BuildKitHost string
+	BuildLimits  docker.BuildLimits
+
+	// Optional registry preview images are pushed to
+	Registry docker.RegistryConfig
+	// Releases is how many commit images are kept per pull request for rollbacks
+	Releases int
+
+	// Default limits for preview containers, overridable per repository
+	ContainerLimits docker.ContainerLimits
+
+	// ReadyTimeout bounds how long a preview may take to accept connections
+	ReadyTimeout time.Duration
+
+	// ProxyContainer is connected to the private networks of previews
+	ProxyContainer string
+	// RoutesDir is the directory of the Traefik file provider routes are written to
+	RoutesDir string
+	// ProbeURL is the Traefik probe entrypoint new releases are checked through before
+	// they are routed, or empty to probe their port directly
+	ProbeURL string
+	// Egress is the default outbound access of previews, open or none
+	Egress string
+
+	// DataDir holds the provider's persistent state, e.g. the sleeping previews
+	DataDir string
+
+	// Per-repository environment variables and secrets injected into previews
+	RepoEnv map[string]map[string]string
+	Secrets *secrets.Store
 }
 
 // Type defines supported deployment providers
@@ -0,0 +1,184 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+const (
+	JobPhasePredeploy  = "predeploy"
+	JobPhasePostdeploy = "postdeploy"
+)
+
+// defaultJobTimeout applies to jobs without a timeout in the manifest
+const defaultJobTimeout = 10 * time.Minute
+
+// jobOutputLines is how much of a job's output is kept for notifications
+const jobOutputLines = 50
+
+// JobResult is the outcome of a predeploy or postdeploy job
+type JobResult struct {
+	Phase    string
+	Name     string
+	ExitCode int
+	// Output holds the last lines of the job's combined stdout and stderr
+	Output   string
+	Duration time.Duration
+}
+
+// JobError reports a job that failed, timed out or exited with a non-zero code
+type JobError struct {
+	JobResult
+	Err error
+}
+
+func (e *JobError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s job %s failed: %v", e.Phase, e.Name, e.Err)
+	}
+	return fmt.Sprintf("%s job %s exited with code %d", e.Phase, e.Name, e.ExitCode)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// JobReporter is implemented by providers that run predeploy and postdeploy jobs
+type JobReporter interface {
+	// JobResults returns the jobs run by the last deploy of a pull request
+	JobResults(repoName, prName string, prNumber int) []JobResult
+}
+
+// jobTarget is where the jobs of a preview run
+type jobTarget struct {
+	// Prefix names the one-shot job containers
+	Prefix      string
+	Image       string
+	Networks    []string
+	Env         []string
+	Labels      map[string]string
+	Limits      docker.ContainerLimits
+	ContainerID string
+}
+
+// runJobs runs the jobs of a phase in order, stopping at the first failure
+func (t *TraefikProvider) runJobs(ctx context.Context, runner *docker.DockerRunner, phase string, jobs []manifest.JobConfig, target jobTarget) ([]JobResult, error) {
+	var results []JobResult
+
+	for _, job := range jobs {
+		result, err := runJob(ctx, runner, phase, job, target)
+		results = append(results, result)
+		if err != nil {
+			return results, &JobError{JobResult: result, Err: err}
+		}
+		if result.ExitCode != 0 {
+			return results, &JobError{JobResult: result}
+		}
+	}
+
+	return results, nil
+}
+
+func runJob(ctx context.Context, runner *docker.DockerRunner, phase string, job manifest.JobConfig, target jobTarget) (JobResult, error) {
+	result := JobResult{Phase: phase, Name: job.Name}
+
+	if job.Name == "" || job.Command == "" {
+		return result, fmt.Errorf("jobs need a name and a command")
+	}
+	if job.Exec && (phase != JobPhasePostdeploy || job.Image != "") {
+		return result, fmt.Errorf("exec jobs run inside the app container, so only as postdeploy jobs without an image")
+	}
+
+	timeout := job.Timeout
+	if timeout <= 0 {
+		timeout = defaultJobTimeout
+	}
+
+	jobCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	log.Printf("🔧 Running %s job %s: %s", phase, job.Name, job.Command)
+	start := time.Now()
+
+	cmd := []string{"sh", "-c", job.Command}
+
+	var execResult docker.ExecResult
+	var err error
+	if job.Exec {
+		execResult, err = runner.Exec(jobCtx, target.ContainerID, cmd, target.Env)
+	} else {
+		image := target.Image
+		if job.Image != "" {
+			if err := runner.PullImage(jobCtx, job.Image); err != nil {
+				return result, err
+			}
+			image = job.Image
+		}
+
+		labels := map[string]string{"flying-cup.job": job.Name}
+		for key, value := range target.Labels {
+			labels[key] = value
+		}
+
+		execResult, err = runner.RunJob(jobCtx, docker.JobOptions{
+			Name:     fmt.Sprintf("%s-job-%s", target.Prefix, job.Name),
+			Image:    image,
+			Cmd:      cmd,
+			Env:      target.Env,
+			Networks: target.Networks,
+			Labels:   labels,
+			Limits:   target.Limits,
+		})
+	}
+
+	result.Duration = time.Since(start).Round(time.Second)
+	result.ExitCode = execResult.ExitCode
+	result.Output = tailLines(execResult.Output, jobOutputLines)
+
+	for _, line := range strings.Split(strings.TrimRight(execResult.Output, "\n"), "\n") {
+		if line != "" {
+			log.Printf("[%s] %s", job.Name, line)
+		}
+	}
+
+	if err != nil {
+		if jobCtx.Err() == context.DeadlineExceeded {
+			return result, fmt.Errorf("timed out after %s", timeout)
+		}
+		return result, err
+	}
+
+	if result.ExitCode == 0 {
+		log.Printf("✅ %s job %s finished in %s", phase, job.Name, result.Duration)
+	} else {
+		log.Printf("❌ %s job %s exited with code %d", phase, job.Name, result.ExitCode)
+	}
+	return result, nil
+}
+
+// JobResults returns the jobs run by the last deploy of a pull request
+func (t *TraefikProvider) JobResults(repoName, prName string, prNumber int) []JobResult {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deployment, exists := t.deployments[deploymentKeyFor(repoName, prName, prNumber)]
+	if !exists {
+		return nil
+	}
+	return deployment.Jobs
+}
+
+// tailLines returns the last n lines of s
+func tailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
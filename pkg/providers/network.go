@@ -0,0 +1,77 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+const (
+	// EgressOpen lets previews reach the internet through a network of their own
+	EgressOpen = "open"
+	// EgressNone restricts previews to their private network, shared only with the proxy
+	EgressNone = "none"
+)
+
+// egressFor returns the egress mode of a preview. A repository can only restrict
+// the controller's default, never open it up.
+func (t *TraefikProvider) egressFor(appManifest *manifest.Manifest) (string, error) {
+	egress := t.config.Egress
+	if egress == "" {
+		egress = EgressOpen
+	}
+
+	for _, mode := range []string{egress, appManifest.Network.Egress} {
+		switch mode {
+		case "", EgressOpen, EgressNone:
+		default:
+			return "", fmt.Errorf("invalid egress mode %q (supported: %s, %s)", mode, EgressOpen, EgressNone)
+		}
+	}
+
+	if appManifest.Network.Egress == EgressNone {
+		egress = EgressNone
+	}
+	return egress, nil
+}
+
+// ensurePreviewNetworks creates the networks of a single-container preview and returns those
+// the app and its jobs join, the private one first. The private network is internal and
+// shared by the app, its sidecars and the proxy. With open egress, the app also joins a
+// network of its own that reaches the outside.
+func (t *TraefikProvider) ensurePreviewNetworks(ctx context.Context, runner *docker.DockerRunner, webhook *webhook.GithubPRWebhook, codeName, egress string) ([]string, error) {
+	labels := t.generateMetadataLabels(webhook)
+
+	privateNetwork := codeName + "-net"
+	if _, err := runner.EnsureNetwork(ctx, privateNetwork, labels, true); err != nil {
+		return nil, err
+	}
+	if err := t.connectProxy(ctx, runner, privateNetwork); err != nil {
+		return nil, err
+	}
+
+	if egress == EgressNone {
+		return []string{privateNetwork}, nil
+	}
+
+	egressNetwork := codeName + "-egress"
+	if _, err := runner.EnsureNetwork(ctx, egressNetwork, labels, false); err != nil {
+		return nil, err
+	}
+	return []string{privateNetwork, egressNetwork}, nil
+}
+
+// connectProxy lets Traefik reach a preview network, the only way into previews
+func (t *TraefikProvider) connectProxy(ctx context.Context, runner *docker.DockerRunner, networkName string) error {
+	if t.config.ProxyContainer == "" {
+		return fmt.Errorf("previews need PROXY_CONTAINER to be set, Traefik reaches them over their private network")
+	}
+
+	if err := runner.ConnectNetwork(ctx, networkName, t.config.ProxyContainer); err != nil {
+		return fmt.Errorf("failed to connect proxy to preview network: %w", err)
+	}
+	return nil
+}
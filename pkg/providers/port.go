@@ -0,0 +1,144 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+// defaultContainerPort is used when neither the manifest nor the image name a port
+const defaultContainerPort = "8080"
+
+// manifestPort returns the port set in the manifest, or the default. Generated
+// Dockerfiles are built to listen on it.
+func manifestPort(appManifest *manifest.Manifest) string {
+	if appManifest.Port > 0 {
+		return strconv.Itoa(appManifest.Port)
+	}
+	return defaultContainerPort
+}
+
+// containerPort resolves the port a preview listens on: the manifest, then the
+// port exposed by the image, then the default
+func containerPort(ctx context.Context, runner *docker.DockerRunner, appManifest *manifest.Manifest, imageTag string) (string, error) {
+	if appManifest.Port > 0 {
+		return strconv.Itoa(appManifest.Port), nil
+	}
+
+	port, err := runner.ExposedPort(ctx, imageTag)
+	if err != nil {
+		return "", err
+	}
+	if port == "" {
+		return defaultContainerPort, nil
+	}
+
+	log.Printf("Using port %s exposed by image %s", port, imageTag)
+	return port, nil
+}
+
+// waitForReady waits until a release of a preview answers. With a probe URL, the release gets
+// a route of its own on the unpublished probe entrypoint, so it is checked the way Traefik
+// reaches it without receiving traffic; otherwise its port is probed directly.
+func (t *TraefikProvider) waitForReady(ctx context.Context, runner *docker.DockerRunner, routeName, containerID, release, port string) error {
+	timeout := t.config.ReadyTimeout
+	if timeout <= 0 {
+		timeout = 2 * time.Minute
+	}
+
+	readyCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if t.config.ProbeURL == "" {
+		log.Printf("Waiting for container to listen on port %s...", port)
+
+		err := runner.WaitForPort(readyCtx, containerID, port, time.Second)
+		if errors.Is(err, docker.ErrContainerUnreachable) {
+			log.Printf("Warning: skipping readiness probe, %v", err)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("preview is not ready: %w (set port in the manifest if the app listens on another port)", err)
+		}
+
+		log.Printf("✅ Container is listening on port %s", port)
+		return nil
+	}
+
+	candidate := routeName + candidateSuffix
+	if err := t.writeRoute(candidate, candidateRoute(routeName, release, port)); err != nil {
+		return err
+	}
+	defer func() {
+		if err := t.removeRoute(candidate); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}()
+
+	log.Printf("Waiting for %s to answer on port %s through the proxy...", release, port)
+
+	if err := probeRelease(readyCtx, runner, t.config.ProbeURL, containerID, release, time.Second); err != nil {
+		return fmt.Errorf("preview is not ready: %w (set port in the manifest if the app listens on another port)", err)
+	}
+
+	log.Printf("✅ %s answers on port %s", release, port)
+	return nil
+}
+
+// probeRelease requests probeURL for the host release every interval, until Traefik answers
+// through the probe route of the release with anything but a gateway error. It fails when
+// the container stops or restarts, and when ctx is done.
+func probeRelease(ctx context.Context, runner *docker.DockerRunner, probeURL, containerID, release string, interval time.Duration) error {
+	httpClient := &http.Client{
+		Timeout: 5 * time.Second,
+		// Redirects are an answer of the app
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	last := "no answer"
+	for {
+		info, err := runner.Client.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect container: %w", err)
+		}
+		if info.State != nil && (info.State.Restarting || !info.State.Running) {
+			return fmt.Errorf("container exited with code %d before answering", info.State.ExitCode)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, probeURL, nil)
+		if err != nil {
+			return fmt.Errorf("invalid probe URL %s: %w", probeURL, err)
+		}
+		req.Host = release
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			last = err.Error()
+		} else {
+			resp.Body.Close()
+			last = resp.Status
+
+			// Without the header, Traefik has not loaded the probe route yet
+			if resp.Header.Get(releaseHeader) == release {
+				switch resp.StatusCode {
+				case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+				default:
+					return nil
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not answer through the proxy (last: %s): %w", release, last, ctx.Err())
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+// defaultReleases is how many commit images are kept per pull request when not configured
+const defaultReleases = 5
+
+// ReleaseSpec is what a release runs from, to run it again without its clone
+type ReleaseSpec struct {
+	// Image is used when no local image of the commit is left
+	Image    string
+	Manifest *manifest.Manifest
+	// Port is the container port the app listened on
+	Port string
+}
+
+// ImageDeployer is implemented by providers that can deploy an image built before
+type ImageDeployer interface {
+	// DeployImage runs the head commit of the webhook from a release without cloning or
+	// building it, e.g. to roll back
+	DeployImage(ctx context.Context, webhook *webhook.GithubPRWebhook, release ReleaseSpec) (string, error)
+	// RunningRelease returns the release the ready preview of a pull request runs
+	RunningRelease(repoName, prName string, prNumber int) (ReleaseSpec, bool)
+}
+
+// DeployImage deploys a pull request from the image and manifest of an earlier commit.
+// The branch head is not cloned, so neither its manifest nor its jobs are used.
+func (t *TraefikProvider) DeployImage(ctx context.Context, webhook *webhook.GithubPRWebhook, release ReleaseSpec) (string, error) {
+	if release.Manifest == nil {
+		return "", fmt.Errorf("the manifest of commit %s was not recorded", shortSHA(webhook.PullRequest.Head.Sha))
+	}
+	return t.deploy(ctx, webhook, &release)
+}
+
+// RunningRelease returns the release the ready preview of a pull request runs
+func (t *TraefikProvider) RunningRelease(repoName, prName string, prNumber int) (ReleaseSpec, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deployment, exists := t.deployments[deploymentKeyFor(repoName, prName, prNumber)]
+	if !exists || deployment.Phase != PhaseReady || deployment.Project != "" || deployment.Manifest == nil {
+		return ReleaseSpec{}, false
+	}
+
+	image := deployment.Image
+	if deployment.RegistryImage != "" {
+		image = deployment.RegistryImage
+	}
+	return ReleaseSpec{Image: image, Manifest: deployment.Manifest, Port: deployment.Port}, true
+}
+
+// tagRelease tags a built image with its commit SHA, and removes the commit images of the
+// pull request beyond the retained ones
+func (t *TraefikProvider) tagRelease(ctx context.Context, cli *client.Client, imageTag, codeName, sha string) (string, error) {
+	releaseTag := fmt.Sprintf("%s:%s", codeName, shortSHA(sha))
+	if err := cli.ImageTag(ctx, imageTag, releaseTag); err != nil {
+		return "", fmt.Errorf("failed to tag image %s: %w", releaseTag, err)
+	}
+
+	if err := t.pruneReleases(ctx, cli, codeName); err != nil {
+		log.Printf("Warning: failed to prune the images of %s: %v", codeName, err)
+	}
+	return releaseTag, nil
+}
+
+// pruneReleases keeps the most recent commit images of a pull request
+func (t *TraefikProvider) pruneReleases(ctx context.Context, cli *client.Client, codeName string) error {
+	keep := t.config.Releases
+	if keep <= 0 {
+		keep = defaultReleases
+	}
+
+	images, err := cli.ImageList(ctx, image.ListOptions{Filters: filters.NewArgs(filters.Arg("reference", codeName))})
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Created > images[j].Created })
+
+	kept := 0
+	for _, img := range images {
+		for _, tag := range img.RepoTags {
+			if !isReleaseTag(codeName, tag) {
+				continue
+			}
+			if kept < keep {
+				kept++
+				continue
+			}
+
+			// Untags the image, which is removed with its last tag
+			if _, err := cli.ImageRemove(ctx, tag, image.RemoveOptions{}); err != nil && !errdefs.IsNotFound(err) {
+				log.Printf("Warning: failed to remove image %s: %v", tag, err)
+				continue
+			}
+			log.Printf("Removed image %s beyond the %d retained releases", tag, keep)
+
+			if t.deletesRegistryImages() {
+				if err := t.registry.DeleteImage(ctx, t.registry.ImageRef(codeName, strings.TrimPrefix(tag, codeName+":"))); err != nil {
+					log.Printf("Warning: failed to delete registry image: %v", err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// releaseImage returns the local image of a commit, or pulls fallback if it is gone
+func (t *TraefikProvider) releaseImage(ctx context.Context, runner *docker.DockerRunner, codeName, sha, fallback string) (string, error) {
+	releaseTag := fmt.Sprintf("%s:%s", codeName, shortSHA(sha))
+	if _, err := runner.Client.ImageInspect(ctx, releaseTag); err == nil {
+		return releaseTag, nil
+	} else if !errdefs.IsNotFound(err) {
+		return "", fmt.Errorf("failed to inspect image %s: %w", releaseTag, err)
+	}
+
+	if fallback == "" || fallback == releaseTag {
+		return "", fmt.Errorf("the image of commit %s is no longer available", shortSHA(sha))
+	}
+	if _, err := runner.Client.ImageInspect(ctx, fallback); err == nil {
+		return fallback, nil
+	}
+	if err := runner.PullImage(ctx, fallback); err != nil {
+		return "", fmt.Errorf("the image of commit %s is no longer available: %w", shortSHA(sha), err)
+	}
+	return fallback, nil
+}
+
+// removeReleases removes every local image of a pull request
+func (t *TraefikProvider) removeReleases(ctx context.Context, codeName string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	images, err := cli.ImageList(ctx, image.ListOptions{Filters: filters.NewArgs(filters.Arg("reference", codeName))})
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	for _, img := range images {
+		if _, err := cli.ImageRemove(ctx, img.ID, image.RemoveOptions{Force: true, PruneChildren: true}); err != nil && !errdefs.IsNotFound(err) {
+			log.Printf("Warning: failed to remove image %s: %v", firstName(img.RepoTags), err)
+		}
+	}
+	return nil
+}
+
+// deletesRegistryImages reports whether pushed images are deleted with their preview
+func (t *TraefikProvider) deletesRegistryImages() bool {
+	return t.registry != nil && t.config.Registry.DeleteOnCleanup
+}
+
+// deleteRegistryReleases deletes every commit image pushed for a pull request, including
+// those of earlier deploys
+func (t *TraefikProvider) deleteRegistryReleases(ctx context.Context, codeName string) error {
+	tags, err := t.registry.Tags(ctx, codeName)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if err := t.registry.DeleteImage(ctx, t.registry.ImageRef(codeName, tag)); err != nil {
+			log.Printf("Warning: failed to delete registry image: %v", err)
+		}
+	}
+	return nil
+}
+
+// isReleaseTag reports whether tag is a commit image of the preview named codeName
+func isReleaseTag(codeName, tag string) bool {
+	version, found := strings.CutPrefix(tag, codeName+":")
+	return found && version != "latest"
+}
@@ -0,0 +1,163 @@
+package providers
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Single-image previews are routed by files of the Traefik file provider instead of container
+// labels, so a release only receives traffic once the controller writes its route, after its
+// checks passed. Compose previews keep their labels.
+
+const (
+	// probeEntrypoint is the unpublished Traefik entrypoint new releases are probed on
+	probeEntrypoint = "probe"
+	// releaseHeader is added to the responses of the probe route, telling the controller
+	// that Traefik loaded the route and reached the release through it
+	releaseHeader = "X-Flying-Cup-Release"
+	// candidateSuffix names the probe route of a release that is not serving yet
+	candidateSuffix = "-candidate"
+)
+
+// routeConfig is the dynamic configuration read by the Traefik file provider
+type routeConfig struct {
+	HTTP routeHTTP `yaml:"http"`
+}
+
+type routeHTTP struct {
+	Routers     map[string]routeRouter     `yaml:"routers"`
+	Middlewares map[string]routeMiddleware `yaml:"middlewares,omitempty"`
+	Services    map[string]routeService    `yaml:"services"`
+}
+
+type routeRouter struct {
+	Rule        string   `yaml:"rule"`
+	EntryPoints []string `yaml:"entryPoints"`
+	Service     string   `yaml:"service"`
+	Middlewares []string `yaml:"middlewares,omitempty"`
+}
+
+type routeMiddleware struct {
+	Headers struct {
+		CustomResponseHeaders map[string]string `yaml:"customResponseHeaders"`
+	} `yaml:"headers"`
+}
+
+type routeService struct {
+	LoadBalancer struct {
+		Servers []routeServer `yaml:"servers"`
+	} `yaml:"loadBalancer"`
+}
+
+type routeServer struct {
+	URL string `yaml:"url"`
+}
+
+// routeName returns the name of the route files, routers and services of the preview named
+// codeName. Unlike the deployment key it does not contain the PR title.
+func (t *TraefikProvider) routeName(codeName string) string {
+	return t.sanitizeForDomain(codeName)
+}
+
+// deploymentRoute returns the route name of a tracked deployment
+func (t *TraefikProvider) deploymentRoute(deployment *TraefikDeployment) string {
+	return t.routeName(codeNameFor(deployment.Webhook.Repository.Name, deployment.Webhook.Number))
+}
+
+// liveRoute routes domain to the app container named release
+func liveRoute(name, domain, release, port string) routeConfig {
+	return singleRoute(name, fmt.Sprintf("Host(`%s`)", domain), "web", release, port, nil)
+}
+
+// candidateRoute routes requests for the host release, on the probe entrypoint only, to the
+// app container of that name, marking the responses with releaseHeader
+func candidateRoute(routeName, release, port string) routeConfig {
+	name := routeName + candidateSuffix
+
+	var marker routeMiddleware
+	marker.Headers.CustomResponseHeaders = map[string]string{releaseHeader: release}
+
+	return singleRoute(name, fmt.Sprintf("Host(`%s`)", release), probeEntrypoint, release, port, map[string]routeMiddleware{name: marker})
+}
+
+// singleRoute builds a router and a service of the same name, reaching the container by name
+func singleRoute(name, rule, entrypoint, release, port string, middlewares map[string]routeMiddleware) routeConfig {
+	var service routeService
+	service.LoadBalancer.Servers = []routeServer{{URL: fmt.Sprintf("http://%s:%s", release, port)}}
+
+	router := routeRouter{Rule: rule, EntryPoints: []string{entrypoint}, Service: name}
+	for middleware := range middlewares {
+		router.Middlewares = append(router.Middlewares, middleware)
+	}
+
+	return routeConfig{HTTP: routeHTTP{
+		Routers:     map[string]routeRouter{name: router},
+		Middlewares: middlewares,
+		Services:    map[string]routeService{name: service},
+	}}
+}
+
+// routePath returns the file the route name is written to, refusing names that would
+// leave the routes directory
+func (t *TraefikProvider) routePath(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid route name %q", name)
+	}
+	return filepath.Join(t.config.RoutesDir, name+".yml"), nil
+}
+
+// writeRoute replaces the route file name, renaming it into place so Traefik never reads
+// a partial file
+func (t *TraefikProvider) writeRoute(name string, route routeConfig) error {
+	path, err := t.routePath(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := yaml.Marshal(route)
+	if err != nil {
+		return fmt.Errorf("failed to encode route %s: %w", name, err)
+	}
+
+	if err := os.MkdirAll(t.config.RoutesDir, 0755); err != nil {
+		return fmt.Errorf("failed to create routes directory: %w", err)
+	}
+
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to write route %s: %w", name, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write route %s: %w", name, err)
+	}
+	return nil
+}
+
+// removeRoute removes the route file name if it exists
+func (t *TraefikProvider) removeRoute(name string) error {
+	path, err := t.routePath(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove route %s: %w", name, err)
+	}
+	return nil
+}
+
+// routeDeployment returns the route name of the preview a route file belongs to, and whether
+// it is the probe route of a release that is not serving yet
+func routeDeployment(fileName string) (string, bool, bool) {
+	name, found := strings.CutSuffix(fileName, ".yml")
+	if !found {
+		return "", false, false
+	}
+	if routeName, candidate := strings.CutSuffix(name, candidateSuffix); candidate {
+		return routeName, true, true
+	}
+	return name, false, true
+}
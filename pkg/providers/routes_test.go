@@ -0,0 +1,206 @@
+package providers
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/karindrlainux/flying-cup/pkg/sidecar"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteRoute(t *testing.T) {
+	tests := []struct {
+		name           string
+		file           string
+		route          routeConfig
+		wantRule       string
+		wantEntrypoint string
+		wantHeader     string
+	}{
+		{
+			name:           "live route",
+			file:           "app-1",
+			route:          liveRoute("app-1", "app-1.preview.example.com", "app-1-green", "3000"),
+			wantRule:       "Host(`app-1.preview.example.com`)",
+			wantEntrypoint: "web",
+		},
+		{
+			name:           "candidate route",
+			file:           "app-1" + candidateSuffix,
+			route:          candidateRoute("app-1", "app-1-green", "3000"),
+			wantRule:       "Host(`app-1-green`)",
+			wantEntrypoint: probeEntrypoint,
+			wantHeader:     "app-1-green",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &TraefikProvider{config: &Config{RoutesDir: t.TempDir()}}
+			if err := provider.writeRoute(tt.file, tt.route); err != nil {
+				t.Fatal(err)
+			}
+
+			path, err := provider.routePath(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var written routeConfig
+			if err := yaml.Unmarshal(data, &written); err != nil {
+				t.Fatal(err)
+			}
+
+			router, exists := written.HTTP.Routers[tt.file]
+			if !exists {
+				t.Fatalf("no router %s in %s", tt.file, data)
+			}
+			if router.Rule != tt.wantRule {
+				t.Errorf("rule %s, want %s", router.Rule, tt.wantRule)
+			}
+			if len(router.EntryPoints) != 1 || router.EntryPoints[0] != tt.wantEntrypoint {
+				t.Errorf("entrypoints %v, want %s", router.EntryPoints, tt.wantEntrypoint)
+			}
+
+			service, exists := written.HTTP.Services[router.Service]
+			if !exists || len(service.LoadBalancer.Servers) != 1 || service.LoadBalancer.Servers[0].URL != "http://app-1-green:3000" {
+				t.Errorf("service %s is %+v, want the release on port 3000", router.Service, service)
+			}
+
+			header := ""
+			for _, name := range router.Middlewares {
+				header = written.HTTP.Middlewares[name].Headers.CustomResponseHeaders[releaseHeader]
+			}
+			if header != tt.wantHeader {
+				t.Errorf("%s response header %q, want %q", releaseHeader, header, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestDeploymentRoute(t *testing.T) {
+	tests := []struct {
+		name  string
+		repo  string
+		title string
+		want  string
+	}{
+		{name: "plain title", repo: "app", title: "login", want: "pr-app-7"},
+		{name: "title with a slash", repo: "app", title: "feat/login", want: "pr-app-7"},
+		{name: "title leaving the directory", repo: "app", title: "../../etc/cron.d/x", want: "pr-app-7"},
+		{name: "repository with a dot", repo: "My.App", title: "login", want: "pr-myapp-7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := &webhook.GithubPRWebhook{Number: 7}
+			hook.Repository.Name = tt.repo
+			hook.PullRequest.Title = tt.title
+
+			dir := t.TempDir()
+			provider := &TraefikProvider{config: &Config{RoutesDir: dir}}
+			name := provider.deploymentRoute(&TraefikDeployment{Webhook: hook})
+			if name != tt.want {
+				t.Fatalf("deploymentRoute = %s, want %s", name, tt.want)
+			}
+
+			if err := provider.writeRoute(name, liveRoute(name, "app.example.com", "app-blue", "3000")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(dir, tt.want+".yml")); err != nil {
+				t.Errorf("route not written to the routes directory: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteRouteRejectsPaths(t *testing.T) {
+	provider := &TraefikProvider{config: &Config{RoutesDir: t.TempDir()}}
+
+	for _, name := range []string{"", "..", "../app", "feat/login", `feat\login`} {
+		t.Run(name, func(t *testing.T) {
+			if err := provider.writeRoute(name, liveRoute(name, "app.example.com", "app-blue", "3000")); err == nil {
+				t.Errorf("writeRoute(%q) succeeded, want an error", name)
+			}
+			if err := provider.removeRoute(name); err == nil {
+				t.Errorf("removeRoute(%q) succeeded, want an error", name)
+			}
+		})
+	}
+}
+
+func TestRouteDeployment(t *testing.T) {
+	tests := []struct {
+		file          string
+		wantName      string
+		wantCandidate bool
+		wantOK        bool
+	}{
+		{file: "pr-app-1.yml", wantName: "pr-app-1", wantOK: true},
+		{file: "pr-app-1-candidate.yml", wantName: "pr-app-1", wantCandidate: true, wantOK: true},
+		{file: "pr-app-1.yml.tmp"},
+		{file: "README.md"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			name, candidate, ok := routeDeployment(tt.file)
+			if name != tt.wantName || candidate != tt.wantCandidate || ok != tt.wantOK {
+				t.Errorf("routeDeployment(%q) = %q, %t, %t, want %q, %t, %t", tt.file, name, candidate, ok, tt.wantName, tt.wantCandidate, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestReleaseName(t *testing.T) {
+	tests := []struct {
+		name string
+		live []container.Summary
+		want string
+	}{
+		{name: "first release", want: "app-1-blue"},
+		{name: "blue is live", live: []container.Summary{{Names: []string{"/app-1-blue"}}}, want: "app-1-green"},
+		{name: "green is live", live: []container.Summary{{Names: []string{"/app-1-green"}}}, want: "app-1-blue"},
+		{name: "legacy container is live", live: []container.Summary{{Names: []string{"/app-1"}}}, want: "app-1-blue"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := releaseName("app-1", tt.live); got != tt.want {
+				t.Errorf("releaseName = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeploymentServes(t *testing.T) {
+	deployment := &TraefikDeployment{ContainerID: "green-id", Release: "app-1-green"}
+
+	tests := []struct {
+		name        string
+		deployment  *TraefikDeployment
+		containerID string
+		labels      map[string]string
+		want        bool
+	}{
+		{name: "live app", deployment: deployment, containerID: "green-id", want: true},
+		{name: "sidecar of the live release", deployment: deployment, containerID: "db-id", labels: map[string]string{sidecar.OwnerLabel: "app-1-green"}, want: true},
+		{name: "retiring app", deployment: deployment, containerID: "blue-id"},
+		{name: "sidecar of the retiring release", deployment: deployment, containerID: "db-id", labels: map[string]string{sidecar.OwnerLabel: "app-1-blue"}},
+		{name: "compose service", deployment: &TraefikDeployment{Project: "app-1"}, containerID: "web-id", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.deployment.serves(tt.containerID, tt.labels); got != tt.want {
+				t.Errorf("serves = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,326 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+)
+
+// ErrNotSleepable is returned for deployments that cannot be stopped and started again,
+// e.g. multi-service previews
+var ErrNotSleepable = errors.New("deployment cannot be scaled to zero")
+
+// PreviewRef identifies the deployment serving a preview host
+type PreviewRef struct {
+	ID    string
+	Repo  string
+	PR    int
+	Phase Phase
+}
+
+// Sleeper is implemented by providers that can scale idle previews to zero
+type Sleeper interface {
+	// Sleep stops the containers of a ready deployment without removing them
+	Sleep(ctx context.Context, deploymentID string) error
+	// Wake starts the containers of a sleeping deployment and waits until it is ready
+	Wake(ctx context.Context, deploymentID string) error
+	// DeploymentForHost returns the deployment serving a preview host
+	DeploymentForHost(host string) (PreviewRef, bool)
+}
+
+// Sleep removes the route of a deployment and stops its app and sidecars. Requests then fall
+// back to the controller which wakes the preview up.
+func (t *TraefikProvider) Sleep(ctx context.Context, deploymentID string) error {
+	t.mu.Lock()
+	deployment, exists := t.deployments[deploymentID]
+	if !exists {
+		t.mu.Unlock()
+		return fmt.Errorf("deployment not found: %s", deploymentID)
+	}
+	if deployment.Project != "" || deployment.ContainerID == "" {
+		t.mu.Unlock()
+		return ErrNotSleepable
+	}
+	if deployment.Phase != PhaseReady {
+		t.mu.Unlock()
+		return fmt.Errorf("deployment %s is %s, not ready", deploymentID, deployment.Phase)
+	}
+	// The health watcher ignores the containers stopping from now on
+	deployment.Phase = PhaseSleeping
+	if err := t.saveSleepingLocked(); err != nil {
+		deployment.Phase = PhaseReady
+		t.mu.Unlock()
+		return err
+	}
+	routeName := t.deploymentRoute(deployment)
+	route := liveRoute(routeName, deployment.Domain, deployment.Release, deployment.Port)
+	t.mu.Unlock()
+
+	if err := t.removeRoute(routeName); err != nil {
+		t.setAwake(deploymentID)
+		return err
+	}
+
+	if err := t.stopDeploymentContainers(ctx, deploymentID); err != nil {
+		// Whatever still runs keeps serving
+		if err := t.writeRoute(routeName, route); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		t.setAwake(deploymentID)
+		return err
+	}
+
+	log.Printf("😴 Preview %s scaled to zero", deploymentID)
+	return nil
+}
+
+// Wake starts the sidecars then the app of a sleeping deployment, waits for the app to answer
+// and routes the preview to it again. Waking a ready deployment does nothing.
+func (t *TraefikProvider) Wake(ctx context.Context, deploymentID string) error {
+	t.mu.Lock()
+	deployment, exists := t.deployments[deploymentID]
+	if !exists {
+		t.mu.Unlock()
+		return fmt.Errorf("deployment not found: %s", deploymentID)
+	}
+	if deployment.Phase == PhaseReady {
+		t.mu.Unlock()
+		return nil
+	}
+	if deployment.Phase != PhaseSleeping {
+		t.mu.Unlock()
+		return fmt.Errorf("deployment %s is %s, not sleeping", deploymentID, deployment.Phase)
+	}
+	deployment.Phase = PhaseStarting
+	containerID, release, port := deployment.ContainerID, deployment.Release, deployment.Port
+	routeName := t.deploymentRoute(deployment)
+	route := liveRoute(routeName, deployment.Domain, release, port)
+	t.mu.Unlock()
+
+	log.Printf("⏰ Waking up preview %s", deploymentID)
+
+	if err := t.startDeploymentContainers(ctx, deploymentID, routeName, containerID, release, port); err != nil {
+		// Leave the preview asleep so the next request tries again
+		t.setPhase(deploymentID, PhaseSleeping)
+		return err
+	}
+
+	if err := t.writeRoute(routeName, route); err != nil {
+		// Leave the preview asleep so the next request tries again
+		t.setPhase(deploymentID, PhaseSleeping)
+		return err
+	}
+
+	t.mu.Lock()
+	if deployment, exists := t.deployments[deploymentID]; exists {
+		deployment.Phase = PhaseReady
+		deployment.Status = StatusRunning
+		deployment.Notified = false
+	}
+	if err := t.saveSleepingLocked(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	t.mu.Unlock()
+
+	log.Printf("✅ Preview %s is awake", deploymentID)
+	return nil
+}
+
+// setAwake moves a deployment that failed to go to sleep back to ready, and persists that
+// it no longer sleeps
+func (t *TraefikProvider) setAwake(deploymentID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if deployment, exists := t.deployments[deploymentID]; exists {
+		deployment.Phase = PhaseReady
+	}
+	if err := t.saveSleepingLocked(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+}
+
+// DeploymentForHost returns the tracked deployment whose domain is host, ignoring the port
+func (t *TraefikProvider) DeploymentForHost(host string) (PreviewRef, bool) {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, deployment := range t.deployments {
+		if deployment.Webhook == nil || !strings.EqualFold(deployment.Domain, host) {
+			continue
+		}
+		return PreviewRef{
+			ID:    deployment.ID,
+			Repo:  deployment.Webhook.Repository.Name,
+			PR:    deployment.Webhook.Number,
+			Phase: deployment.Phase,
+		}, true
+	}
+	return PreviewRef{}, false
+}
+
+// stopDeploymentContainers stops the app before its sidecars
+func (t *TraefikProvider) stopDeploymentContainers(ctx context.Context, deploymentID string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	containers, err := deploymentContainers(ctx, cli, deploymentID, false)
+	if err != nil {
+		return err
+	}
+
+	for i := len(containers) - 1; i >= 0; i-- {
+		if err := cli.ContainerStop(ctx, containers[i].ID, container.StopOptions{}); err != nil {
+			return fmt.Errorf("failed to stop container %s: %w", firstName(containers[i].Names), err)
+		}
+	}
+	return nil
+}
+
+// startDeploymentContainers starts the sidecars before the app, then probes the app
+func (t *TraefikProvider) startDeploymentContainers(ctx context.Context, deploymentID, routeName, containerID, release, port string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	containers, err := deploymentContainers(ctx, cli, deploymentID, true)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		if err := cli.ContainerStart(ctx, c.ID, container.StartOptions{}); err != nil {
+			return fmt.Errorf("failed to start container %s: %w", firstName(c.Names), err)
+		}
+	}
+
+	return t.waitForReady(ctx, &docker.DockerRunner{Client: cli}, routeName, containerID, release, port)
+}
+
+// deploymentContainers lists the sidecars then the app of a deployment, skipping jobs
+func deploymentContainers(ctx context.Context, cli *client.Client, deploymentID string, all bool) ([]container.Summary, error) {
+	list, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     all,
+		Filters: filters.NewArgs(filters.Arg("label", "flying-cup.deployment="+deploymentID)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	var sidecars, apps []container.Summary
+	for _, c := range list {
+		if _, isJob := c.Labels["flying-cup.job"]; isJob {
+			continue
+		}
+		if c.Labels["flying-cup.domain"] == "" {
+			sidecars = append(sidecars, c)
+		} else {
+			apps = append(apps, c)
+		}
+	}
+	return append(sidecars, apps...), nil
+}
+
+// sleepingFile persists the sleeping previews, which nothing running on the host tells apart
+// from stopped ones after a restart
+const sleepingFile = "sleeping.json"
+
+// saveSleepingLocked persists the sleeping deployments; callers must hold the lock
+func (t *TraefikProvider) saveSleepingLocked() error {
+	if t.config.DataDir == "" {
+		return nil
+	}
+
+	sleeping := []*TraefikDeployment{}
+	for _, deployment := range t.deployments {
+		if deployment.Phase == PhaseSleeping {
+			sleeping = append(sleeping, deployment)
+		}
+	}
+	sort.Slice(sleeping, func(i, j int) bool { return sleeping[i].ID < sleeping[j].ID })
+
+	data, err := json.MarshalIndent(sleeping, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sleeping previews: %w", err)
+	}
+
+	if err := os.MkdirAll(t.config.DataDir, 0700); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(t.config.DataDir, sleepingFile)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write sleeping previews: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write sleeping previews: %w", err)
+	}
+	return nil
+}
+
+// restoreSleeping tracks the previews that were sleeping when the controller stopped again,
+// so they still wake up on request and are not collected as orphans. Previews whose app
+// container is gone are dropped, and those started in the meantime are ready.
+func (t *TraefikProvider) restoreSleeping(ctx context.Context, cli *client.Client) error {
+	if t.config.DataDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(t.config.DataDir, sleepingFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read sleeping previews: %w", err)
+	}
+
+	var sleeping []*TraefikDeployment
+	if err := json.Unmarshal(data, &sleeping); err != nil {
+		return fmt.Errorf("failed to decode sleeping previews: %w", err)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, deployment := range sleeping {
+		if _, tracked := t.deployments[deployment.ID]; tracked {
+			continue
+		}
+
+		info, err := cli.ContainerInspect(ctx, deployment.ContainerID)
+		if err != nil {
+			log.Printf("Sleeping preview %s is gone: %v", deployment.ID, err)
+			continue
+		}
+
+		if info.State != nil && info.State.Running {
+			deployment.Phase = PhaseReady
+			deployment.Status = StatusRunning
+		}
+		t.deployments[deployment.ID] = deployment
+		log.Printf("😴 Restored %s preview %s", deployment.Phase, deployment.ID)
+	}
+
+	return t.saveSleepingLocked()
+}
@@ -0,0 +1,218 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+)
+
+// GetDeploymentStatus returns the phase of a deployment with the live state of its app container
+func (t *TraefikProvider) GetDeploymentStatus(ctx context.Context, deploymentID string) (*DeploymentStatus, error) {
+	t.mu.Lock()
+	deployment, exists := t.deployments[deploymentID]
+	if !exists {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("deployment not found: %s", deploymentID)
+	}
+
+	status := &DeploymentStatus{
+		ID:       deployment.ID,
+		Repo:     deployment.Webhook.Repository.Name,
+		PR:       deployment.Webhook.Number,
+		Title:    deployment.Webhook.PullRequest.Title,
+		Phase:    deployment.Phase,
+		Error:    deployment.Error,
+		URL:      t.previewURL(deployment.Domain),
+		Image:    deployment.Image,
+		SHA:      deployment.SHA,
+		ExitCode: deployment.ExitCode,
+	}
+	if deployment.RegistryImage != "" {
+		status.Image = deployment.RegistryImage
+	}
+	containerID := deployment.ContainerID
+	t.mu.Unlock()
+
+	// Only deployed previews have a container to inspect
+	if status.Phase != PhaseReady || containerID == "" {
+		return status, nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	dockerRunner := &docker.DockerRunner{Client: cli}
+	info, err := dockerRunner.GetContainerInfo(ctx, containerID)
+	if errdefs.IsNotFound(err) {
+		status.Phase = PhaseStopped
+		status.ContainerState = "removed"
+		return status, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
+	}
+
+	status.RestartCount = info.RestartCount
+	if info.State == nil {
+		return status, nil
+	}
+
+	status.ContainerState = info.State.Status
+	status.Health = "none"
+	if info.State.Health != nil {
+		status.Health = info.State.Health.Status
+	}
+
+	if startedAt, err := time.Parse(time.RFC3339Nano, info.State.StartedAt); err == nil {
+		status.StartedAt = startedAt
+		if info.State.Running {
+			status.Uptime = time.Since(startedAt).Round(time.Second)
+		}
+	}
+
+	if info.State.Running && info.Config != nil {
+		status.Memory = memoryLimit(info.Config.Labels)
+	}
+
+	switch info.State.Status {
+	case "exited", "dead":
+		status.Phase = PhaseStopped
+		status.ExitCode = info.State.ExitCode
+	}
+
+	return status, nil
+}
+
+// ListDeployments returns the deployments tracked by the controller together with those
+// only found through the flying-cup.deployment label, e.g. after a controller restart
+func (t *TraefikProvider) ListDeployments(ctx context.Context, filter DeploymentFilter) ([]*DeploymentStatus, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	defer cli.Close()
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", "flying-cup.deployment")),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	t.mu.Lock()
+	ids := make([]string, 0, len(t.deployments))
+	for id := range t.deployments {
+		ids = append(ids, id)
+	}
+	t.mu.Unlock()
+
+	var statuses []*DeploymentStatus
+	seen := make(map[string]bool)
+
+	for _, id := range ids {
+		status, err := t.GetDeploymentStatus(ctx, id)
+		if err != nil {
+			// Removed in the meantime
+			continue
+		}
+		seen[id] = true
+		if filter.Match(status) {
+			statuses = append(statuses, status)
+		}
+	}
+
+	// Public containers carry the routing labels, so prefer them over sidecars and jobs
+	untracked := make(map[string]*DeploymentStatus)
+	for _, c := range containers {
+		id := c.Labels["flying-cup.deployment"]
+		if seen[id] {
+			continue
+		}
+
+		if _, found := untracked[id]; found && c.Labels["flying-cup.domain"] == "" {
+			continue
+		}
+
+		status := untrackedStatus(id, c)
+		if c.Labels["flying-cup.domain"] != "" {
+			status.URL = t.previewURL(c.Labels["flying-cup.domain"])
+		}
+		untracked[id] = status
+	}
+
+	for _, status := range untracked {
+		if filter.Match(status) {
+			statuses = append(statuses, status)
+		}
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses, nil
+}
+
+// untrackedStatus describes a deployment from the labels and state of one of its containers
+func untrackedStatus(id string, c container.Summary) *DeploymentStatus {
+	repo := c.Labels["flying-cup.repo"]
+	pr, _ := strconv.Atoi(c.Labels["flying-cup.pr"])
+
+	// Deployment IDs are {repo}-pr-{title}-{number}
+	title := strings.TrimSuffix(strings.TrimPrefix(id, repo+"-pr-"), fmt.Sprintf("-%d", pr))
+
+	status := &DeploymentStatus{
+		ID:             id,
+		Repo:           repo,
+		PR:             pr,
+		Title:          title,
+		Phase:          PhaseStopped,
+		Image:          c.Image,
+		SHA:            c.Labels["flying-cup.sha"],
+		ContainerState: c.State,
+	}
+
+	switch c.State {
+	case "running", "restarting":
+		status.Phase = PhaseReady
+		status.Memory = memoryLimit(c.Labels)
+	}
+	return status
+}
+
+// memoryLimit reads the memory limit a container was started with from its labels
+func memoryLimit(labels map[string]string) int64 {
+	memory, _ := strconv.ParseInt(labels["flying-cup.limits.memory"], 10, 64)
+	return memory
+}
+
+// setPhase moves a deployment to the next phase of its deploy
+func (t *TraefikProvider) setPhase(deploymentKey string, phase Phase) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Phase = phase
+	}
+}
+
+// setFailed marks a deployment as failed with the error that stopped it
+func (t *TraefikProvider) setFailed(deploymentKey string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Phase = PhaseFailed
+		deployment.Error = err.Error()
+	}
+}
@@ -4,15 +4,19 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
 	"github.com/docker/docker/client"
 	"github.com/karindrlainux/flying-cup/pkg/docker"
 	"github.com/karindrlainux/flying-cup/pkg/git"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+	"github.com/karindrlainux/flying-cup/pkg/sidecar"
 	"github.com/karindrlainux/flying-cup/pkg/types"
 	"github.com/karindrlainux/flying-cup/pkg/webhook"
 )
@@ -23,6 +27,8 @@ type TraefikProvider struct {
 	// Traefik-specific fields
 	deployments map[string]*TraefikDeployment
 	mu          sync.Mutex
+	builder     docker.Builder
+	registry    *docker.Registry
 }
 
 // TraefikDeployment represents a deployment managed by Traefik
@@ -31,7 +37,31 @@ type TraefikDeployment struct {
 	Name        string
 	Domain      string
 	ContainerID string
-	Status      string
+	Phase       Phase
+	// Error explains a failed phase
+	Error string
+	// Status is the runtime state tracked from Docker events once ready, e.g. running or crashed
+	Status string
+	SHA    string
+	// Image is the local image tag, RegistryImage the pushed reference if any
+	Image         string
+	RegistryImage string
+	// Project is the compose project name of multi-service previews
+	Project string
+	// Release is the app container the route points to, and Port the port it listens on
+	Release string
+	Port    string
+	// Manifest is the repository manifest the app runs with, kept to roll back to it
+	Manifest *manifest.Manifest
+	// Jobs are the predeploy and postdeploy jobs run by the last deploy
+	Jobs []JobResult
+	// Webhook is the event that triggered the deploy
+	Webhook *webhook.GithubPRWebhook
+	// Restarts and ExitCode are tracked from the Docker events stream since the deploy
+	Restarts int
+	ExitCode int
+	// Notified is set once the PR has been told the preview went unhealthy
+	Notified bool
 }
 
 // NewTraefikProvider creates a new Traefik provider
@@ -50,13 +80,47 @@ func (t *TraefikProvider) Init(config interface{}) error {
 		return fmt.Errorf("failed to create Docker client: %w", err)
 	}
 
+	if t.builder == nil {
+		t.builder, err = docker.NewBuilder(t.config.Builder, t.config.BuildKitHost, t.config.BuildLimits, cli)
+		if err != nil {
+			return fmt.Errorf("failed to create image builder: %w", err)
+		}
+	}
+
+	if t.config.Registry.URL != "" {
+		t.registry = docker.NewRegistry(cli, t.config.Registry)
+		log.Printf("Preview images will be pushed to %s", t.config.Registry.URL)
+	}
+
+	if err := t.restoreSleeping(context.Background(), cli); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
 	return t.ensureWebNetwork(context.Background(), cli)
 }
 
+// SetBuilder replaces the image builder, e.g. with a fake in tests
+func (t *TraefikProvider) SetBuilder(builder docker.Builder) {
+	t.builder = builder
+}
+
 // CreateDeployment creates a new deployment using Traefik
 func (t *TraefikProvider) CreateDeployment(ctx context.Context, webhook *webhook.GithubPRWebhook) (string, error) {
+	return t.deploy(ctx, webhook, nil)
+}
+
+// deploy builds and runs the head commit of a pull request, or runs release without
+// cloning or building
+func (t *TraefikProvider) deploy(ctx context.Context, webhook *webhook.GithubPRWebhook, release *ReleaseSpec) (string, error) {
 	log.Printf("Creating Traefik deployment for PR #%d", webhook.Number)
 
+	deploymentKey := deploymentKeyFor(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
+
+	// The live release keeps serving until the new one is ready
+	t.mu.Lock()
+	previous := t.deployments[deploymentKey]
+	t.mu.Unlock()
+
 	// Generate domain for this PR
 	previewDomain, err := t.createTraefikDeployment(webhook)
 	if err != nil {
@@ -64,27 +128,28 @@ func (t *TraefikProvider) CreateDeployment(ctx context.Context, webhook *webhook
 	}
 
 	// Build and run container
-	containerID, err := t.buildAndRunContainer(ctx, webhook, previewDomain)
+	containerID, err := t.buildAndRunContainer(ctx, webhook, previewDomain, release)
 	if err != nil {
+		if !t.keepPrevious(context.WithoutCancel(ctx), deploymentKey, previous) {
+			t.setFailed(deploymentKey, err)
+		}
 		return "", fmt.Errorf("failed to build and run container: %w", err)
 	}
 
 	// Update deployment with container ID
 	t.mu.Lock()
-	deploymentKey := fmt.Sprintf("%s-pr-%s-%d", webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
 	if deployment, exists := t.deployments[deploymentKey]; exists {
 		deployment.ContainerID = containerID
-		deployment.Status = "running"
+		deployment.Phase = PhaseReady
+		deployment.Status = StatusRunning
 	}
-	t.mu.Unlock()
-
-	// Get protocol based on environment
-	protocol := "https" // Default to HTTPS for production
-	if t.config.Environment == "local" {
-		protocol = "http"
+	// A redeploy replaces a sleeping preview
+	if err := t.saveSleepingLocked(); err != nil {
+		log.Printf("Warning: %v", err)
 	}
+	t.mu.Unlock()
 
-	return fmt.Sprintf("%s://%s", protocol, previewDomain), nil
+	return t.previewURL(previewDomain), nil
 }
 
 // CleanupDeployment removes a Traefik deployment
@@ -92,37 +157,67 @@ func (t *TraefikProvider) CleanupDeployment(ctx context.Context, repoName, prNam
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	deploymentKey := fmt.Sprintf("%s-pr-%s-%d", repoName, prName, prNumber)
+	deploymentKey := deploymentKeyFor(repoName, prName, prNumber)
 	deployment, exists := t.deployments[deploymentKey]
 	if !exists {
-		return fmt.Errorf("deployment not found: %s", deploymentKey)
+		// Left by a previous controller run, only its labelled resources are known
+		log.Printf("Deployment %s is not tracked, removing its labelled resources", deploymentKey)
+		deployment = &TraefikDeployment{ID: deploymentKey}
 	}
 
 	log.Printf("Cleaning up Traefik deployment: %s", deploymentKey)
 
-	// Stop and remove container if it exists
-	if deployment.ContainerID != "" {
+	// Stop routing the preview before its containers go
+	codeName := codeNameFor(repoName, prNumber)
+	routeName := t.routeName(codeName)
+	for _, route := range []string{routeName, routeName + candidateSuffix} {
+		if err := t.removeRoute(route); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+
+	// Tear down the whole stack of multi-service previews
+	if deployment.Project != "" {
+		if err := t.removeComposeStack(ctx, deployment.Project); err != nil {
+			log.Printf("Warning: failed to remove compose stack: %v", err)
+		}
+	} else if deployment.ContainerID != "" {
+		// Stop and remove container if it exists
 		if err := t.stopAndRemoveContainer(deployment.ContainerID); err != nil {
 			log.Printf("Warning: failed to stop container: %v", err)
 		}
 	}
 
-	delete(t.deployments, deploymentKey)
-	log.Printf("Traefik deployment removed: %s", deploymentKey)
-	return nil
-}
+	// Remove everything else labelled with the deployment: sidecars, volumes and the private network
+	if err := t.removeDeploymentResources(ctx, deploymentKey); err != nil {
+		log.Printf("Warning: failed to remove deployment resources: %v", err)
+	}
 
-// GetDeploymentStatus returns the status of a deployment
-func (t *TraefikProvider) GetDeploymentStatus(ctx context.Context, deploymentID string) (string, error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	// Remove the clone and the local image
+	if err := git.RemoveClonedRepository(ctx, filepath.Join(reposDir, codeName)); err != nil {
+		log.Printf("Warning: failed to remove cloned repository: %v", err)
+	}
 
-	deployment, exists := t.deployments[deploymentID]
-	if !exists {
-		return "", fmt.Errorf("deployment not found: %s", deploymentID)
+	// Single-image previews keep an image per commit; compose previews name their own
+	if deployment.Project == "" {
+		if err := t.removeReleases(ctx, codeName); err != nil {
+			log.Printf("Warning: failed to remove images: %v", err)
+		}
 	}
 
-	return deployment.Status, nil
+	// Delete the tags pushed for every commit from the registry
+	if t.deletesRegistryImages() {
+		if err := t.deleteRegistryReleases(ctx, codeName); err != nil {
+			log.Printf("Warning: failed to delete registry images: %v", err)
+		}
+	}
+
+	delete(t.deployments, deploymentKey)
+	if err := t.saveSleepingLocked(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	log.Printf("Traefik deployment removed: %s", deploymentKey)
+	return nil
 }
 
 // Helper methods
@@ -131,7 +226,7 @@ func (t *TraefikProvider) createTraefikDeployment(webhook *webhook.GithubPRWebho
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	deploymentKey := fmt.Sprintf("%s-pr-%s-%d", webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
+	deploymentKey := deploymentKeyFor(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
 
 	// Generate subdomain for this PR
 	// Format: reponame-prname-prnumber.domain
@@ -145,10 +240,12 @@ func (t *TraefikProvider) createTraefikDeployment(webhook *webhook.GithubPRWebho
 
 	// Store deployment info
 	deployment := &TraefikDeployment{
-		ID:     deploymentKey,
-		Name:   deploymentKey,
-		Domain: domain,
-		Status: "pending",
+		ID:      deploymentKey,
+		Name:    deploymentKey,
+		Domain:  domain,
+		Phase:   PhaseQueued,
+		SHA:     webhook.PullRequest.Head.Sha,
+		Webhook: webhook,
 	}
 
 	t.deployments[deploymentKey] = deployment
@@ -157,15 +254,31 @@ func (t *TraefikProvider) createTraefikDeployment(webhook *webhook.GithubPRWebho
 	return domain, nil
 }
 
-func (t *TraefikProvider) buildAndRunContainer(ctx context.Context, webhook *webhook.GithubPRWebhook, domain string) (string, error) {
+func (t *TraefikProvider) buildAndRunContainer(ctx context.Context, webhook *webhook.GithubPRWebhook, domain string, rollback *ReleaseSpec) (string, error) {
 	// Generate code name
-	codeName := fmt.Sprintf("pr-%s-%d", webhook.Repository.Name, webhook.Number)
-	repoPath := fmt.Sprintf("./repos/%s", codeName)
+	codeName := codeNameFor(webhook.Repository.Name, webhook.Number)
+	repoPath := filepath.Join(reposDir, codeName)
+	deploymentKey := deploymentKeyFor(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
+
+	var appManifest *manifest.Manifest
+	var err error
+	if rollback != nil {
+		// Rollbacks run the release as it was deployed, without the branch head
+		appManifest = rollback.Manifest
+		repoPath = ""
+	} else {
+		// Clone repository
+		t.setPhase(deploymentKey, PhaseCloning)
+		err = git.CloneRepository(ctx, webhook.Repository.CloneUrl, webhook.PullRequest.Head.Ref, repoPath)
+		if err != nil {
+			return "", fmt.Errorf("failed to clone repository: %w", err)
+		}
 
-	// Clone repository
-	err := git.CloneRepository(ctx, webhook.Repository.CloneUrl, webhook.PullRequest.Head.Ref, repoPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to clone repository: %w", err)
+		// Load repository manifest
+		appManifest, err = manifest.Load(repoPath)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	// Create Docker client
@@ -174,52 +287,248 @@ func (t *TraefikProvider) buildAndRunContainer(ctx context.Context, webhook *web
 		return "", fmt.Errorf("failed to create docker client: %w", err)
 	}
 
+	// Resolve environment variables and secrets
+	env, err := t.resolveEnv(webhook, appManifest, t.previewURL(domain))
+	if err != nil {
+		return "", err
+	}
+
+	// Resolve container limits with the repository overrides
+	limits, err := t.config.ContainerLimits.WithOverrides(appManifest.Resources)
+	if err != nil {
+		return "", err
+	}
+
+	egress, err := t.egressFor(appManifest)
+	if err != nil {
+		return "", err
+	}
+
+	t.setPhase(deploymentKey, PhaseBuilding)
+
+	// Multi-service previews run the repository's compose file instead of a single image
+	if appManifest.Compose.File != "" {
+		if rollback != nil {
+			return "", fmt.Errorf("rollbacks are not supported for compose previews")
+		}
+		if len(appManifest.Jobs.Predeploy) > 0 || len(appManifest.Jobs.Postdeploy) > 0 {
+			return "", fmt.Errorf("predeploy and postdeploy jobs are not supported for compose previews")
+		}
+		return t.runComposeStack(ctx, cli, webhook, appManifest, repoPath, codeName, domain, env, limits, egress)
+	}
+
 	// Build Docker image
-	dockerBuilder := &docker.DockerBuilder{Client: cli}
 	app := &types.App{
 		Name:          codeName,
 		SourcePath:    repoPath,
-		ContainerPort: "8080",
+		ContainerPort: manifestPort(appManifest),
+		Manifest:      appManifest,
+		Env:           env,
+	}
+
+	dockerRunner := &docker.DockerRunner{Client: cli}
+
+	// Rollbacks run an image built before instead of building the head commit
+	imageTag, registryImage := "", ""
+	if rollback != nil {
+		imageTag, err = t.releaseImage(ctx, dockerRunner, codeName, webhook.PullRequest.Head.Sha, rollback.Image)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		imageTag, err = t.builder.BuildImage(ctx, app, "Dockerfile", true)
+		if err != nil {
+			return "", fmt.Errorf("failed to build Docker image: %w", err)
+		}
+
+		// Keep an image per commit, to roll back to it later
+		imageTag, err = t.tagRelease(ctx, cli, imageTag, codeName, webhook.PullRequest.Head.Sha)
+		if err != nil {
+			return "", err
+		}
+
+		// Push the image to the registry under its commit SHA
+		if t.registry != nil {
+			registryImage, err = t.registry.Push(ctx, imageTag, codeName, shortSHA(webhook.PullRequest.Head.Sha))
+			if err != nil {
+				return "", fmt.Errorf("failed to push Docker image: %w", err)
+			}
+		}
 	}
 
-	imageTag, err := dockerBuilder.BuildImage(ctx, app, "Dockerfile", true)
+	t.mu.Lock()
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Image = imageTag
+		deployment.RegistryImage = registryImage
+	}
+	t.mu.Unlock()
+
+	t.setPhase(deploymentKey, PhaseStarting)
+
+	// Resolve the port the app listens on now that the image exists
+	if rollback != nil && rollback.Port != "" {
+		app.ContainerPort = rollback.Port
+	} else {
+		app.ContainerPort, err = containerPort(ctx, dockerRunner, appManifest, imageTag)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Every preview gets a private network shared only by its app, its sidecars and the proxy
+	networks, err := t.ensurePreviewNetworks(ctx, dockerRunner, webhook, codeName, egress)
 	if err != nil {
-		return "", fmt.Errorf("failed to build Docker image: %w", err)
+		return "", err
+	}
+	app.Networks = networks
+	networkName := networks[0]
+
+	// The app carries no routing labels, its route is written once it passed its checks
+	labels := t.generateAppLabels(webhook, domain)
+	labels["flying-cup.port"] = app.ContainerPort
+	for key, value := range limits.Labels() {
+		labels[key] = value
 	}
 
-	// Generate Traefik labels
-	labels := t.generateTraefikLabels(webhook, domain)
+	// The new release runs next to the live one, under its own name, until it is ready
+	live, err := liveApps(ctx, cli, deploymentKey)
+	if err != nil {
+		return "", err
+	}
+	release := releaseName(codeName, live)
 
-	// Run container with Traefik integration
-	dockerRunner := &docker.DockerRunner{Client: cli}
-	containerID, err := dockerRunner.RunContainerWithTraefik(ctx, app, imageTag, codeName, labels)
+	released := false
+	defer func() {
+		if !released {
+			t.discard(context.WithoutCancel(ctx), dockerRunner, release)
+		}
+	}()
+
+	// Start database sidecars and inject their credentials
+	if len(appManifest.Services) > 0 {
+		sidecarEnv, err := sidecar.Start(ctx, dockerRunner, appManifest.Services, sidecar.Options{
+			Prefix:       release,
+			Network:      networkName,
+			Labels:       t.generateMetadataLabels(webhook),
+			RepoPath:     repoPath,
+			ReadyTimeout: 2 * time.Minute,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to start sidecars: %w", err)
+		}
+
+		app.Env = append(app.Env, sidecarEnv...)
+	}
+
+	// Jobs run from the preview image next to the app, and can reach it by container name
+	jobs := jobTarget{
+		Prefix:   codeName,
+		Image:    imageTag,
+		Networks: networks,
+		Env: append(append([]string{}, app.Env...),
+			"PREVIEW_URL="+t.previewURL(domain),
+			fmt.Sprintf("PREVIEW_INTERNAL_URL=http://%s:%s", release, app.ContainerPort),
+		),
+		Labels: t.generateMetadataLabels(webhook),
+		Limits: limits,
+	}
+
+	results, err := t.runJobs(ctx, dockerRunner, JobPhasePredeploy, appManifest.Jobs.Predeploy, jobs)
+	t.recordJobs(deploymentKey, results)
+	if err != nil {
+		return "", err
+	}
+
+	// Run the new release next to the live one, which keeps serving the preview
+	containerID, err := dockerRunner.RunContainerWithTraefik(ctx, app, imageTag, release, labels, limits)
 	if err != nil {
 		return "", fmt.Errorf("failed to run Docker container: %w", err)
 	}
 
-	log.Printf("Container %s started with ID %s", codeName, containerID)
+	log.Printf("Container %s started with ID %s", release, containerID)
+
+	t.mu.Lock()
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Port = app.ContainerPort
+		deployment.Manifest = appManifest
+	}
+	t.mu.Unlock()
+
+	if err := t.waitForReady(ctx, dockerRunner, t.routeName(codeName), containerID, release, app.ContainerPort); err != nil {
+		return "", err
+	}
+
+	jobs.ContainerID = containerID
+	results, err = t.runJobs(ctx, dockerRunner, JobPhasePostdeploy, appManifest.Jobs.Postdeploy, jobs)
+	t.recordJobs(deploymentKey, results)
+	if err != nil {
+		return "", err
+	}
+
+	// Only now does the preview switch to the new release
+	routeName := t.routeName(codeName)
+	if err := t.writeRoute(routeName, liveRoute(routeName, domain, release, app.ContainerPort)); err != nil {
+		return "", err
+	}
+	released = true
+
+	t.mu.Lock()
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Release = release
+	}
+	t.mu.Unlock()
+
+	if len(live) > 0 {
+		// Traefik reloads the route asynchronously, let it stop sending requests to the live release
+		time.Sleep(routeSwitchDelay)
+		t.retire(context.WithoutCancel(ctx), dockerRunner, live)
+	}
+
 	return containerID, nil
 }
 
-func (t *TraefikProvider) generateTraefikLabels(webhook *webhook.GithubPRWebhook, domain string) map[string]string {
-	deploymentKey := fmt.Sprintf("%s-pr-%s-%d", webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number)
+// recordJobs appends job results to the deployment
+func (t *TraefikProvider) recordJobs(deploymentKey string, results []JobResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-	return map[string]string{
-		// Enable Traefik for this container
-		"traefik.enable": "true",
+	if deployment, exists := t.deployments[deploymentKey]; exists {
+		deployment.Jobs = append(deployment.Jobs, results...)
+	}
+}
+
+// generateTraefikLabels routes domain to the container port through a router named router,
+// reaching the container over the given network
+func (t *TraefikProvider) generateTraefikLabels(webhook *webhook.GithubPRWebhook, router, domain, port, network string) map[string]string {
+	labels := t.generateAppLabels(webhook, domain)
 
-		// HTTP Router configuration - simplified for local testing
-		"traefik.http.routers." + deploymentKey + ".rule":        fmt.Sprintf("Host(`%s`)", domain),
-		"traefik.http.routers." + deploymentKey + ".entrypoints": "web",
+	// Enable Traefik for this container
+	labels["traefik.enable"] = "true"
 
-		// Service configuration - use internal container port
-		"traefik.http.services." + deploymentKey + ".loadbalancer.server.port": "8080",
+	// HTTP Router configuration - simplified for local testing
+	labels["traefik.http.routers."+router+".rule"] = fmt.Sprintf("Host(`%s`)", domain)
+	labels["traefik.http.routers."+router+".entrypoints"] = "web"
+
+	// Service configuration - use internal container port
+	labels["traefik.http.services."+router+".loadbalancer.server.port"] = port
+	labels["traefik.docker.network"] = network
+	return labels
+}
 
-		// Add metadata labels
-		"flying-cup.deployment": deploymentKey,
+// generateAppLabels returns the labels of a container serving domain
+func (t *TraefikProvider) generateAppLabels(webhook *webhook.GithubPRWebhook, domain string) map[string]string {
+	labels := t.generateMetadataLabels(webhook)
+	labels["flying-cup.domain"] = domain
+	labels["flying-cup.sha"] = webhook.PullRequest.Head.Sha
+	return labels
+}
+
+// generateMetadataLabels returns the flying-cup.* labels identifying a deployment's resources
+func (t *TraefikProvider) generateMetadataLabels(webhook *webhook.GithubPRWebhook) map[string]string {
+	return map[string]string{
+		"flying-cup.deployment": deploymentKeyFor(webhook.Repository.Name, webhook.PullRequest.Title, webhook.Number),
 		"flying-cup.repo":       webhook.Repository.Name,
 		"flying-cup.pr":         fmt.Sprintf("%d", webhook.Number),
-		"flying-cup.domain":     domain,
 	}
 }
 
@@ -253,6 +562,17 @@ func (t *TraefikProvider) ensureWebNetwork(ctx context.Context, cli *client.Clie
 	return nil
 }
 
+// removeDeploymentResources removes every container, network and volume labelled with the deployment
+func (t *TraefikProvider) removeDeploymentResources(ctx context.Context, deploymentKey string) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return fmt.Errorf("failed to create Docker client: %w", err)
+	}
+
+	dockerRunner := &docker.DockerRunner{Client: cli}
+	return dockerRunner.RemoveResources(ctx, "flying-cup.deployment", deploymentKey)
+}
+
 func (t *TraefikProvider) stopAndRemoveContainer(containerID string) error {
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
@@ -275,6 +595,40 @@ func (t *TraefikProvider) stopAndRemoveContainer(containerID string) error {
 	return nil
 }
 
+// previewURL returns the preview URL for a domain, using HTTPS except in local environments
+func (t *TraefikProvider) previewURL(domain string) string {
+	protocol := "https" // Default to HTTPS for production
+	if t.config.Environment == "local" {
+		protocol = "http"
+	}
+
+	return fmt.Sprintf("%s://%s", protocol, domain)
+}
+
+// reposDir holds the clones of the previewed branches
+const reposDir = "./repos"
+
+// codeNameFor names the containers, networks, images and clone directory of a preview
+func codeNameFor(repoName string, prNumber int) string {
+	return fmt.Sprintf("pr-%s-%d", repoName, prNumber)
+}
+
+// deploymentKeyFor returns the key deployments are stored and labelled under
+func deploymentKeyFor(repoName, prName string, prNumber int) string {
+	return fmt.Sprintf("%s-pr-%s-%d", repoName, prName, prNumber)
+}
+
+// shortSHA returns the abbreviated commit SHA used in image tags
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	if sha == "" {
+		return "latest"
+	}
+	return sha
+}
+
 func (t *TraefikProvider) sanitizeForDomain(s string) string {
 	s = strings.ToLower(s)
 	s = strings.ReplaceAll(s, " ", "-")
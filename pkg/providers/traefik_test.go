@@ -0,0 +1,102 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/karindrlainux/flying-cup/pkg/types"
+	"github.com/karindrlainux/flying-cup/pkg/webhook"
+)
+
+var errFakeBuild = errors.New("fake build failed")
+
+// fakeBuilder records the apps it is asked to build instead of building them
+type fakeBuilder struct {
+	built []*types.App
+}
+
+func (b *fakeBuilder) BuildImage(ctx context.Context, app *types.App, dockerfile string, nonCache bool) (string, error) {
+	b.built = append(b.built, app)
+	return "", errFakeBuild
+}
+
+func (b *fakeBuilder) RemoveImage(ctx context.Context, imageTag string) error {
+	return nil
+}
+
+// testRepository creates a git repository with a manifest on branch, to clone previews from
+func testRepository(t *testing.T, branch string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, ".flying-cup.yml"), []byte("port: 3000\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"init", "-q", "-b", branch},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, output)
+		}
+	}
+	return dir
+}
+
+func TestDeployBuildsWithBuilder(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	repo := testRepository(t, "feature")
+
+	// Clones are made in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	builder := &fakeBuilder{}
+	provider := NewTraefikProvider(&Config{Domain: "preview.example.com"})
+	provider.SetBuilder(builder)
+
+	hook := &webhook.GithubPRWebhook{Number: 7}
+	hook.Repository.Name = "app"
+	hook.Repository.CloneUrl = repo
+	hook.PullRequest.Title = "login"
+	hook.PullRequest.Head.Ref = "feature"
+
+	if _, err := provider.CreateDeployment(context.Background(), hook); !errors.Is(err, errFakeBuild) {
+		t.Fatalf("CreateDeployment returned %v, want the build error", err)
+	}
+
+	if len(builder.built) != 1 {
+		t.Fatalf("%d builds, want 1", len(builder.built))
+	}
+	app := builder.built[0]
+	if app.Name != "pr-app-7" {
+		t.Errorf("built %s, want pr-app-7", app.Name)
+	}
+	if app.ContainerPort != "3000" {
+		t.Errorf("built for port %s, want the manifest port 3000", app.ContainerPort)
+	}
+	if _, err := os.Stat(filepath.Join(app.SourcePath, ".flying-cup.yml")); err != nil {
+		t.Errorf("built from %s, not the clone: %v", app.SourcePath, err)
+	}
+
+	deployment := provider.deployments[deploymentKeyFor("app", "login", 7)]
+	if deployment == nil || deployment.Phase != PhaseFailed {
+		t.Errorf("deployment %+v, want it failed", deployment)
+	}
+}
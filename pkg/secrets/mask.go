@@ -0,0 +1,63 @@
+package secrets
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Masker hides secret values in text
+type Masker interface {
+	Mask(text string) string
+}
+
+// MaskingWriter masks secrets in everything written through it. Output is
+// buffered per line so a secret split across writes is still masked.
+type MaskingWriter struct {
+	out    io.Writer
+	masker Masker
+	buf    []byte
+	mu     sync.Mutex
+}
+
+// NewMaskingWriter wraps out with secret masking
+func NewMaskingWriter(out io.Writer, masker Masker) *MaskingWriter {
+	return &MaskingWriter{out: out, masker: masker}
+}
+
+func (w *MaskingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexAny(w.buf, "\n\r")
+		if i == -1 {
+			break
+		}
+
+		line := w.masker.Mask(string(w.buf[:i+1]))
+		w.buf = w.buf[i+1:]
+
+		if _, err := io.WriteString(w.out, line); err != nil {
+			return len(p), err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes any buffered partial line
+func (w *MaskingWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.out, w.masker.Mask(string(w.buf)))
+	w.buf = nil
+	return err
+}
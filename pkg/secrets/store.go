@@ -0,0 +1,213 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minMaskLength avoids masking very short values, which would garble unrelated output
+const minMaskLength = 4
+
+// Store keeps per-repository secrets encrypted at rest with AES-GCM
+type Store struct {
+	path    string
+	gcm     cipher.AEAD
+	secrets map[string]map[string]string
+	mu      sync.RWMutex
+}
+
+// NewStore opens the encrypted secrets file at path, creating it on first write.
+// The encryption key is derived from the given passphrase.
+func NewStore(path, passphrase string) (*Store, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("SECRETS_KEY is required to store secrets")
+	}
+
+	key := sha256.Sum256([]byte(passphrase))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+
+	s := &Store{
+		path:    path,
+		gcm:     gcm,
+		secrets: make(map[string]map[string]string),
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Get returns the decrypted secrets of a repository
+func (s *Store) Get(repo string) map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	values := make(map[string]string, len(s.secrets[repo]))
+	for name, value := range s.secrets[repo] {
+		values[name] = value
+	}
+	return values
+}
+
+// Names returns the secret names of a repository, sorted
+func (s *Store) Names(repo string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.secrets[repo]))
+	for name := range s.secrets[repo] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Set stores a secret and persists the store
+func (s *Store) Set(repo, name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.secrets[repo] == nil {
+		s.secrets[repo] = make(map[string]string)
+	}
+	s.secrets[repo][name] = value
+
+	return s.save()
+}
+
+// Delete removes a secret and persists the store
+func (s *Store) Delete(repo, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.secrets[repo], name)
+	if len(s.secrets[repo]) == 0 {
+		delete(s.secrets, repo)
+	}
+
+	return s.save()
+}
+
+// Mask replaces every known secret value in text with ***
+func (s *Store) Mask(text string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, repoSecrets := range s.secrets {
+		for _, value := range repoSecrets {
+			if len(value) >= minMaskLength {
+				text = strings.ReplaceAll(text, value, "***")
+			}
+		}
+	}
+	return text
+}
+
+// load reads and decrypts the secrets file, if any
+func (s *Store) load() error {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read secrets file: %w", err)
+	}
+
+	var encrypted map[string]map[string]string
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return fmt.Errorf("failed to parse secrets file: %w", err)
+	}
+
+	for repo, repoSecrets := range encrypted {
+		s.secrets[repo] = make(map[string]string, len(repoSecrets))
+		for name, ciphertext := range repoSecrets {
+			value, err := s.decrypt(ciphertext)
+			if err != nil {
+				return fmt.Errorf("failed to decrypt secret %s/%s (wrong SECRETS_KEY?): %w", repo, name, err)
+			}
+			s.secrets[repo][name] = value
+		}
+	}
+
+	return nil
+}
+
+// save encrypts and writes the secrets file atomically; callers must hold the lock
+func (s *Store) save() error {
+	encrypted := make(map[string]map[string]string, len(s.secrets))
+	for repo, repoSecrets := range s.secrets {
+		encrypted[repo] = make(map[string]string, len(repoSecrets))
+		for name, value := range repoSecrets {
+			ciphertext, err := s.encrypt(value)
+			if err != nil {
+				return err
+			}
+			encrypted[repo][name] = ciphertext
+		}
+	}
+
+	data, err := json.MarshalIndent(encrypted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode secrets: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return fmt.Errorf("failed to create secrets directory: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write secrets file: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Store) encrypt(value string) (string, error) {
+	nonce := make([]byte, s.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := s.gcm.Seal(nonce, nonce, []byte(value), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (s *Store) decrypt(ciphertext string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < s.gcm.NonceSize() {
+		return "", fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, sealed := sealed[:s.gcm.NonceSize()], sealed[s.gcm.NonceSize():]
+	value, err := s.gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(value), nil
+}
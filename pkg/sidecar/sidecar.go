@@ -0,0 +1,313 @@
+package sidecar
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/karindrlainux/flying-cup/pkg/docker"
+	"github.com/karindrlainux/flying-cup/pkg/git"
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+// OwnerLabel marks sidecar containers and volumes with the preview they belong to
+const OwnerLabel = "flying-cup.sidecar-of"
+
+// seedDir is where seed files are copied inside the sidecar
+const seedDir = "/tmp"
+
+// Options configures where sidecars run
+type Options struct {
+	// Prefix names the sidecar containers and volumes, e.g. pr-myapp-12
+	Prefix string
+	// Network is the per-preview network shared with the app
+	Network string
+	// Labels are added to every sidecar container and volume
+	Labels map[string]string
+	// RepoPath is the cloned repository seed files are read from. Without a clone, e.g.
+	// on a rollback, seed files are skipped and only seed commands run.
+	RepoPath string
+	// ReadyTimeout bounds how long a sidecar may take to accept connections
+	ReadyTimeout time.Duration
+}
+
+// credentials are generated for every sidecar
+type credentials struct {
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Database string
+}
+
+// engine describes how to run, probe and seed one type of sidecar
+type engine struct {
+	image        func(version string) string
+	port         string
+	user         string
+	database     string
+	dataDir      string
+	containerEnv func(c credentials) []string
+	cmd          func(c credentials) []string
+	ready        []string
+	seed         func(file string) []string
+	url          func(c credentials) string
+}
+
+var engines = map[string]engine{
+	"postgres": {
+		image:    func(version string) string { return fmt.Sprintf("postgres:%s-alpine", orDefault(version, "16")) },
+		port:     "5432",
+		user:     "app",
+		database: "app",
+		dataDir:  "/var/lib/postgresql/data",
+		containerEnv: func(c credentials) []string {
+			return []string{"POSTGRES_USER=" + c.User, "POSTGRES_PASSWORD=" + c.Password, "POSTGRES_DB=" + c.Database, "PGPASSWORD=" + c.Password}
+		},
+		// The init scripts run a socket-only server, so probe TCP to wait for the final one
+		ready: []string{"sh", "-c", `pg_isready -h 127.0.0.1 -U "$POSTGRES_USER" -d "$POSTGRES_DB"`},
+		seed: func(file string) []string {
+			return []string{"sh", "-c", fmt.Sprintf(`psql -v ON_ERROR_STOP=1 -h 127.0.0.1 -U "$POSTGRES_USER" -d "$POSTGRES_DB" -f %s`, file)}
+		},
+		url: func(c credentials) string {
+			return fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable", c.User, c.Password, c.Host, c.Port, c.Database)
+		},
+	},
+	"mysql": {
+		image:    func(version string) string { return fmt.Sprintf("mysql:%s", orDefault(version, "8.4")) },
+		port:     "3306",
+		user:     "app",
+		database: "app",
+		dataDir:  "/var/lib/mysql",
+		containerEnv: func(c credentials) []string {
+			return []string{"MYSQL_USER=" + c.User, "MYSQL_PASSWORD=" + c.Password, "MYSQL_DATABASE=" + c.Database, "MYSQL_RANDOM_ROOT_PASSWORD=yes"}
+		},
+		// The init scripts run with networking disabled, so probe TCP to wait for the final server
+		ready: []string{"sh", "-c", `mysqladmin ping -h 127.0.0.1 -u"$MYSQL_USER" -p"$MYSQL_PASSWORD" --silent`},
+		seed: func(file string) []string {
+			return []string{"sh", "-c", fmt.Sprintf(`mysql -h 127.0.0.1 -u"$MYSQL_USER" -p"$MYSQL_PASSWORD" "$MYSQL_DATABASE" < %s`, file)}
+		},
+		url: func(c credentials) string {
+			return fmt.Sprintf("mysql://%s:%s@%s:%s/%s", c.User, c.Password, c.Host, c.Port, c.Database)
+		},
+	},
+	"redis": {
+		image:    func(version string) string { return fmt.Sprintf("redis:%s-alpine", orDefault(version, "7")) },
+		port:     "6379",
+		database: "0",
+		dataDir:  "/data",
+		containerEnv: func(c credentials) []string {
+			return []string{"REDISCLI_AUTH=" + c.Password}
+		},
+		cmd: func(c credentials) []string {
+			return []string{"redis-server", "--requirepass", c.Password}
+		},
+		ready: []string{"sh", "-c", "redis-cli ping | grep -q PONG"},
+		seed: func(file string) []string {
+			return []string{"sh", "-c", fmt.Sprintf("redis-cli < %s", file)}
+		},
+		url: func(c credentials) string {
+			return fmt.Sprintf("redis://:%s@%s:%s/%s", c.Password, c.Host, c.Port, c.Database)
+		},
+	},
+}
+
+// Start replaces the preview's sidecars with fresh ones, waits until they accept
+// connections, seeds them and returns the environment variables to inject into the app
+func Start(ctx context.Context, runner *docker.DockerRunner, services []manifest.ServiceConfig, opts Options) ([]string, error) {
+	// Every deploy gets fresh, freshly seeded sidecars
+	if err := Remove(ctx, runner, opts.Prefix); err != nil {
+		return nil, err
+	}
+
+	var env []string
+	for _, service := range services {
+		serviceEnv, err := start(ctx, runner, service, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start %s sidecar %s: %w", service.Type, service.Name, err)
+		}
+		env = append(env, serviceEnv...)
+	}
+
+	return env, nil
+}
+
+// Remove removes the sidecar containers and volumes of a preview
+func Remove(ctx context.Context, runner *docker.DockerRunner, prefix string) error {
+	return runner.RemoveResources(ctx, OwnerLabel, prefix)
+}
+
+func start(ctx context.Context, runner *docker.DockerRunner, service manifest.ServiceConfig, opts Options) ([]string, error) {
+	eng, ok := engines[service.Type]
+	if !ok {
+		return nil, fmt.Errorf("unsupported sidecar type %q (supported: postgres, mysql, redis)", service.Type)
+	}
+	if service.Name == "" {
+		return nil, fmt.Errorf("sidecar name is required")
+	}
+
+	password, err := generatePassword()
+	if err != nil {
+		return nil, err
+	}
+
+	// Sidecars are reached by their container name, which is unique to the release, so the
+	// sidecars of a new release never answer for the live one on the shared network
+	name := fmt.Sprintf("%s-%s", opts.Prefix, service.Name)
+
+	creds := credentials{
+		Host:     name,
+		Port:     eng.port,
+		User:     eng.user,
+		Password: password,
+		Database: eng.database,
+	}
+
+	labels := map[string]string{OwnerLabel: opts.Prefix, "flying-cup.sidecar": service.Name}
+	for key, value := range opts.Labels {
+		labels[key] = value
+	}
+
+	image := eng.image(service.Version)
+	if err := runner.PullImage(ctx, image); err != nil {
+		return nil, err
+	}
+
+	volumeName := name + "-data"
+	if err := runner.CreateVolume(ctx, volumeName, labels); err != nil {
+		return nil, err
+	}
+
+	containerConfig := &container.Config{
+		Image:  image,
+		Env:    eng.containerEnv(creds),
+		Labels: labels,
+	}
+	if eng.cmd != nil {
+		containerConfig.Cmd = eng.cmd(creds)
+	}
+
+	hostConfig := &container.HostConfig{
+		NetworkMode: container.NetworkMode(opts.Network),
+		RestartPolicy: container.RestartPolicy{
+			Name: "unless-stopped",
+		},
+		Mounts: []mount.Mount{{Type: mount.TypeVolume, Source: volumeName, Target: eng.dataDir}},
+	}
+
+	networkingConfig := &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{
+			opts.Network: {Aliases: []string{name}},
+		},
+	}
+
+	resp, err := runner.Client.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, nil, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container: %w", err)
+	}
+
+	if err := runner.Client.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to start container: %w", err)
+	}
+
+	log.Printf("Waiting for %s sidecar %s to be ready...", service.Type, service.Name)
+
+	readyCtx, cancel := context.WithTimeout(ctx, opts.ReadyTimeout)
+	defer cancel()
+
+	if err := runner.WaitForExec(readyCtx, resp.ID, eng.ready, time.Second); err != nil {
+		return nil, err
+	}
+
+	if err := seed(ctx, runner, resp.ID, eng, service, opts.RepoPath); err != nil {
+		return nil, err
+	}
+
+	log.Printf("✅ %s sidecar %s ready", service.Type, service.Name)
+	return appEnv(service.Name, creds, eng.url(creds)), nil
+}
+
+// seed loads the seed files, then runs the seed commands inside the sidecar
+func seed(ctx context.Context, runner *docker.DockerRunner, containerID string, eng engine, service manifest.ServiceConfig, repoPath string) error {
+	if len(service.Seed) > 0 && repoPath == "" {
+		log.Printf("Skipping the seed files of %s, no clone to read them from", service.Name)
+	} else if len(service.Seed) > 0 {
+		paths := make([]string, 0, len(service.Seed))
+		for _, file := range service.Seed {
+			// Symlinks are resolved, so a seed file cannot copy a host file into the database
+			path, err := git.ResolvePath(repoPath, file)
+			if err != nil {
+				return fmt.Errorf("invalid seed file: %w", err)
+			}
+			paths = append(paths, path)
+		}
+
+		if err := runner.CopyFilesToContainer(ctx, containerID, seedDir, paths); err != nil {
+			return err
+		}
+
+		for _, file := range service.Seed {
+			log.Printf("Seeding %s with %s", service.Name, file)
+			if err := run(ctx, runner, containerID, eng.seed(seedDir+"/"+filepath.Base(file))); err != nil {
+				return fmt.Errorf("seed file %s failed: %w", file, err)
+			}
+		}
+	}
+
+	for _, command := range service.Commands {
+		log.Printf("Running on %s: %s", service.Name, command)
+		if err := run(ctx, runner, containerID, []string{"sh", "-c", command}); err != nil {
+			return fmt.Errorf("command %q failed: %w", command, err)
+		}
+	}
+
+	return nil
+}
+
+func run(ctx context.Context, runner *docker.DockerRunner, containerID string, cmd []string) error {
+	result, err := runner.Exec(ctx, containerID, cmd, nil)
+	if err != nil {
+		return err
+	}
+	if result.ExitCode != 0 {
+		return fmt.Errorf("exit code %d: %s", result.ExitCode, strings.TrimSpace(result.Output))
+	}
+	return nil
+}
+
+// appEnv returns the connection settings as NAME_URL, NAME_HOST, ... for a sidecar named name
+func appEnv(name string, c credentials, url string) []string {
+	prefix := strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+
+	return []string{
+		prefix + "_URL=" + url,
+		prefix + "_HOST=" + c.Host,
+		prefix + "_PORT=" + c.Port,
+		prefix + "_USER=" + c.User,
+		prefix + "_PASSWORD=" + c.Password,
+		prefix + "_DATABASE=" + c.Database,
+	}
+}
+
+func generatePassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func orDefault(value, defaultValue string) string {
+	if value != "" {
+		return value
+	}
+	return defaultValue
+}
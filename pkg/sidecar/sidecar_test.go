@@ -0,0 +1,54 @@
+package sidecar
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/karindrlainux/flying-cup/pkg/manifest"
+)
+
+func TestSeedRefusesFilesOutsideTheRepository(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, ".env"), []byte("GITHUB_TOKEN=secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo := t.TempDir()
+	if err := os.Mkdir(filepath.Join(repo, "db"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{
+		"dump.sql":   filepath.Join(outside, ".env"),
+		"db/env.sql": "../../" + filepath.Base(outside) + "/.env",
+		"host":       outside,
+	} {
+		if err := os.Symlink(target, filepath.Join(repo, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		file string
+	}{
+		{name: "symlinked seed file", file: "dump.sql"},
+		{name: "relative symlink", file: "db/env.sql"},
+		{name: "symlinked directory", file: "host/.env"},
+		{name: "parent directory", file: "../" + filepath.Base(outside) + "/.env"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := manifest.ServiceConfig{Name: "database", Type: "postgres", Seed: []string{tt.file}}
+
+			// The runner is never used, the seed file is refused before anything is copied
+			err := seed(context.Background(), nil, "sidecar-id", engine{}, service, repo)
+			if err == nil || !strings.Contains(err.Error(), "outside the repository") {
+				t.Errorf("seeding with %s returned %v, want it refused", tt.file, err)
+			}
+		})
+	}
+}
@@ -1,7 +1,15 @@
 package types
 
+import "github.com/karindrlainux/flying-cup/pkg/manifest"
+
 type App struct {
 	Name          string
 	SourcePath    string
 	ContainerPort string
+	Manifest      *manifest.Manifest
+	// Env is the container environment as KEY=value pairs
+	Env []string
+	// Networks the container is connected to, the first one being its own.
+	// Defaults to the shared web network when empty.
+	Networks []string
 }
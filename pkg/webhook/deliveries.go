@@ -0,0 +1,219 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery statuses
+const (
+	DeliveryProcessed = "processed"
+	DeliveryFailed    = "failed"
+)
+
+// validDeliveryID keeps delivery IDs safe to use as file names
+var validDeliveryID = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// Delivery is a webhook received from GitHub, identified by its X-GitHub-Delivery header
+type Delivery struct {
+	ID string `json:"id"`
+	// Event is the X-GitHub-Event header, e.g. pull_request
+	Event    string    `json:"event,omitempty"`
+	Received time.Time `json:"received"`
+	Status   string    `json:"status"`
+	// Duplicates counts the redeliveries skipped within the dedup window
+	Duplicates int    `json:"duplicates"`
+	Action     string `json:"action,omitempty"`
+	Repo       string `json:"repo,omitempty"`
+	PR         int    `json:"pr,omitempty"`
+	// Body is the raw payload, only kept on disk
+	Body string `json:"body,omitempty"`
+}
+
+// DeliveryStore records the webhook deliveries with their payloads, to skip
+// redeliveries and replay a delivery later
+type DeliveryStore struct {
+	dir       string
+	window    time.Duration
+	retention time.Duration
+
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+// NewDeliveryStore opens the deliveries stored in dir. Redeliveries within window are
+// skipped, and deliveries are kept for retention.
+func NewDeliveryStore(dir string, window, retention time.Duration) (*DeliveryStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create deliveries directory: %w", err)
+	}
+
+	s := &DeliveryStore{dir: dir, window: window, retention: retention, deliveries: make(map[string]*Delivery)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deliveries directory: %w", err)
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		delivery, err := s.read(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil {
+			log.Printf("Warning: skipping delivery %s: %v", entry.Name(), err)
+			continue
+		}
+		delivery.Body = ""
+		s.deliveries[delivery.ID] = delivery
+	}
+
+	s.prune()
+	return s, nil
+}
+
+// begin records a delivery before it is handled. It returns false for a redelivery
+// within the dedup window of a delivery that did not fail.
+func (s *DeliveryStore) begin(id, event string, body []byte, summary deliverySummary) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, exists := s.deliveries[id]; exists && existing.Status != DeliveryFailed && time.Since(existing.Received) < s.window {
+		existing.Duplicates++
+		return false, s.write(existing, body)
+	}
+
+	delivery := &Delivery{
+		ID:       id,
+		Event:    event,
+		Received: time.Now(),
+		Status:   DeliveryProcessed,
+		Action:   summary.Action,
+		Repo:     summary.Repo,
+		PR:       summary.PR,
+	}
+	s.deliveries[id] = delivery
+	s.prune()
+
+	return true, s.write(delivery, body)
+}
+
+// fail marks a delivery whose handling failed, so a redelivery is handled again
+func (s *DeliveryStore) fail(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delivery, exists := s.deliveries[id]
+	if !exists {
+		return
+	}
+	delivery.Status = DeliveryFailed
+
+	stored, err := s.read(id)
+	if err != nil {
+		log.Printf("Warning: failed to read delivery %s: %v", id, err)
+		return
+	}
+	if err := s.write(delivery, []byte(stored.Body)); err != nil {
+		log.Printf("Warning: failed to update delivery %s: %v", id, err)
+	}
+}
+
+// List returns the stored deliveries without their payloads, newest first
+func (s *DeliveryStore) List() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := make([]Delivery, 0, len(s.deliveries))
+	for _, delivery := range s.deliveries {
+		deliveries = append(deliveries, *delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].Received.After(deliveries[j].Received) })
+	return deliveries
+}
+
+// Get returns a stored delivery with its payload
+func (s *DeliveryStore) Get(id string) (*Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.deliveries[id]; !exists {
+		return nil, fmt.Errorf("delivery not found: %s", id)
+	}
+	return s.read(id)
+}
+
+// prune removes the deliveries older than the retention; callers must hold the lock
+func (s *DeliveryStore) prune() {
+	for id, delivery := range s.deliveries {
+		if time.Since(delivery.Received) < s.retention {
+			continue
+		}
+
+		delete(s.deliveries, id)
+		if err := os.Remove(s.path(id)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove delivery %s: %v", id, err)
+		}
+	}
+}
+
+func (s *DeliveryStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *DeliveryStore) read(id string) (*Delivery, error) {
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery: %w", err)
+	}
+
+	var delivery Delivery
+	if err := json.Unmarshal(data, &delivery); err != nil {
+		return nil, fmt.Errorf("failed to decode delivery: %w", err)
+	}
+	return &delivery, nil
+}
+
+// write stores a delivery with its payload atomically
+func (s *DeliveryStore) write(delivery *Delivery, body []byte) error {
+	stored := *delivery
+	stored.Body = string(body)
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode delivery: %w", err)
+	}
+
+	tmp := s.path(delivery.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write delivery: %w", err)
+	}
+	return os.Rename(tmp, s.path(delivery.ID))
+}
+
+type deliveryContextKey struct{}
+
+// deliveryContext tells the handlers which delivery they handle
+type deliveryContext struct {
+	id     string
+	replay bool
+}
+
+// DeliveryFromContext returns the ID of the delivery being handled, and whether it is replayed
+func DeliveryFromContext(ctx context.Context) (id string, replay bool) {
+	delivery, _ := ctx.Value(deliveryContextKey{}).(deliveryContext)
+	return delivery.id, delivery.replay
+}
+
+func withDelivery(ctx context.Context, id string, replay bool) context.Context {
+	return context.WithValue(ctx, deliveryContextKey{}, deliveryContext{id: id, replay: replay})
+}
@@ -0,0 +1,157 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestDeliveryStoreBegin(t *testing.T) {
+	tests := []struct {
+		name string
+		// previous is the stored state of the delivery before the redelivery, nil for none
+		previous       *Delivery
+		wantHandle     bool
+		wantDuplicates int
+	}{
+		{
+			name:       "new delivery",
+			wantHandle: true,
+		},
+		{
+			name:           "redelivery within the window",
+			previous:       &Delivery{Status: DeliveryProcessed, Received: time.Now().Add(-time.Minute)},
+			wantHandle:     false,
+			wantDuplicates: 1,
+		},
+		{
+			name:       "redelivery of a failed delivery",
+			previous:   &Delivery{Status: DeliveryFailed, Received: time.Now().Add(-time.Minute)},
+			wantHandle: true,
+		},
+		{
+			name:       "redelivery after the window",
+			previous:   &Delivery{Status: DeliveryProcessed, Received: time.Now().Add(-2 * time.Hour)},
+			wantHandle: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewDeliveryStore(t.TempDir(), time.Hour, 24*time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.previous != nil {
+				if _, err := store.begin("delivery-1", "pull_request", []byte(`{}`), deliverySummary{}); err != nil {
+					t.Fatal(err)
+				}
+				store.deliveries["delivery-1"].Status = tt.previous.Status
+				store.deliveries["delivery-1"].Received = tt.previous.Received
+			}
+
+			handle, err := store.begin("delivery-1", "pull_request", []byte(`{"action":"opened"}`), deliverySummary{Action: "opened", Repo: "app", PR: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if handle != tt.wantHandle {
+				t.Errorf("begin returned %t, want %t", handle, tt.wantHandle)
+			}
+
+			stored, err := store.Get("delivery-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Duplicates != tt.wantDuplicates {
+				t.Errorf("%d duplicates recorded, want %d", stored.Duplicates, tt.wantDuplicates)
+			}
+			if stored.Body != `{"action":"opened"}` {
+				t.Errorf("stored payload %q, want the latest one", stored.Body)
+			}
+		})
+	}
+}
+
+func TestDeliveryStorePrunesExpiredDeliveries(t *testing.T) {
+	store, err := NewDeliveryStore(t.TempDir(), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.begin("old", "pull_request", []byte(`{}`), deliverySummary{}); err != nil {
+		t.Fatal(err)
+	}
+	store.deliveries["old"].Received = time.Now().Add(-48 * time.Hour)
+
+	if _, err := store.begin("new", "pull_request", []byte(`{}`), deliverySummary{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Get("old"); err == nil {
+		t.Error("delivery past the retention is still listed")
+	}
+	if _, err := os.Stat(store.path("old")); !os.IsNotExist(err) {
+		t.Errorf("delivery past the retention is still stored: %v", err)
+	}
+	if len(store.List()) != 1 {
+		t.Errorf("%d deliveries listed, want 1", len(store.List()))
+	}
+}
+
+func TestHandleGithubWebhookRetriesFailedDeliveries(t *testing.T) {
+	store, err := NewDeliveryStore(t.TempDir(), time.Hour, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls := 0
+	handler := HandleGithubWebhook("", store, Handlers{
+		OnPROpened: func(ctx context.Context, webhook *GithubPRWebhook) error {
+			calls++
+			if calls == 1 {
+				return errors.New("queue unavailable")
+			}
+			return nil
+		},
+	})
+
+	payload := url.Values{"payload": {`{"action": "opened", "number": 1, "repository": {"name": "app"}}`}}.Encode()
+	deliver := func() int {
+		req := httptest.NewRequest(http.MethodPost, "/webhook/github", strings.NewReader(payload))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-GitHub-Event", "pull_request")
+		req.Header.Set("X-GitHub-Delivery", "delivery-1")
+		rec := httptest.NewRecorder()
+
+		if err := handler(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+
+	if code := deliver(); code != http.StatusInternalServerError {
+		t.Fatalf("first delivery answered %d, want %d", code, http.StatusInternalServerError)
+	}
+	if stored, _ := store.Get("delivery-1"); stored == nil || stored.Status != DeliveryFailed {
+		t.Fatalf("delivery %+v, want it failed", stored)
+	}
+
+	if code := deliver(); code != http.StatusOK {
+		t.Fatalf("redelivery answered %d, want %d", code, http.StatusOK)
+	}
+	if calls != 2 {
+		t.Errorf("handled %d times, want the failed delivery handled again", calls)
+	}
+	if stored, _ := store.Get("delivery-1"); stored == nil || stored.Status != DeliveryProcessed {
+		t.Errorf("delivery %+v, want it processed", stored)
+	}
+}
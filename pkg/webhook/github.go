@@ -35,20 +35,64 @@ type Repository struct {
 }
 
 type PullRequest struct {
-	Id    int    `json:"id"`
-	Title string `json:"title"`
-	Url   string `json:"url"`
-	Head  struct {
+	Id     int     `json:"id"`
+	Title  string  `json:"title"`
+	Url    string  `json:"url"`
+	Labels []Label `json:"labels"`
+	Head   struct {
 		Ref string `json:"ref"`
 		Sha string `json:"sha"`
 	} `json:"head"`
 }
 
-func HandleGithubWebhook(
-	webhookSecret string,
-	onPROpened func(ctx context.Context, webhook *GithubPRWebhook) error,
-	onPRClosed func(ctx context.Context, webhook *GithubPRWebhook) error,
-) echo.HandlerFunc {
+type Label struct {
+	Name string `json:"name"`
+}
+
+// HasLabel reports whether the pull request carries the label
+func (pr PullRequest) HasLabel(name string) bool {
+	for _, label := range pr.Labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// GithubCommentWebhook is an issue_comment event; Issue.PullRequest is set for comments on pull requests
+type GithubCommentWebhook struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number      int    `json:"number"`
+		Title       string `json:"title"`
+		PullRequest *struct {
+			Url string `json:"url"`
+		} `json:"pull_request"`
+	} `json:"issue"`
+	Comment struct {
+		Body string `json:"body"`
+		User Sender `json:"user"`
+		// AuthorAssociation is the relation of the author to the repository, e.g. OWNER or CONTRIBUTOR
+		AuthorAssociation string `json:"author_association"`
+	} `json:"comment"`
+	Repository Repository `json:"repository"`
+	Sender     Sender     `json:"sender"`
+}
+
+// Handlers are called for the GitHub events flying-cup acts on; nil handlers ignore their events
+type Handlers struct {
+	// OnPROpened is called when a pull request is opened, reopened or pushed to
+	OnPROpened func(ctx context.Context, webhook *GithubPRWebhook) error
+	OnPRClosed func(ctx context.Context, webhook *GithubPRWebhook) error
+	// OnPRLabeled is called when the labels of a pull request change
+	OnPRLabeled func(ctx context.Context, webhook *GithubPRWebhook) error
+	// OnPRComment is called for new comments on pull requests
+	OnPRComment func(ctx context.Context, webhook *GithubCommentWebhook) error
+}
+
+// HandleGithubWebhook handles the pull request and comment webhooks of GitHub.
+// Deliveries are recorded in deliveries, if not nil, to skip redeliveries.
+func HandleGithubWebhook(webhookSecret string, deliveries *DeliveryStore, handlers Handlers) echo.HandlerFunc {
 	return func(c echo.Context) error {
 
 		body, err := io.ReadAll(c.Request().Body)
@@ -59,98 +103,194 @@ func HandleGithubWebhook(
 
 		signature := c.Request().Header.Get("X-Hub-Signature-256")
 
-		fmt.Println(c.Request().Header)
-
 		if err := validateSignature(body, signature, webhookSecret); err != nil {
 			return c.String(http.StatusUnauthorized, "Invalid signature")
 		}
 
+		event := c.Request().Header.Get("X-GitHub-Event")
+		deliveryID := c.Request().Header.Get("X-GitHub-Delivery")
+		log.Printf("📨 Received %s delivery %s", event, deliveryID)
+
 		// Parse Webhook
-		webhook, err := parseWebhook(body)
+		summary, err := summarize(event, body)
 
 		if err != nil {
 			return c.String(http.StatusBadRequest, "Failed to parse webhook")
 		}
 
-		switch webhook.Action {
-		case "opened":
-			return handlePROpened(c, webhook, onPROpened)
-		case "reopened":
-			return handlePROpened(c, webhook, onPROpened)
-		case "closed":
-			return handlePRClosed(c, webhook, onPRClosed)
-		default:
-			return c.JSON(http.StatusOK, map[string]string{"status": "ignored"})
+		if deliveries != nil && validDeliveryID.MatchString(deliveryID) {
+			handle, err := deliveries.begin(deliveryID, event, body, summary)
+			if err != nil {
+				log.Printf("Warning: failed to record delivery %s: %v", deliveryID, err)
+			}
+			if !handle {
+				log.Printf("⏭️  Skipping redelivery %s of PR #%d", deliveryID, summary.PR)
+				return c.JSON(http.StatusOK, map[string]string{"status": "duplicate"})
+			}
+		}
+
+		c.SetRequest(c.Request().WithContext(withDelivery(c.Request().Context(), deliveryID, false)))
+		err = dispatch(c, event, body, handlers)
+
+		// A handler may fail without writing a response, which leaves the status at 200
+		if deliveries != nil && (err != nil || c.Response().Status >= http.StatusBadRequest) {
+			deliveries.fail(deliveryID)
 		}
+		return err
 	}
 }
 
-func handlePRClosed(c echo.Context, webhook *GithubPRWebhook, onPRClosed func(ctx context.Context, webhook *GithubPRWebhook) error) error {
+// ReplayDelivery handles a stored delivery again, by the ID in the :id path parameter
+func ReplayDelivery(deliveries *DeliveryStore, handlers Handlers) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		delivery, err := deliveries.Get(c.Param("id"))
+		if err != nil {
+			return c.String(http.StatusNotFound, err.Error())
+		}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("❌ Webhook handler panic for PR #%d: %v", webhook.Number, r)
-			}
-		}()
+		log.Printf("🔁 Replaying delivery %s (%s) of PR #%d", delivery.ID, delivery.Action, delivery.PR)
 
-		log.Printf("📝 Processing PR closed event for PR #%d", webhook.Number)
+		c.SetRequest(c.Request().WithContext(withDelivery(c.Request().Context(), delivery.ID, true)))
+		return dispatch(c, delivery.Event, []byte(delivery.Body), handlers)
+	}
+}
 
-		err := onPRClosed(context.Background(), webhook)
+// deliverySummary identifies what a delivery is about
+type deliverySummary struct {
+	Action string
+	Repo   string
+	PR     int
+}
 
+// summarize parses a delivery just enough to record it
+func summarize(event string, body []byte) (deliverySummary, error) {
+	if event == "issue_comment" {
+		comment, err := parseCommentWebhook(body)
 		if err != nil {
-			log.Printf("❌ PR closed handler failed for PR #%d: %v", webhook.Number, err)
-		} else {
-			log.Printf("✅ PR closed handler completed for PR #%d", webhook.Number)
+			return deliverySummary{}, err
 		}
-	}()
+		return deliverySummary{Action: comment.Action, Repo: comment.Repository.Name, PR: comment.Issue.Number}, nil
+	}
 
-	return c.JSON(http.StatusOK, map[string]string{"status": "handle pr closed triggered"})
+	webhook, err := parseWebhook(body)
+	if err != nil {
+		return deliverySummary{}, err
+	}
+	return deliverySummary{Action: webhook.Action, Repo: webhook.Repository.Name, PR: webhook.Number}, nil
 }
 
-func handlePROpened(c echo.Context, webhook *GithubPRWebhook, onPROpened func(ctx context.Context, webhook *GithubPRWebhook) error) error {
+// dispatch hands a webhook to the handler of its event and action
+func dispatch(c echo.Context, event string, body []byte, handlers Handlers) error {
+	if event == "issue_comment" {
+		comment, err := parseCommentWebhook(body)
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Failed to parse webhook")
+		}
+		if comment.Action != "created" || comment.Issue.PullRequest == nil || handlers.OnPRComment == nil {
+			return c.JSON(http.StatusOK, map[string]string{"status": "ignored"})
+		}
+		return handlePRComment(c, comment, handlers.OnPRComment)
+	}
+
+	// Deliveries without an event header are pull request events
+	webhook, err := parseWebhook(body)
+	if err != nil {
+		return c.String(http.StatusBadRequest, "Failed to parse webhook")
+	}
+
+	switch webhook.Action {
+	case "opened":
+		return handlePROpened(c, webhook, handlers.OnPROpened)
+	case "reopened":
+		return handlePROpened(c, webhook, handlers.OnPROpened)
+	case "synchronize":
+		// New commits were pushed to the PR
+		return handlePROpened(c, webhook, handlers.OnPROpened)
+	case "closed":
+		return handlePRClosed(c, webhook, handlers.OnPRClosed)
+	case "labeled", "unlabeled":
+		if handlers.OnPRLabeled == nil {
+			break
+		}
+		if err := handlers.OnPRLabeled(c.Request().Context(), webhook); err != nil {
+			log.Printf("❌ PR labeled handler failed for PR #%d: %v", webhook.Number, err)
+			return c.String(http.StatusInternalServerError, "Failed to handle labels")
+		}
+		return c.JSON(http.StatusOK, map[string]string{"status": "labels updated"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"status": "ignored"})
+}
+
+// handlePRComment handles the comment in the background
+func handlePRComment(c echo.Context, comment *GithubCommentWebhook, onPRComment func(ctx context.Context, webhook *GithubCommentWebhook) error) error {
+	ctx := context.WithoutCancel(c.Request().Context())
 
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
-				log.Printf("❌ PR opened panic for PR #%d: %v", webhook.Number, r)
+				log.Printf("❌ Webhook handler panic for comment on PR #%d: %v", comment.Issue.Number, r)
 			}
 		}()
 
-		err := onPROpened(context.Background(), webhook)
-
-		if err != nil {
-			log.Printf("❌ PR opened failed for PR #%d: %v", webhook.Number, err)
-		} else {
-			log.Printf("✅ PR opened completed for PR #%d", webhook.Number)
+		if err := onPRComment(ctx, comment); err != nil {
+			log.Printf("❌ PR comment handler failed for PR #%d: %v", comment.Issue.Number, err)
 		}
 	}()
 
-	return c.JSON(http.StatusOK, map[string]string{"status": "handle pr opened triggered"})
+	return c.JSON(http.StatusOK, map[string]string{"status": "handle pr comment triggered"})
 }
 
-func parseWebhook(body []byte) (*GithubPRWebhook, error) {
-	var webhook GithubPRWebhook
+// handlePRClosed acknowledges the webhook only once onPRClosed returns, so it must
+// only record the cleanup, e.g. in a durable queue
+func handlePRClosed(c echo.Context, webhook *GithubPRWebhook, onPRClosed func(ctx context.Context, webhook *GithubPRWebhook) error) error {
+	log.Printf("📝 Processing PR closed event for PR #%d", webhook.Number)
 
-	formData, err := url.ParseQuery(string(body))
+	if err := onPRClosed(c.Request().Context(), webhook); err != nil {
+		log.Printf("❌ PR closed handler failed for PR #%d: %v", webhook.Number, err)
+		return c.String(http.StatusInternalServerError, "Failed to queue cleanup")
+	}
+
+	log.Printf("✅ PR closed queued for PR #%d", webhook.Number)
+	return c.JSON(http.StatusOK, map[string]string{"status": "handle pr closed triggered"})
+}
+
+// handlePROpened acknowledges the webhook only once onPROpened returns, so it must
+// only record the deploy, e.g. in a durable queue. Failed deliveries are not redelivered
+// by GitHub on their own, they are listed for a manual redelivery or replay.
+func handlePROpened(c echo.Context, webhook *GithubPRWebhook, onPROpened func(ctx context.Context, webhook *GithubPRWebhook) error) error {
+	if err := onPROpened(c.Request().Context(), webhook); err != nil {
+		log.Printf("❌ PR opened failed for PR #%d: %v", webhook.Number, err)
+		return c.String(http.StatusInternalServerError, "Failed to queue deployment")
+	}
+
+	log.Printf("✅ PR opened queued for PR #%d", webhook.Number)
+	return c.JSON(http.StatusOK, map[string]string{"status": "handle pr opened triggered"})
+}
+
+func parseCommentWebhook(body []byte) (*GithubCommentWebhook, error) {
+	payload, err := decodePayload(body)
 	if err != nil {
-		log.Println("Error parsing form data:", err)
-		return nil, echo.NewHTTPError(400, "Invalid form data")
+		return nil, err
 	}
 
-	payloadStr := formData.Get("payload")
-	if payloadStr == "" {
-		log.Println("Error: No payload field in form data")
-		return nil, echo.NewHTTPError(400, "No payload field")
+	var comment GithubCommentWebhook
+	if err := json.Unmarshal(payload, &comment); err != nil {
+		log.Println("Error unmarshalling decoded payload:", err)
+		return nil, echo.NewHTTPError(400, "Invalid JSON payload")
 	}
+	return &comment, nil
+}
 
-	decodedPayload, err := url.QueryUnescape(payloadStr)
+func parseWebhook(body []byte) (*GithubPRWebhook, error) {
+	var webhook GithubPRWebhook
+
+	decodedPayload, err := decodePayload(body)
 	if err != nil {
-		log.Println("Error decoding payload:", err)
-		return nil, echo.NewHTTPError(400, "Invalid URL encoding")
+		return nil, err
 	}
 
-	if err := json.Unmarshal([]byte(decodedPayload), &webhook); err != nil {
+	if err := json.Unmarshal(decodedPayload, &webhook); err != nil {
 		log.Println("Error unmarshalling decoded payload:", err)
 		return nil, echo.NewHTTPError(400, "Invalid JSON payload")
 	}
@@ -166,11 +306,31 @@ func parseWebhook(body []byte) (*GithubPRWebhook, error) {
 
 	return &webhook, nil
 }
-func validateSignature(body []byte, signature string, webhookSecret string) error {
 
-	fmt.Printf("webhookSecret: %s\n", webhookSecret)
-	fmt.Printf("signature: %s\n", signature)
+// decodePayload extracts the JSON payload of a form encoded webhook
+func decodePayload(body []byte) ([]byte, error) {
+	formData, err := url.ParseQuery(string(body))
+	if err != nil {
+		log.Println("Error parsing form data:", err)
+		return nil, echo.NewHTTPError(400, "Invalid form data")
+	}
 
+	payloadStr := formData.Get("payload")
+	if payloadStr == "" {
+		log.Println("Error: No payload field in form data")
+		return nil, echo.NewHTTPError(400, "No payload field")
+	}
+
+	decodedPayload, err := url.QueryUnescape(payloadStr)
+	if err != nil {
+		log.Println("Error decoding payload:", err)
+		return nil, echo.NewHTTPError(400, "Invalid URL encoding")
+	}
+
+	return []byte(decodedPayload), nil
+}
+
+func validateSignature(body []byte, signature string, webhookSecret string) error {
 	if webhookSecret == "" {
 		return nil
 	}
@@ -21,6 +21,33 @@ else
     echo "✅ repos directory already exists"
 fi
 
+# Create data directory if it doesn't exist
+if [ ! -d data ]; then
+    echo "📁 Creating data directory..."
+    mkdir -p data
+    echo "✅ data directory created!"
+else
+    echo "✅ data directory already exists"
+fi
+
+# Create routes directory if it doesn't exist
+if [ ! -d routes ]; then
+    echo "📁 Creating routes directory..."
+    mkdir -p routes
+    echo "✅ routes directory created!"
+else
+    echo "✅ routes directory already exists"
+fi
+
+# Create an empty config file so it can be mounted
+if [ ! -f config.yaml ]; then
+    echo "📝 Creating config.yaml..."
+    echo "repos: {}" > config.yaml
+    echo "✅ config.yaml created!"
+else
+    echo "✅ config.yaml already exists"
+fi
+
 echo "🎉 Setup complete!"
 echo ""
 echo "Next steps:"
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/karindrlainux/flying-cup/pkg/deployment"
+	"github.com/karindrlainux/flying-cup/pkg/providers"
+	"github.com/labstack/echo/v4"
+)
+
+// wakeRouter is the Traefik router sending requests of stopped previews to the controller
+const wakeRouter = "flying-cup-wake"
+
+// wakeHeader is set by a Traefik middleware on the wake router only, telling the requests
+// of sleeping previews from those routed to the controller itself
+const wakeHeader = "X-Flying-Cup-Wake"
+
+// wakeWait is how long a request waits for its preview to wake up before getting a retry page
+const wakeWait = 20 * time.Second
+
+// wakePreviews serves the requests Traefik falls back to the controller for, because the
+// preview of their host has no route. The preview is started, and the request gets a page
+// refreshing until Traefik routes the host to the preview again.
+func wakePreviews(scaler *deployment.IdleScaler, domain string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get(wakeHeader) == "" {
+				return next(c)
+			}
+
+			host := c.Request().Host
+			if name, _, err := net.SplitHostPort(host); err == nil {
+				host = name
+			}
+			if !strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(domain)) {
+				return next(c)
+			}
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), wakeWait)
+			defer cancel()
+
+			ref, err := scaler.Wake(ctx, host)
+			switch {
+			case errors.Is(err, deployment.ErrUnknownPreview):
+				return c.HTML(http.StatusNotFound, wakePage("Preview not running",
+					"No preview is running at this address. Push to the pull request, or comment <code>/preview wake</code> on it, to deploy it again.", 0))
+			case errors.Is(err, context.DeadlineExceeded):
+				c.Response().Header().Set("Retry-After", "5")
+				return c.HTML(http.StatusServiceUnavailable, wakePage("Waking up the preview",
+					"The preview was stopped for lack of traffic and is starting again. This page refreshes once it is ready.", 5))
+			case err != nil:
+				return c.HTML(http.StatusBadGateway, wakePage("Preview failed to start", html.EscapeString(err.Error()), 0))
+			}
+
+			// Redirecting would land here again until Traefik loaded the route of the preview,
+			// so refresh shortly instead
+			if ref.Phase != providers.PhaseReady {
+				log.Printf("⏰ Preview %s woken up by a request to %s", ref.ID, host)
+			}
+			c.Response().Header().Set("Retry-After", "1")
+			return c.HTML(http.StatusServiceUnavailable, wakePage("Preview is up",
+				"The preview is running again. This page refreshes in a moment.", 1))
+		}
+	}
+}
+
+// wakePage renders a page refreshing every refresh seconds, or never when zero
+func wakePage(title, message string, refresh int) string {
+	meta := ""
+	if refresh > 0 {
+		meta = fmt.Sprintf(`<meta http-equiv="refresh" content="%d">`, refresh)
+	}
+
+	return fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+%s
+<title>%s</title>
+</head>
+<body style="font-family: sans-serif; text-align: center; margin-top: 15vh">
+<h1>☕ %s</h1>
+<p>%s</p>
+</body>
+</html>`, meta, title, title, message)
+}